@@ -1,9 +1,15 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -13,30 +19,135 @@ import (
 
 // RootOptions provides the information that will be used to build a firewall configuration.
 type RootOptions struct {
-	IncomingProxyPort     int
-	OutgoingProxyPort     int
-	ProxyUserID           int
-	PortsToRedirect       []int
-	InboundPortsToIgnore  []string
-	OutboundPortsToIgnore []string
-	SimulateOnly          bool
-	NetNs                 string
-	UseWaitFlag           bool
-	TimeoutCloseWaitSecs  int
+	IncomingProxyPort       int
+	OutgoingProxyPort       int
+	ProxyAdminPort          int
+	ProxyUserID             int
+	ProxyGroupID            int
+	PortsToRedirect         []int
+	OutboundPortsToRedirect []int
+	PortRangesToRedirect    []string
+	InboundPortTargets      map[string]int
+	OutboundPortTargets     map[string]int
+	InboundPortsToIgnore    []string
+	OutboundPortsToIgnore   []string
+	SimulateOnly            bool
+	NetNs                   string
+	UseWaitFlag             bool
+	WaitSeconds             int
+	WaitInterval            time.Duration
+	TimeoutCloseWaitSecs    int
+	IPFamily                string
+	Backend                 string
+	RedirectUDP             bool
+	OutboundCIDRsToIgnore   []string
+	InboundCIDRsToIgnore    []string
+	ProxyMode               string
+	TproxyMark              int
+	UseIptablesRestore      bool
+	VerifyRules             bool
+	CheckOnly               bool
+	Timeout                 time.Duration
+	MaxRetries              int
+	RetryBackoff            time.Duration
+	LoopbackInterface       string
+	RedirectChainName       string
+	JumpPosition            int
+	OutputChainName         string
+	IptablesPath            string
+	IptablesSavePath        string
+	Ip6tablesPath           string
+	Ip6tablesSavePath       string
+	NsenterPath             string
+	NetNsPID                int
+	SkipInbound             bool
+	SkipOutbound            bool
+	StrictCleanup           bool
+	DumpScript              bool
+	Plan                    bool
+	SelfTest                bool
+	FwMark                  int
+	FwMarkMask              int
+	DisableComments         bool
+	CommentPrefix           string
+	LogRedirects            bool
+	LogPackets              bool
+	LogRateLimit            string
+	IgnoreEstablished       bool
+	SkipStateDump           bool
+	IgnoreClusterDNS        bool
+	ClusterDNSAddresses     []string
+	Masquerade              bool
+	SNATAddress             string
+	UseDNAT                 bool
+	DNATAddress             string
+	SkipSpecialRanges       bool
+	ReconcileExisting       bool
+	ProxyUIDRange           string
+	IgnoreICMP              bool
+	InsertIgnoredPorts      bool
+	NoTrackPorts            []int
+	CommentLabel            string
+	SkipInstalledRules      bool
+	ProbePorts              []int
+	Env                     []string
+	IgnoreDNAT              bool
+	RollbackOnFailure       bool
+	IgnoreNodeLocal         bool
+	NodeAddresses           []string
+	ScopeJumpsToProtocols   bool
+	ListModes               bool
+	LoopbackCIDRs           []string
+	StateDumpTimeout        time.Duration
+	RedirectNewOnly         bool
+	IgnoreTarget            string
+	PreserveForeignChains   bool
+	InboundInterface        string
+	OutboundInterface       string
 }
 
 func newRootOptions() *RootOptions {
 	return &RootOptions{
-		IncomingProxyPort:     -1,
-		OutgoingProxyPort:     -1,
-		ProxyUserID:           -1,
-		PortsToRedirect:       make([]int, 0),
-		InboundPortsToIgnore:  make([]string, 0),
-		OutboundPortsToIgnore: make([]string, 0),
-		SimulateOnly:          false,
-		NetNs:                 "",
-		UseWaitFlag:           false,
-		TimeoutCloseWaitSecs:  0,
+		IncomingProxyPort:       -1,
+		OutgoingProxyPort:       -1,
+		ProxyAdminPort:          0,
+		ProxyUserID:             -1,
+		ProxyGroupID:            -1,
+		PortsToRedirect:         make([]int, 0),
+		OutboundPortsToRedirect: make([]int, 0),
+		NoTrackPorts:            make([]int, 0),
+		ProbePorts:              make([]int, 0),
+		PortRangesToRedirect:    make([]string, 0),
+		InboundPortsToIgnore:    make([]string, 0),
+		OutboundPortsToIgnore:   make([]string, 0),
+		SimulateOnly:            false,
+		NetNs:                   "",
+		NsenterPath:             iptables.DefaultNsenterPath,
+		UseWaitFlag:             false,
+		WaitSeconds:             0,
+		WaitInterval:            0,
+		TimeoutCloseWaitSecs:    0,
+		IPFamily:                iptables.IPv4Family,
+		Backend:                 "",
+		RedirectUDP:             false,
+		OutboundCIDRsToIgnore:   make([]string, 0),
+		InboundCIDRsToIgnore:    make([]string, 0),
+		ClusterDNSAddresses:     make([]string, 0),
+		NodeAddresses:           make([]string, 0),
+		ProxyMode:               iptables.RedirectProxyMode,
+		TproxyMark:              iptables.DefaultTproxyMark,
+		UseIptablesRestore:      false,
+		VerifyRules:             false,
+		CheckOnly:               false,
+		Timeout:                 0,
+		MaxRetries:              0,
+		RetryBackoff:            time.Second,
+		LoopbackInterface:       iptables.DefaultLoopbackInterface,
+		LoopbackCIDRs:           make([]string, 0),
+		RedirectChainName:       iptables.ProxyInitRedirectChainName,
+		JumpPosition:            0,
+		OutputChainName:         iptables.ProxyInitOutputChainName,
+		CommentPrefix:           iptables.DefaultCommentPrefix,
 	}
 }
 
@@ -51,6 +162,45 @@ func NewRootCmd() *cobra.Command {
 		Long:  "proxy-init adds a Kubernetes pod to the Linkerd service mesh.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 
+			if options.SelfTest {
+				err := iptables.SelfTest()
+				if errors.Is(err, iptables.ErrSelfTestSkipped) {
+					log.Printf("Skipping the self-test: %s", err)
+					return nil
+				}
+				return err
+			}
+
+			if options.ListModes {
+				for _, mode := range iptables.ValidModes() {
+					if _, err := fmt.Fprintln(cmd.OutOrStdout(), mode); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			if options.DumpScript {
+				config, err := BuildFirewallConfiguration(options)
+				if err != nil {
+					return err
+				}
+				return iptables.DumpScript(cmd.OutOrStdout(), *config)
+			}
+
+			if options.Plan {
+				config, err := BuildFirewallConfiguration(options)
+				if err != nil {
+					return err
+				}
+				plan, err := config.Plan()
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(cmd.OutOrStdout(), string(plan))
+				return err
+			}
+
 			if options.TimeoutCloseWaitSecs != 0 {
 				sysctl := exec.Command("sysctl", "-w",
 					fmt.Sprintf("net.netfilter.nf_conntrack_tcp_timeout_close_wait=%d", options.TimeoutCloseWaitSecs),
@@ -66,20 +216,102 @@ func NewRootCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			return iptables.ConfigureFirewall(*config)
+
+			ctx := context.Background()
+			if options.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+				defer cancel()
+			}
+			return iptables.ConfigureFirewall(ctx, *config)
 		},
 	}
 
 	cmd.PersistentFlags().IntVarP(&options.IncomingProxyPort, "incoming-proxy-port", "p", options.IncomingProxyPort, "Port to redirect incoming traffic")
 	cmd.PersistentFlags().IntVarP(&options.OutgoingProxyPort, "outgoing-proxy-port", "o", options.OutgoingProxyPort, "Port to redirect outgoing traffic")
-	cmd.PersistentFlags().IntVarP(&options.ProxyUserID, "proxy-uid", "u", options.ProxyUserID, "User ID that the proxy is running under. Any traffic coming from this user will be ignored to avoid infinite redirection loops.")
+	cmd.PersistentFlags().IntVar(&options.ProxyAdminPort, "proxy-admin-port", options.ProxyAdminPort, "Port of the proxy's admin server, whose inbound traffic is never redirected. Optional")
+	cmd.PersistentFlags().IntVarP(&options.ProxyUserID, "proxy-uid", "u", options.ProxyUserID, "User ID that the proxy is running under, 0 for root. Any traffic coming from this user will be ignored to avoid infinite redirection loops.")
+	cmd.PersistentFlags().StringVar(&options.ProxyUIDRange, "proxy-uid-range", options.ProxyUIDRange, "Range of user IDs the proxies are running under, e.g. 2102-2110, instead of --proxy-uid")
+	cmd.PersistentFlags().IntVar(&options.ProxyGroupID, "proxy-gid", options.ProxyGroupID, "Group ID that the proxy is running under, 0 for root. Any traffic coming from this group will be ignored to avoid infinite redirection loops.")
 	cmd.PersistentFlags().IntSliceVarP(&options.PortsToRedirect, "ports-to-redirect", "r", options.PortsToRedirect, "Port to redirect to proxy, if no port is specified then ALL ports are redirected")
+	cmd.PersistentFlags().IntSliceVar(&options.OutboundPortsToRedirect, "outbound-ports-to-redirect", options.OutboundPortsToRedirect, "Outbound destination port to redirect to proxy, if no port is specified then ALL outbound ports are redirected")
+	cmd.PersistentFlags().BoolVar(&options.SkipInbound, "skip-inbound", options.SkipInbound, "Don't redirect incoming traffic to the proxy")
+	cmd.PersistentFlags().BoolVar(&options.SkipOutbound, "skip-outbound", options.SkipOutbound, "Don't redirect outgoing traffic to the proxy")
+	cmd.PersistentFlags().IntVar(&options.FwMark, "fwmark", options.FwMark, "Fwmark set on outgoing traffic redirected to the proxy, for policy routing. No mark is set when 0")
+	cmd.PersistentFlags().IntVar(&options.FwMarkMask, "fwmark-mask", options.FwMarkMask, "Mask of the bits set by --fwmark. The whole fwmark is set when 0")
+	cmd.PersistentFlags().BoolVar(&options.DisableComments, "disable-comments", options.DisableComments, "Don't add comments to the rules, for iptables builds lacking the comment match")
+	cmd.PersistentFlags().StringVar(&options.CommentPrefix, "comment-prefix", options.CommentPrefix, "Prefix of the comments identifying the rules")
+	cmd.PersistentFlags().StringVar(&options.CommentLabel, "comment-label", options.CommentLabel, "Label added to the comments of the rules, such as the name of the pod they're applied for")
+	cmd.PersistentFlags().BoolVar(&options.LogRedirects, "log-redirects", options.LogRedirects, "Log the original destination of new inbound connections to the kernel log before redirecting them")
+	cmd.PersistentFlags().BoolVar(&options.LogPackets, "log-packets", options.LogPackets, "Log the packets entering the proxy-init chains and those redirected to the proxy to the kernel log")
+	cmd.PersistentFlags().StringVar(&options.LogRateLimit, "log-rate-limit", options.LogRateLimit, "Maximum rate of the entries logged by --log-packets, such as 10/second. No limit when empty")
+	cmd.PersistentFlags().BoolVar(&options.IgnoreEstablished, "ignore-established", options.IgnoreEstablished, "Don't redirect the outgoing traffic of connections established before the rules were applied")
+	cmd.PersistentFlags().BoolVar(&options.IgnoreClusterDNS, "ignore-cluster-dns", options.IgnoreClusterDNS, "Don't redirect the DNS queries to the cluster DNS, read from /etc/resolv.conf unless --cluster-dns-addresses is set")
+	cmd.PersistentFlags().StringSliceVar(&options.ClusterDNSAddresses, "cluster-dns-addresses", options.ClusterDNSAddresses, "Addresses of the cluster DNS ignored with --ignore-cluster-dns")
+	cmd.PersistentFlags().BoolVar(&options.Masquerade, "masquerade", options.Masquerade, "Rewrite the source of the redirected outgoing traffic to the address of the outgoing interface")
+	cmd.PersistentFlags().StringVar(&options.SNATAddress, "snat-address", options.SNATAddress, "Rewrite the source of the redirected outgoing traffic to this address")
+	cmd.PersistentFlags().BoolVar(&options.UseDNAT, "use-dnat", options.UseDNAT, "Redirect traffic to the proxy with DNAT to --dnat-address instead of REDIRECT")
+	cmd.PersistentFlags().StringVar(&options.DNATAddress, "dnat-address", options.DNATAddress, "Address traffic is sent to with --use-dnat, the loopback address by default")
+	cmd.PersistentFlags().BoolVar(&options.SkipSpecialRanges, "skip-special-ranges", options.SkipSpecialRanges, "Don't redirect the outgoing traffic to the link-local and multicast ranges, such as the cloud metadata service")
+	cmd.PersistentFlags().BoolVar(&options.ReconcileExisting, "reconcile-existing", options.ReconcileExisting, "Apply only the differences with the installed rules instead of removing the proxy-init chains first")
+	cmd.PersistentFlags().BoolVar(&options.IgnoreICMP, "ignore-icmp", options.IgnoreICMP, "Don't redirect the ICMP traffic, to keep path MTU discovery and diagnostics working")
+	cmd.PersistentFlags().BoolVar(&options.InsertIgnoredPorts, "insert-ignored-ports", options.InsertIgnoredPorts, "Insert the rules ignoring the inbound and outbound ports at the top of their chain, so that they take precedence over every other rule of the chain")
+	cmd.PersistentFlags().IntSliceVar(&options.NoTrackPorts, "notrack-ports", options.NoTrackPorts, "Ports whose traffic is exempted from connection tracking, and therefore never redirected to proxy")
+	cmd.PersistentFlags().BoolVar(&options.SkipInstalledRules, "skip-installed-rules", options.SkipInstalledRules, "Keep the chains and rules of previous runs, only adding the rules iptables-save doesn't list yet")
+	cmd.PersistentFlags().IntSliceVar(&options.ProbePorts, "probe-ports", options.ProbePorts, "Ports of the liveness and readiness probes, whose inbound traffic is never redirected to proxy")
+	cmd.PersistentFlags().StringArrayVar(&options.Env, "env", options.Env, "Environment variable of the iptables commands, as KEY=VALUE, e.g. to pin PATH. Can be repeated. When unset, the environment is inherited")
+	cmd.PersistentFlags().BoolVar(&options.IgnoreDNAT, "ignore-dnat", options.IgnoreDNAT, "Don't redirect the incoming traffic whose destination was already translated, e.g. by kube-proxy")
+	cmd.PersistentFlags().BoolVar(&options.RollbackOnFailure, "rollback-on-failure", options.RollbackOnFailure, "Restore the rules as they were before the run when applying them fails or times out")
+	cmd.PersistentFlags().BoolVar(&options.IgnoreNodeLocal, "ignore-node-local", options.IgnoreNodeLocal, "Don't redirect the outgoing traffic to the node, whose addresses must be set with --node-addresses unless running in the host network namespace with --netns or --netns-pid")
+	cmd.PersistentFlags().StringSliceVar(&options.NodeAddresses, "node-addresses", options.NodeAddresses, "Addresses of the node ignored with --ignore-node-local")
+	cmd.PersistentFlags().BoolVar(&options.ScopeJumpsToProtocols, "scope-jumps-to-protocols", options.ScopeJumpsToProtocols, "Jump into the proxy-init chains once per redirected protocol rather than for all protocols")
+	cmd.PersistentFlags().BoolVar(&options.RedirectNewOnly, "redirect-new-only", options.RedirectNewOnly, "Only redirect new connections, leaving the flows going on when the rules are applied alone")
+	cmd.PersistentFlags().DurationVar(&options.StateDumpTimeout, "state-dump-timeout", options.StateDumpTimeout, "Give up on listing the rules before and after applying them past this duration, 0 for no limit")
+	cmd.PersistentFlags().StringVar(&options.IgnoreTarget, "ignore-target", options.IgnoreTarget, "Chain the ignored ports and CIDRs are sent to, ending with a verdict such as ACCEPT; RETURN when empty")
+	cmd.PersistentFlags().BoolVar(&options.PreserveForeignChains, "preserve-foreign-chains", options.PreserveForeignChains, "Only ever remove the PROXY_INIT_ chains and the jumps carrying the proxy-init comment")
+	cmd.PersistentFlags().StringVar(&options.InboundInterface, "inbound-interface", options.InboundInterface, "Only redirect the incoming traffic arriving on this interface")
+	cmd.PersistentFlags().StringVar(&options.OutboundInterface, "outbound-interface", options.OutboundInterface, "Only redirect the outgoing traffic leaving through this interface, which can't be the loopback interface")
+	cmd.PersistentFlags().BoolVar(&options.SkipStateDump, "skip-state-dump", options.SkipStateDump, "Don't list the rules before and after applying them")
+	cmd.PersistentFlags().BoolVar(&options.SelfTest, "self-test", options.SelfTest, "Don't change anything, just check that the rules can be applied in a temporary network namespace")
+	cmd.PersistentFlags().BoolVar(&options.DumpScript, "dump-script", options.DumpScript, "Don't change anything, just print the iptables commands as a shell script")
+	cmd.PersistentFlags().BoolVar(&options.Plan, "plan", options.Plan, "Don't change anything, just print the rules to apply as JSON")
+	cmd.PersistentFlags().BoolVar(&options.ListModes, "list-modes", options.ListModes, "Don't change anything, just print the valid redirect modes")
+	cmd.PersistentFlags().BoolVar(&options.StrictCleanup, "strict-cleanup", options.StrictCleanup, "Fail if the chains left behind by a previous run can't be removed")
+	cmd.PersistentFlags().StringSliceVar(&options.PortRangesToRedirect, "port-ranges-to-redirect", options.PortRangesToRedirect, "Port ranges (inclusive) to redirect to proxy, in addition to --ports-to-redirect")
+	cmd.PersistentFlags().StringToIntVar(&options.InboundPortTargets, "inbound-port-targets", options.InboundPortTargets, "Proxy port to redirect some of the --ports-to-redirect to instead of --incoming-proxy-port, e.g. 8080=4144")
+	cmd.PersistentFlags().StringToIntVar(&options.OutboundPortTargets, "outbound-port-targets", options.OutboundPortTargets, "Proxy port to redirect some of the --outbound-ports-to-redirect to instead of --outgoing-proxy-port, e.g. 443=4145")
 	cmd.PersistentFlags().StringSliceVar(&options.InboundPortsToIgnore, "inbound-ports-to-ignore", options.InboundPortsToIgnore, "Inbound ports and/or port ranges (inclusive) to ignore and not redirect to proxy. This has higher precedence than any other parameters.")
 	cmd.PersistentFlags().StringSliceVar(&options.OutboundPortsToIgnore, "outbound-ports-to-ignore", options.OutboundPortsToIgnore, "Outbound ports and/or port ranges (inclusive) to ignore and not redirect to proxy. This has higher precedence than any other parameters.")
 	cmd.PersistentFlags().BoolVar(&options.SimulateOnly, "simulate", options.SimulateOnly, "Don't execute any command, just print what would be executed")
 	cmd.PersistentFlags().StringVar(&options.NetNs, "netns", options.NetNs, "Optional network namespace in which to run the iptables commands")
+	cmd.PersistentFlags().IntVar(&options.NetNsPID, "netns-pid", options.NetNsPID, "Optional PID of a process whose network namespace the iptables commands run in, instead of --netns")
+	cmd.PersistentFlags().StringVar(&options.NsenterPath, "nsenter-path", options.NsenterPath, "Path of the nsenter binary used to enter the network namespace")
 	cmd.PersistentFlags().BoolVarP(&options.UseWaitFlag, "use-wait-flag", "w", options.UseWaitFlag, "Appends the \"-w\" flag to the iptables commands")
+	cmd.PersistentFlags().IntVar(&options.WaitSeconds, "wait-seconds", options.WaitSeconds, "Maximum number of seconds iptables waits for the xtables lock with --use-wait-flag. No limit when 0")
+	cmd.PersistentFlags().DurationVar(&options.WaitInterval, "wait-interval", options.WaitInterval, "How often iptables tries to acquire the xtables lock with --use-wait-flag. iptables' default when 0")
 	cmd.PersistentFlags().IntVar(&options.TimeoutCloseWaitSecs, "timeout-close-wait-secs", options.TimeoutCloseWaitSecs, "Sets nf_conntrack_tcp_timeout_close_wait")
+	cmd.PersistentFlags().StringVar(&options.IPFamily, "ip-family", options.IPFamily, fmt.Sprintf("IP family to configure rules for: %q, %q or %q", iptables.IPv4Family, iptables.IPv6Family, iptables.DualStackFamily))
+	cmd.PersistentFlags().StringVar(&options.Backend, "backend", options.Backend, fmt.Sprintf("Optional iptables backend to use: %q, %q or %q. By default the iptables binaries on the PATH are used", iptables.LegacyBackend, iptables.NftBackend, iptables.AutoBackend))
+	cmd.PersistentFlags().BoolVar(&options.RedirectUDP, "redirect-udp", options.RedirectUDP, "Redirect UDP traffic to the proxy in addition to TCP traffic")
+	cmd.PersistentFlags().StringSliceVar(&options.OutboundCIDRsToIgnore, "outbound-cidrs-to-ignore", options.OutboundCIDRsToIgnore, "Outbound destination CIDRs to ignore and not redirect to proxy")
+	cmd.PersistentFlags().StringSliceVar(&options.InboundCIDRsToIgnore, "inbound-cidrs-to-ignore", options.InboundCIDRsToIgnore, "Inbound source CIDRs to ignore and not redirect to proxy")
+	cmd.PersistentFlags().StringVar(&options.ProxyMode, "proxy-mode", options.ProxyMode, fmt.Sprintf("How inbound traffic is sent to the proxy: %q (nat table) or %q (mangle table, preserving the original destination)", iptables.RedirectProxyMode, iptables.TproxyProxyMode))
+	cmd.PersistentFlags().IntVar(&options.TproxyMark, "tproxy-mark", options.TproxyMark, "Fwmark set on packets intercepted in \"tproxy\" proxy mode")
+	cmd.PersistentFlags().BoolVar(&options.UseIptablesRestore, "use-iptables-restore", options.UseIptablesRestore, "Apply all the rules atomically in a single iptables-restore call")
+	cmd.PersistentFlags().BoolVar(&options.VerifyRules, "verify-rules", options.VerifyRules, "Fail if the rules redirecting traffic to the proxy are missing once applied")
+	cmd.PersistentFlags().BoolVar(&options.CheckOnly, "check", options.CheckOnly, "Don't change anything, just fail if the installed rules differ from the ones that would be applied")
+	cmd.PersistentFlags().DurationVar(&options.Timeout, "timeout", options.Timeout, "Maximum time to spend configuring iptables, including waiting for the xtables lock. No limit when 0")
+	cmd.PersistentFlags().IntVar(&options.MaxRetries, "max-retries", options.MaxRetries, "Number of times an iptables command failing because the xtables lock is held is retried")
+	cmd.PersistentFlags().DurationVar(&options.RetryBackoff, "retry-backoff", options.RetryBackoff, "Delay before the first retry of an iptables command, doubled for every following retry")
+	cmd.PersistentFlags().StringVar(&options.LoopbackInterface, "loopback-interface", options.LoopbackInterface, "Name of the loopback device, whose traffic isn't redirected")
+	cmd.PersistentFlags().StringSliceVar(&options.LoopbackCIDRs, "loopback-cidrs", options.LoopbackCIDRs, "Loopback destinations of the proxy's traffic to itself, at most one per IP family, 127.0.0.1/32 and ::1/128 by default")
+	cmd.PersistentFlags().StringVar(&options.RedirectChainName, "redirect-chain-name", options.RedirectChainName, "Name of the chain redirecting incoming traffic to the proxy")
+	cmd.PersistentFlags().StringVar(&options.OutputChainName, "output-chain-name", options.OutputChainName, "Name of the chain redirecting outgoing traffic to the proxy")
+	cmd.PersistentFlags().IntVar(&options.JumpPosition, "jump-position", options.JumpPosition, "Position at which the jumps to the proxy-init chains are inserted in PREROUTING and OUTPUT, 1 being the first rule. When 0, the jumps are appended")
+	cmd.PersistentFlags().StringVar(&options.IptablesPath, "iptables-path", options.IptablesPath, "Path of the iptables binary. Looked up on the PATH when empty")
+	cmd.PersistentFlags().StringVar(&options.IptablesSavePath, "iptables-save-path", options.IptablesSavePath, "Path of the iptables-save binary. Looked up on the PATH when empty")
+	cmd.PersistentFlags().StringVar(&options.Ip6tablesPath, "ip6tables-path", options.Ip6tablesPath, "Path of the ip6tables binary. Looked up on the PATH when empty")
+	cmd.PersistentFlags().StringVar(&options.Ip6tablesSavePath, "ip6tables-save-path", options.Ip6tablesSavePath, "Path of the ip6tables-save binary. Looked up on the PATH when empty")
 
 	return cmd
 }
@@ -94,23 +326,259 @@ func BuildFirewallConfiguration(options *RootOptions) (*iptables.FirewallConfigu
 		return nil, fmt.Errorf("--outgoing-proxy-port must be a valid TCP port number")
 	}
 
+	if options.ProxyAdminPort != 0 && !ports.IsValid(options.ProxyAdminPort) {
+		return nil, fmt.Errorf("--proxy-admin-port must be a valid TCP port number")
+	}
+
+	switch options.IPFamily {
+	case iptables.IPv4Family, iptables.IPv6Family, iptables.DualStackFamily:
+	default:
+		return nil, fmt.Errorf("--ip-family must be one of %q, %q or %q", iptables.IPv4Family, iptables.IPv6Family, iptables.DualStackFamily)
+	}
+
+	for _, portRange := range options.PortRangesToRedirect {
+		if _, err := ports.ParsePortRange(portRange); err != nil {
+			return nil, fmt.Errorf("--port-ranges-to-redirect must only contain valid port ranges: %s", err)
+		}
+	}
+
+	var inboundPortTargets map[int]int
+	for port, target := range options.InboundPortTargets {
+		parsed, err := strconv.Atoi(port)
+		if err != nil || !ports.IsValid(parsed) {
+			return nil, fmt.Errorf("--inbound-port-targets must only map valid port numbers, got %q", port)
+		}
+		if inboundPortTargets == nil {
+			inboundPortTargets = make(map[int]int)
+		}
+		inboundPortTargets[parsed] = target
+	}
+
+	var outboundPortTargets map[int]int
+	for port, target := range options.OutboundPortTargets {
+		parsed, err := strconv.Atoi(port)
+		if err != nil || !ports.IsValid(parsed) {
+			return nil, fmt.Errorf("--outbound-port-targets must only map valid port numbers, got %q", port)
+		}
+		if outboundPortTargets == nil {
+			outboundPortTargets = make(map[int]int)
+		}
+		outboundPortTargets[parsed] = target
+	}
+
+	var proxyUIDRange [2]int
+	if options.ProxyUIDRange != "" {
+		bounds := strings.Split(options.ProxyUIDRange, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("--proxy-uid-range must be a range of user IDs such as 2102-2110, got %q", options.ProxyUIDRange)
+		}
+		for i, bound := range bounds {
+			id, err := strconv.Atoi(bound)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("--proxy-uid-range must be a range of user IDs such as 2102-2110, got %q", options.ProxyUIDRange)
+			}
+			proxyUIDRange[i] = id
+		}
+		if proxyUIDRange[0] > proxyUIDRange[1] {
+			return nil, fmt.Errorf("--proxy-uid-range must not start after its end, got %q", options.ProxyUIDRange)
+		}
+		if options.ProxyUserID != -1 {
+			return nil, fmt.Errorf("--proxy-uid and --proxy-uid-range can't be used together")
+		}
+	}
+
+	for _, cidr := range options.OutboundCIDRsToIgnore {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("--outbound-cidrs-to-ignore must only contain valid CIDRs, got %q", cidr)
+		}
+	}
+
+	for _, cidr := range options.InboundCIDRsToIgnore {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("--inbound-cidrs-to-ignore must only contain valid CIDRs, got %q", cidr)
+		}
+	}
+
+	for _, address := range options.ClusterDNSAddresses {
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("--cluster-dns-addresses must only contain valid IP addresses, got %q", address)
+		}
+	}
+
+	for _, cidr := range options.LoopbackCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("--loopback-cidrs must only contain valid CIDRs, got %q", cidr)
+		}
+	}
+
+	for _, address := range options.NodeAddresses {
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("--node-addresses must only contain valid IP addresses, got %q", address)
+		}
+	}
+
+	if options.SNATAddress != "" && net.ParseIP(options.SNATAddress) == nil {
+		return nil, fmt.Errorf("--snat-address must be a valid IP address, got %q", options.SNATAddress)
+	}
+
+	if options.DNATAddress != "" && net.ParseIP(options.DNATAddress) == nil {
+		return nil, fmt.Errorf("--dnat-address must be a valid IP address, got %q", options.DNATAddress)
+	}
+
+	if options.DNATAddress != "" && !options.UseDNAT {
+		return nil, fmt.Errorf("--dnat-address requires --use-dnat")
+	}
+
+	if options.Masquerade && options.SNATAddress != "" {
+		return nil, fmt.Errorf("--masquerade and --snat-address can't be used together")
+	}
+
+	switch options.ProxyMode {
+	case iptables.RedirectProxyMode, iptables.TproxyProxyMode:
+	default:
+		return nil, fmt.Errorf("--proxy-mode must be one of %q or %q", iptables.RedirectProxyMode, iptables.TproxyProxyMode)
+	}
+
+	if options.TproxyMark <= 0 {
+		return nil, fmt.Errorf("--tproxy-mark must be a positive number")
+	}
+
+	switch options.Backend {
+	case "", iptables.LegacyBackend, iptables.NftBackend, iptables.AutoBackend:
+	default:
+		return nil, fmt.Errorf("--backend must be one of %q, %q or %q", iptables.LegacyBackend, iptables.NftBackend, iptables.AutoBackend)
+	}
+
+	if options.WaitSeconds < 0 {
+		return nil, fmt.Errorf("--wait-seconds must not be negative")
+	}
+
+	if options.WaitInterval < 0 {
+		return nil, fmt.Errorf("--wait-interval must not be negative")
+	}
+
+	if options.JumpPosition < 0 {
+		return nil, fmt.Errorf("--jump-position must not be negative")
+	}
+
+	if options.MaxRetries < 0 {
+		return nil, fmt.Errorf("--max-retries must not be negative")
+	}
+
+	if options.RetryBackoff < 0 {
+		return nil, fmt.Errorf("--retry-backoff must not be negative")
+	}
+
+	if options.StateDumpTimeout < 0 {
+		return nil, fmt.Errorf("--state-dump-timeout must not be negative")
+	}
+
+	// -1 means the proxy's user or group isn't known, which the firewall configuration represents as 0 without
+	// HasProxyUID or HasProxyGID, since 0 is root's ID
+	proxyUID := options.ProxyUserID
+	if proxyUID == -1 {
+		proxyUID = 0
+	}
+	proxyGID := options.ProxyGroupID
+	if proxyGID == -1 {
+		proxyGID = 0
+	}
+
 	firewallConfiguration := &iptables.FirewallConfiguration{
-		ProxyInboundPort:       options.IncomingProxyPort,
-		ProxyOutgoingPort:      options.OutgoingProxyPort,
-		ProxyUID:               options.ProxyUserID,
-		PortsToRedirectInbound: options.PortsToRedirect,
-		InboundPortsToIgnore:   options.InboundPortsToIgnore,
-		OutboundPortsToIgnore:  options.OutboundPortsToIgnore,
-		SimulateOnly:           options.SimulateOnly,
-		NetNs:                  options.NetNs,
-		UseWaitFlag:            options.UseWaitFlag,
-	}
-
-	if len(options.PortsToRedirect) > 0 {
+		ProxyInboundPort:            options.IncomingProxyPort,
+		ProxyOutgoingPort:           options.OutgoingProxyPort,
+		ProxyAdminPort:              options.ProxyAdminPort,
+		ProxyUID:                    proxyUID,
+		ProxyGID:                    proxyGID,
+		HasProxyUID:                 options.ProxyUserID != -1,
+		HasProxyGID:                 options.ProxyGroupID != -1,
+		ProxyUIDRange:               proxyUIDRange,
+		IgnoreICMP:                  options.IgnoreICMP,
+		InsertIgnoredPorts:          options.InsertIgnoredPorts,
+		NoTrackPorts:                options.NoTrackPorts,
+		PortsToRedirectInbound:      options.PortsToRedirect,
+		PortsToRedirectOutbound:     options.OutboundPortsToRedirect,
+		PortRangesToRedirectInbound: options.PortRangesToRedirect,
+		InboundPortTargets:          inboundPortTargets,
+		OutboundPortTargets:         outboundPortTargets,
+		InboundPortsToIgnore:        options.InboundPortsToIgnore,
+		OutboundPortsToIgnore:       options.OutboundPortsToIgnore,
+		SimulateOnly:                options.SimulateOnly,
+		NetNs:                       options.NetNs,
+		UseWaitFlag:                 options.UseWaitFlag,
+		WaitFlagSeconds:             options.WaitSeconds,
+		WaitInterval:                options.WaitInterval,
+		IPFamily:                    options.IPFamily,
+		Backend:                     options.Backend,
+		RedirectUDP:                 options.RedirectUDP,
+		OutboundCIDRsToIgnore:       options.OutboundCIDRsToIgnore,
+		InboundCIDRsToIgnore:        options.InboundCIDRsToIgnore,
+		ProxyMode:                   options.ProxyMode,
+		TproxyMark:                  options.TproxyMark,
+		UseIptablesRestore:          options.UseIptablesRestore,
+		VerifyRules:                 options.VerifyRules,
+		CheckMode:                   options.CheckOnly,
+		MaxRetries:                  options.MaxRetries,
+		RetryBackoff:                options.RetryBackoff,
+		StateDumpTimeout:            options.StateDumpTimeout,
+		RedirectNewOnly:             options.RedirectNewOnly,
+		IgnoreTarget:                options.IgnoreTarget,
+		PreserveForeignChains:       options.PreserveForeignChains,
+		InboundInterface:            options.InboundInterface,
+		OutboundInterface:           options.OutboundInterface,
+		LoopbackInterface:           options.LoopbackInterface,
+		LoopbackCIDRs:               options.LoopbackCIDRs,
+		RedirectChainName:           options.RedirectChainName,
+		OutputChainName:             options.OutputChainName,
+		JumpPosition:                options.JumpPosition,
+		IptablesPath:                options.IptablesPath,
+		IptablesSavePath:            options.IptablesSavePath,
+		Ip6tablesPath:               options.Ip6tablesPath,
+		Ip6tablesSavePath:           options.Ip6tablesSavePath,
+		NsenterPath:                 options.NsenterPath,
+		NetNsPID:                    options.NetNsPID,
+		SkipInbound:                 options.SkipInbound,
+		SkipOutbound:                options.SkipOutbound,
+		StrictCleanup:               options.StrictCleanup,
+		FwMark:                      options.FwMark,
+		FwMarkMask:                  options.FwMarkMask,
+		DisableComments:             options.DisableComments,
+		CommentPrefix:               options.CommentPrefix,
+		CommentLabel:                options.CommentLabel,
+		SkipInstalledRules:          options.SkipInstalledRules,
+		ProbePorts:                  options.ProbePorts,
+		Env:                         options.Env,
+		IgnoreDNAT:                  options.IgnoreDNAT,
+		RollbackOnFailure:           options.RollbackOnFailure,
+		IgnoreNodeLocal:             options.IgnoreNodeLocal,
+		NodeAddresses:               options.NodeAddresses,
+		ScopeJumpsToProtocols:       options.ScopeJumpsToProtocols,
+		LogRedirects:                options.LogRedirects,
+		LogPackets:                  options.LogPackets,
+		LogRateLimit:                options.LogRateLimit,
+		IgnoreEstablished:           options.IgnoreEstablished,
+		SkipStateDump:               options.SkipStateDump,
+		IgnoreClusterDNS:            options.IgnoreClusterDNS,
+		ClusterDNSAddresses:         options.ClusterDNSAddresses,
+		Masquerade:                  options.Masquerade,
+		SNATAddress:                 options.SNATAddress,
+		UseDNAT:                     options.UseDNAT,
+		DNATAddress:                 options.DNATAddress,
+		SkipSpecialRanges:           options.SkipSpecialRanges,
+		ReconcileExisting:           options.ReconcileExisting,
+	}
+
+	if len(options.PortsToRedirect) > 0 || len(options.PortRangesToRedirect) > 0 {
 		firewallConfiguration.Mode = iptables.RedirectListedMode
 	} else {
 		firewallConfiguration.Mode = iptables.RedirectAllMode
 	}
 
+	if len(options.OutboundPortsToRedirect) > 0 {
+		firewallConfiguration.OutboundMode = iptables.RedirectListedMode
+	} else {
+		firewallConfiguration.OutboundMode = iptables.RedirectAllMode
+	}
+
 	return firewallConfiguration, nil
 }
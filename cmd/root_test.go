@@ -3,6 +3,7 @@ package cmd
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/linkerd/linkerd2-proxy-init/iptables"
 )
@@ -13,15 +14,35 @@ func TestBuildFirewallConfiguration(t *testing.T) {
 		expectedOutgoingProxyPort := 2345
 		expectedProxyUserID := 33
 		expectedConfig := &iptables.FirewallConfiguration{
-			Mode:                   iptables.RedirectAllMode,
-			PortsToRedirectInbound: make([]int, 0),
-			InboundPortsToIgnore:   make([]string, 0),
-			OutboundPortsToIgnore:  make([]string, 0),
-			ProxyInboundPort:       expectedIncomingProxyPort,
-			ProxyOutgoingPort:      expectedOutgoingProxyPort,
-			ProxyUID:               expectedProxyUserID,
-			SimulateOnly:           false,
-			UseWaitFlag:            false,
+			Mode:                        iptables.RedirectAllMode,
+			PortsToRedirectInbound:      make([]int, 0),
+			PortsToRedirectOutbound:     make([]int, 0),
+			OutboundMode:                iptables.RedirectAllMode,
+			InboundPortsToIgnore:        make([]string, 0),
+			OutboundPortsToIgnore:       make([]string, 0),
+			ProxyInboundPort:            expectedIncomingProxyPort,
+			ProxyOutgoingPort:           expectedOutgoingProxyPort,
+			ProxyUID:                    expectedProxyUserID,
+			HasProxyUID:                 true,
+			SimulateOnly:                false,
+			UseWaitFlag:                 false,
+			IPFamily:                    iptables.IPv4Family,
+			OutboundCIDRsToIgnore:       make([]string, 0),
+			InboundCIDRsToIgnore:        make([]string, 0),
+			ClusterDNSAddresses:         make([]string, 0),
+			NodeAddresses:               make([]string, 0),
+			NoTrackPorts:                make([]int, 0),
+			ProbePorts:                  make([]int, 0),
+			ProxyMode:                   iptables.RedirectProxyMode,
+			TproxyMark:                  iptables.DefaultTproxyMark,
+			PortRangesToRedirectInbound: make([]string, 0),
+			RetryBackoff:                time.Second,
+			LoopbackInterface:           iptables.DefaultLoopbackInterface,
+			LoopbackCIDRs:               make([]string, 0),
+			NsenterPath:                 iptables.DefaultNsenterPath,
+			RedirectChainName:           iptables.ProxyInitRedirectChainName,
+			OutputChainName:             iptables.ProxyInitOutputChainName,
+			CommentPrefix:               iptables.DefaultCommentPrefix,
 		}
 
 		options := newRootOptions()
@@ -72,6 +93,70 @@ func TestBuildFirewallConfiguration(t *testing.T) {
 				},
 				errorMessage: "--outgoing-proxy-port must be a valid TCP port number",
 			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort: 1234,
+					OutgoingProxyPort: 2345,
+					IPFamily:          "ipv5",
+				},
+				errorMessage: "--ip-family must be one of \"ipv4\", \"ipv6\" or \"dual-stack\"",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:     1234,
+					OutgoingProxyPort:     2345,
+					IPFamily:              iptables.IPv4Family,
+					OutboundCIDRsToIgnore: []string{"10.0.0.0/33"},
+				},
+				errorMessage: "--outbound-cidrs-to-ignore must only contain valid CIDRs, got \"10.0.0.0/33\"",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:  1234,
+					OutgoingProxyPort:  2345,
+					IPFamily:           iptables.IPv4Family,
+					InboundPortTargets: map[string]int{"http": 4144},
+				},
+				errorMessage: "--inbound-port-targets must only map valid port numbers, got \"http\"",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:   1234,
+					OutgoingProxyPort:   2345,
+					IPFamily:            iptables.IPv4Family,
+					OutboundPortTargets: map[string]int{"https": 4145},
+				},
+				errorMessage: "--outbound-port-targets must only map valid port numbers, got \"https\"",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:   1234,
+					OutgoingProxyPort:   2345,
+					IPFamily:            iptables.IPv4Family,
+					ClusterDNSAddresses: []string{"kube-dns"},
+				},
+				errorMessage: "--cluster-dns-addresses must only contain valid IP addresses, got \"kube-dns\"",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort: 1234,
+					OutgoingProxyPort: 2345,
+					IPFamily:          iptables.IPv4Family,
+					Masquerade:        true,
+					SNATAddress:       "10.0.0.1",
+				},
+				errorMessage: "--masquerade and --snat-address can't be used together",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort: 1234,
+					OutgoingProxyPort: 2345,
+					IPFamily:          iptables.IPv4Family,
+					ProxyUserID:       -1,
+					ProxyUIDRange:     "2110-2102",
+				},
+				errorMessage: "--proxy-uid-range must not start after its end, got \"2110-2102\"",
+			},
 		} {
 			_, err := BuildFirewallConfiguration(tt.options)
 			if err == nil {
@@ -1,5 +1,5 @@
 module github.com/linkerd/linkerd2-proxy-init
 
-go 1.12
+go 1.13
 
 require github.com/spf13/cobra v0.0.5
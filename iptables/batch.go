@@ -0,0 +1,95 @@
+package iptables
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultConcurrency is the number of network namespaces ConfigureFirewalls configures at once when no concurrency is
+// given.
+const DefaultConcurrency = 4
+
+// ConfigureFirewalls configures the network namespace of each configuration, e.g. the pods of a node, from a single
+// process. The returned errors are at the index of their configuration, nil when it was applied. Configurations only
+// differing by their network namespace are validated once, the iptables backend being detected in each namespace.
+//
+// At most concurrency namespaces are configured at once, DefaultConcurrency when it isn't positive. The namespaces
+// share the xtables lock, so UseWaitFlag or MaxRetries should be set when configuring several at once. The
+// configurations not started by the time ctx is done fail with its error.
+func ConfigureFirewalls(ctx context.Context, firewallConfigurations []FirewallConfiguration, concurrency int) []error {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	errs := make([]error, len(firewallConfigurations))
+	validated := make([]validation, 0)
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, firewallConfiguration := range firewallConfigurations {
+		firewallConfiguration.ctx = ctx
+
+		var err error
+		if previous, ok := findValidation(validated, firewallConfiguration); ok {
+			err = previous.err
+		} else {
+			err = validateFirewall(firewallConfiguration)
+			validated = append(validated, validation{firewallConfiguration, err})
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, firewallConfiguration FirewallConfiguration) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			logger(firewallConfiguration).Info("Tracing this script execution", "traceID", traceID(firewallConfiguration), "netns", firewallConfiguration.NetNs, "netnsPID", firewallConfiguration.NetNsPID)
+			start := time.Now()
+			defer func() {
+				metrics(firewallConfiguration).ApplyDuration(time.Since(start))
+			}()
+			errs[i] = configureFirewall(firewallConfiguration)
+		}(i, firewallConfiguration)
+	}
+	wg.Wait()
+	return errs
+}
+
+// validation is the outcome of validateFirewall for a configuration.
+type validation struct {
+	firewallConfiguration FirewallConfiguration
+	err                   error
+}
+
+// findValidation returns the validation of a configuration only differing from the given one by its network
+// namespace.
+func findValidation(validated []validation, firewallConfiguration FirewallConfiguration) (validation, bool) {
+	for _, v := range validated {
+		if sameExceptNamespace(v.firewallConfiguration, firewallConfiguration) {
+			return v, true
+		}
+	}
+	return validation{}, false
+}
+
+// sameExceptNamespace checks whether the configurations only differ by their network namespace. Whether they run in
+// the host network namespace must still match, as the validation depends on it. Configurations with hooks are never
+// the same, as functions can't be compared.
+func sameExceptNamespace(a FirewallConfiguration, b FirewallConfiguration) bool {
+	if runsInHostNamespace(a) != runsInHostNamespace(b) {
+		return false
+	}
+	a.NetNs, a.NetNsPID = "", 0
+	b.NetNs, b.NetNsPID = "", 0
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,88 @@
+package iptables
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestConfigureFirewalls(t *testing.T) {
+	namespaces := []string{"/var/run/netns/pod-a", "/var/run/netns/pod-b", "/var/run/netns/pod-c"}
+	configurations := make([]FirewallConfiguration, 0)
+	runners := make([]*recordingRunner, 0)
+	for _, netns := range namespaces {
+		runner := &recordingRunner{}
+		runners = append(runners, runner)
+		configurations = append(configurations, FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			NetNs:             netns,
+			Runner:            runner,
+		})
+	}
+	// invalid configurations fail on their own
+	configurations = append(configurations, FirewallConfiguration{
+		Mode:              "unknown",
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		NetNs:             "/var/run/netns/pod-d",
+		Runner:            &recordingRunner{},
+	})
+
+	errs := ConfigureFirewalls(context.Background(), configurations, 2)
+	if len(errs) != len(configurations) {
+		t.Fatalf("expected %d errors but got %d", len(configurations), len(errs))
+	}
+	for i := range namespaces {
+		if errs[i] != nil {
+			t.Fatalf("unexpected error for %s: %s", namespaces[i], errs[i])
+		}
+	}
+	if errs[3] == nil {
+		t.Fatalf("expected the invalid configuration to fail")
+	}
+
+	for i, runner := range runners {
+		if len(runner.commands) == 0 {
+			t.Fatalf("expected commands to be run in %s", namespaces[i])
+		}
+		for _, command := range runner.commands {
+			if !strings.Contains(command, "--net="+namespaces[i]) {
+				t.Fatalf("expected %s to be run in %s", command, namespaces[i])
+			}
+		}
+	}
+}
+
+func TestConfigureFirewalls_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	runner := &recordingRunner{}
+	errs := ConfigureFirewalls(ctx, []FirewallConfiguration{{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		Runner:            runner,
+	}}, 1)
+	// The configuration may have taken the free slot before noticing the cancellation.
+	if errs[0] == nil {
+		t.Fatalf("expected the configuration to fail once canceled")
+	}
+}
+
+func TestSameExceptNamespace(t *testing.T) {
+	a := FirewallConfiguration{Mode: RedirectAllMode, PortsToRedirectInbound: []int{8080}, NetNs: "/var/run/netns/a"}
+	b := FirewallConfiguration{Mode: RedirectAllMode, PortsToRedirectInbound: []int{8080}, NetNsPID: 42}
+	if !sameExceptNamespace(a, b) {
+		t.Fatalf("expected configurations only differing by their namespace to be the same")
+	}
+	b.PortsToRedirectInbound = []int{9090}
+	if sameExceptNamespace(a, b) {
+		t.Fatalf("expected configurations with different ports not to be the same")
+	}
+	if sameExceptNamespace(a, FirewallConfiguration{Mode: RedirectAllMode, PortsToRedirectInbound: []int{8080}}) {
+		t.Fatalf("expected a configuration of the current namespace not to be the same as one entering another")
+	}
+}
@@ -0,0 +1,79 @@
+package iptables
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// RuleBuilder builds the commands adding individual proxy-init rules, without running them, for tools composing their
+// own rule sets out of the same primitives as BuildRules. The commands use the iptables binary of the IP family and
+// backend, the nat table, the loopback interface, the DNAT address and the comment settings of the configuration.
+type RuleBuilder struct {
+	firewallConfiguration FirewallConfiguration
+}
+
+// NewRuleBuilder returns a RuleBuilder for the configuration, which isn't validated. The IPv4 binary is used unless
+// the IP family is IPv6Family.
+func NewRuleBuilder(firewallConfiguration FirewallConfiguration) *RuleBuilder {
+	return &RuleBuilder{firewallConfiguration: firewallConfiguration}
+}
+
+// CreateChain creates the chain.
+func (b *RuleBuilder) CreateChain(chainName string, comment string) *exec.Cmd {
+	return b.build(makeCreateNewChain(b.binary(), b.table(), chainName, comment))
+}
+
+// JumpTo sends all the traffic of the chain to the target chain, appending the rule or inserting it at the position
+// when it's positive.
+func (b *RuleBuilder) JumpTo(chainName string, targetChain string, position int, comment string) *exec.Cmd {
+	return b.build(makeJumpFromChainToAnotherForAllProtocols(b.binary(), b.table(), chainName, position, "", "", targetChain, comment))
+}
+
+// RedirectToPort redirects the traffic of the protocol to the destination port or port range, or to any port when
+// empty, to the proxy port.
+func (b *RuleBuilder) RedirectToPort(chainName string, protocol string, destination string, proxyPort int, comment string) *exec.Cmd {
+	if destination == "" {
+		return b.build(makeRedirectChainToPort(b.binary(), b.table(), chainName, protocol, dnatAddress(b.firewallConfiguration), proxyPort, comment))
+	}
+	return b.build(makeRedirectChainToPortBasedOnDestinationPort(b.binary(), b.table(), chainName, protocol, destination, dnatAddress(b.firewallConfiguration), proxyPort, comment))
+}
+
+// IgnorePorts leaves the traffic of the protocol to the ports or port ranges alone, or sends it to the IgnoreTarget
+// of the configuration. A single rule references at most IptablesMultiportLimit ports, a range counting as two.
+func (b *RuleBuilder) IgnorePorts(chainName string, protocol string, ports []string, comment string) *exec.Cmd {
+	return b.build(makeIgnorePorts(b.binary(), b.table(), chainName, 0, protocol, ports, ignoreTarget(b.firewallConfiguration), comment))
+}
+
+// IgnoreUID leaves the traffic of the user alone.
+func (b *RuleBuilder) IgnoreUID(chainName string, uid int, comment string) *exec.Cmd {
+	return b.build(makeIgnoreOwner(b.binary(), b.table(), chainName, "--uid-owner", strconv.Itoa(uid), comment))
+}
+
+// IgnoreGID leaves the traffic of the group alone.
+func (b *RuleBuilder) IgnoreGID(chainName string, gid int, comment string) *exec.Cmd {
+	return b.build(makeIgnoreOwner(b.binary(), b.table(), chainName, "--gid-owner", strconv.Itoa(gid), comment))
+}
+
+// IgnoreLoopback leaves the traffic sent through the loopback interface alone.
+func (b *RuleBuilder) IgnoreLoopback(chainName string, comment string) *exec.Cmd {
+	return b.build(makeIgnoreLoopback(b.binary(), b.table(), chainName, loopbackInterface(b.firewallConfiguration), comment))
+}
+
+// Rule returns the rule the command adds, as it would be listed by ListInstalledRules, or false when the command
+// doesn't add a rule.
+func (b *RuleBuilder) Rule(cmd *exec.Cmd) (Rule, bool) {
+	return addedRule(b.binary(), cmd)
+}
+
+func (b *RuleBuilder) build(cmd *exec.Cmd) *exec.Cmd {
+	applyCommentSettings(b.firewallConfiguration, cmd)
+	return cmd
+}
+
+func (b *RuleBuilder) binary() string {
+	return iptablesBinary(b.firewallConfiguration)
+}
+
+func (b *RuleBuilder) table() string {
+	return natTable(b.firewallConfiguration)
+}
@@ -0,0 +1,61 @@
+package iptables
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuleBuilder(t *testing.T) {
+	builder := NewRuleBuilder(FirewallConfiguration{IPFamily: IPv6Family, CommentPrefix: "my-mesh"})
+	comment := func(text string) string {
+		return "my-mesh/" + text + "/" + ExecutionTraceID
+	}
+
+	for _, tt := range []struct {
+		name     string
+		cmd      *exec.Cmd
+		expected string
+	}{
+		{"create chain", builder.CreateChain("MY_CHAIN", "my-chain"), "ip6tables -t nat -N MY_CHAIN -m comment --comment " + comment("my-chain")},
+		{"jump", builder.JumpTo("OUTPUT", "MY_CHAIN", 1, "install-my-chain"), "ip6tables -t nat -I OUTPUT 1 -j MY_CHAIN -m comment --comment " + comment("install-my-chain")},
+		{"redirect all ports", builder.RedirectToPort("MY_CHAIN", "tcp", "", 4140, "redirect-all"), "ip6tables -t nat -A MY_CHAIN -p tcp -j REDIRECT --to-port 4140 -m comment --comment " + comment("redirect-all")},
+		{"redirect a port", builder.RedirectToPort("MY_CHAIN", "tcp", "8080", 4143, "redirect-8080"), "ip6tables -t nat -A MY_CHAIN -p tcp --destination-port 8080 -j REDIRECT --to-port 4143 -m comment --comment " + comment("redirect-8080")},
+		{"ignore ports", builder.IgnorePorts("MY_CHAIN", "udp", []string{"53", "8000:8100"}, "ignore-dns"), "ip6tables -t nat -A MY_CHAIN -p udp --match multiport --dports 53,8000:8100 -j RETURN -m comment --comment " + comment("ignore-dns")},
+		{"ignore uid", builder.IgnoreUID("MY_CHAIN", 2102, "ignore-proxy"), "ip6tables -t nat -A MY_CHAIN -m owner --uid-owner 2102 -j RETURN -m comment --comment " + comment("ignore-proxy")},
+		{"ignore gid", builder.IgnoreGID("MY_CHAIN", 0, "ignore-root"), "ip6tables -t nat -A MY_CHAIN -m owner --gid-owner 0 -j RETURN -m comment --comment " + comment("ignore-root")},
+		{"ignore loopback", builder.IgnoreLoopback("MY_CHAIN", "ignore-loopback"), "ip6tables -t nat -A MY_CHAIN -o lo -j RETURN -m comment --comment " + comment("ignore-loopback")},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := strings.Join(tt.cmd.Args, " "); actual != tt.expected {
+				t.Fatalf("expected\n%s\nbut got\n%s", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRuleBuilder_Rule(t *testing.T) {
+	builder := NewRuleBuilder(FirewallConfiguration{})
+
+	rule, ok := builder.Rule(builder.IgnoreUID("MY_CHAIN", 2102, "ignore-proxy"))
+	if !ok {
+		t.Fatalf("expected the command to add a rule")
+	}
+	expected := Rule{
+		Table:         "nat",
+		Chain:         "MY_CHAIN",
+		Matches:       []string{"-m", "owner", "--uid-owner", "2102"},
+		Target:        "RETURN",
+		TargetOptions: []string{},
+		Comment:       formatComment("ignore-proxy"),
+	}
+	if !reflect.DeepEqual(rule, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, rule)
+	}
+
+	if _, ok := builder.Rule(builder.CreateChain("MY_CHAIN", "my-chain")); ok {
+		t.Fatalf("expected the creation of a chain not to add a rule")
+	}
+}
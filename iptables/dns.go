@@ -0,0 +1,62 @@
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// resolvConfPath is the resolver configuration listing the nameservers of the cluster DNS.
+var resolvConfPath = "/etc/resolv.conf"
+
+// clusterDNSAddresses returns the addresses of the cluster DNS to ignore: the configured ClusterDNSAddresses or, when
+// none are configured, the nameservers listed in /etc/resolv.conf.
+func clusterDNSAddresses(firewallConfiguration FirewallConfiguration) ([]string, error) {
+	if len(firewallConfiguration.ClusterDNSAddresses) > 0 {
+		return firewallConfiguration.ClusterDNSAddresses, nil
+	}
+
+	resolvConf, err := ioutil.ReadFile(resolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the cluster DNS addresses: %w", err)
+	}
+	addresses := parseNameservers(resolvConf)
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("could not read the cluster DNS addresses: no nameserver found in %s", resolvConfPath)
+	}
+	return addresses, nil
+}
+
+// parseNameservers returns the addresses of the nameservers listed in the resolver configuration, without
+// duplicates. Addresses with a zone, such as `fe80::1%eth0`, can't be matched by iptables and are skipped.
+func parseNameservers(resolvConf []byte) []string {
+	addresses := make([]string, 0)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(resolvConf))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && !seen[ip.String()] {
+			seen[ip.String()] = true
+			addresses = append(addresses, ip.String())
+		}
+	}
+	return addresses
+}
+
+// addressesForFamily returns the addresses belonging to the IP family.
+func addressesForFamily(addresses []string, family string) []string {
+	familyAddresses := make([]string, 0)
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip != nil && (ip.To4() != nil) == (family != IPv6Family) {
+			familyAddresses = append(familyAddresses, address)
+		}
+	}
+	return familyAddresses
+}
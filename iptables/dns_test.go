@@ -0,0 +1,99 @@
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNameservers(t *testing.T) {
+	resolvConf := `# generated by the kubelet
+search default.svc.cluster.local svc.cluster.local cluster.local
+nameserver 10.96.0.10
+nameserver fd00:10:96::a
+nameserver 10.96.0.10
+nameserver fe80::1%eth0
+options ndots:5
+`
+	addresses := parseNameservers([]byte(resolvConf))
+	expected := []string{"10.96.0.10", "fd00:10:96::a"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("expected nameservers %v but got %v", expected, addresses)
+	}
+}
+
+func TestClusterDNSAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+
+	t.Run("It fails without resolv.conf", func(t *testing.T) {
+		if _, err := clusterDNSAddresses(FirewallConfiguration{}); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	if err := ioutil.WriteFile(resolvConfPath, []byte("nameserver 10.96.0.10\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Run("It reads the nameservers of resolv.conf", func(t *testing.T) {
+		addresses, err := clusterDNSAddresses(FirewallConfiguration{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(addresses, []string{"10.96.0.10"}) {
+			t.Fatalf("expected the nameserver of resolv.conf but got %v", addresses)
+		}
+	})
+
+	t.Run("It prefers the configured addresses", func(t *testing.T) {
+		addresses, err := clusterDNSAddresses(FirewallConfiguration{ClusterDNSAddresses: []string{"10.0.0.10"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(addresses, []string{"10.0.0.10"}) {
+			t.Fatalf("expected the configured address but got %v", addresses)
+		}
+	})
+}
+
+func TestBuildRules_IgnoreClusterDNS(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                RedirectAllMode,
+		ProxyInboundPort:    4143,
+		ProxyOutgoingPort:   4140,
+		IPFamily:            DualStackFamily,
+		IgnoreClusterDNS:    true,
+		ClusterDNSAddresses: []string{"10.96.0.10", "10.96.0.11", "fd00:10:96::a"},
+		SkipInbound:         true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "--dport 53") {
+			found = append(found, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp -d 10.96.0.10 --dport 53 -j RETURN -m comment --comment " + formatComment("ignore-cluster-dns-tcp-10.96.0.10"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p udp -d 10.96.0.10 --dport 53 -j RETURN -m comment --comment " + formatComment("ignore-cluster-dns-udp-10.96.0.10"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp -d 10.96.0.11 --dport 53 -j RETURN -m comment --comment " + formatComment("ignore-cluster-dns-tcp-10.96.0.11"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p udp -d 10.96.0.11 --dport 53 -j RETURN -m comment --comment " + formatComment("ignore-cluster-dns-udp-10.96.0.11"),
+		"ip6tables -t nat -A PROXY_INIT_OUTPUT -p tcp -d fd00:10:96::a --dport 53 -j RETURN -m comment --comment " + formatComment("ignore-cluster-dns-tcp-fd00:10:96::a"),
+		"ip6tables -t nat -A PROXY_INIT_OUTPUT -p udp -d fd00:10:96::a --dport 53 -j RETURN -m comment --comment " + formatComment("ignore-cluster-dns-udp-fd00:10:96::a"),
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("unexpected DNS rules:\ngot:\n%s\nexpected:\n%s", strings.Join(found, "\n"), strings.Join(expected, "\n"))
+	}
+}
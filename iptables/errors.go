@@ -0,0 +1,94 @@
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrLockTimeout reports a command that failed because another process held the xtables lock, including after
+	// waiting for it with UseWaitFlag or retrying with MaxRetries. Retrying later may succeed.
+	ErrLockTimeout = errors.New("the xtables lock is held by another process")
+	// ErrPermission reports a command or check that failed for lack of privileges, such as the NET_ADMIN capability.
+	ErrPermission = errors.New("permission denied")
+	// ErrChainExists reports a command that failed because the chain to create already exists.
+	ErrChainExists = errors.New("chain already exists")
+	// ErrNoChain reports a command that failed because the chain, target or match it refers to doesn't exist.
+	ErrNoChain = errors.New("no such chain, target or match")
+	// ErrOwnerMatchUnavailable reports a command that failed because the kernel lacks the xt_owner module behind the
+	// owner match, which the rules telling the proxy's own traffic apart rely on.
+	ErrOwnerMatchUnavailable = errors.New("the owner match is unavailable")
+	// ErrInvalidCommand reports a command iptables rejected as malformed, such as an unknown option or a bad argument.
+	ErrInvalidCommand = errors.New("invalid command")
+)
+
+// failureKinds maps the messages of iptables to the errors they are classified as, checked in order.
+var failureKinds = []struct {
+	messages []string
+	kind     error
+}{
+	{[]string{"holding the xtables lock", "Resource temporarily unavailable"}, ErrLockTimeout},
+	{[]string{"Permission denied", "Operation not permitted"}, ErrPermission},
+	{[]string{"Chain already exists"}, ErrChainExists},
+	{[]string{"match `owner'", "Extension owner revision"}, ErrOwnerMatchUnavailable},
+	{[]string{"No chain/target/match by that name"}, ErrNoChain},
+	{[]string{"Bad argument", "unknown option", "Invalid argument", "for more information"}, ErrInvalidCommand},
+}
+
+// CommandError is returned when a command fails. It wraps the error of the command, such as an *exec.ExitError, and
+// matches the sentinel error its output is classified as with errors.Is, so that callers can tell whether to retry.
+type CommandError struct {
+	// Args are the arguments of the command, including the binary.
+	Args []string
+	// Err is the error the command failed with.
+	Err error
+	// Detail is the output explaining the failure, preferably the standard error.
+	Detail string
+	// Kind is the sentinel error the failure is classified as, or nil for unknown failures.
+	Kind error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command %q failed: %s: %s", e.Args, e.Err, e.Detail)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the sentinel error the failure is classified as.
+func (e *CommandError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// newCommandError classifies the failure of the command based on its output and error.
+func newCommandError(args []string, err error, detail string) *CommandError {
+	commandError := &CommandError{Args: args, Err: err, Detail: detail}
+	for _, failure := range failureKinds {
+		for _, message := range failure.messages {
+			if strings.Contains(detail, message) || strings.Contains(err.Error(), message) {
+				commandError.Kind = failure.kind
+				break
+			}
+		}
+		if commandError.Kind != nil {
+			break
+		}
+	}
+	// Legacy iptables reports a missing xt_owner module like a missing chain.
+	if commandError.Kind == ErrNoChain && usesOwnerMatch(args) {
+		commandError.Kind = ErrOwnerMatchUnavailable
+	}
+	return commandError
+}
+
+// usesOwnerMatch checks whether the arguments of the command load the owner match.
+func usesOwnerMatch(args []string) bool {
+	for i := 0; i < len(args)-1; i++ {
+		if (args[i] == "-m" || args[i] == "--match") && args[i+1] == "owner" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package iptables
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestExecuteCommand_ClassifiesFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		output   string
+		expected error
+	}{
+		{"lock", "Another app is currently holding the xtables lock. Perhaps you want to use the -w option?", ErrLockTimeout},
+		{"permission", "iptables v1.8.4 (legacy): can't initialize iptables table `nat': Permission denied (you must be root)", ErrPermission},
+		{"existing chain", "iptables: Chain already exists.", ErrChainExists},
+		{"missing chain", "iptables: No chain/target/match by that name.", ErrNoChain},
+		{"owner match", "iptables v1.8.4 (legacy): Couldn't load match `owner':No such file or directory\n\nTry `iptables -h' or 'iptables --help' for more information.", ErrOwnerMatchUnavailable},
+		{"syntax", "iptables v1.8.4 (legacy): unknown option \"--to-prot\"\nTry `iptables -h' or 'iptables --help' for more information.", ErrInvalidCommand},
+		{"unknown", "iptables: Something unexpected happened.", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			failure := errors.New("exit status 1")
+			runner := &scriptedRunner{
+				outputs: map[string]string{"iptables -t nat -N PROXY_INIT_REDIRECT": tt.output},
+				errors:  map[string]error{"iptables -t nat -N PROXY_INIT_REDIRECT": failure},
+			}
+			err := executeCommand(FirewallConfiguration{Runner: runner}, exec.Command("iptables", "-t", "nat", "-N", "PROXY_INIT_REDIRECT"))
+
+			var commandError *CommandError
+			if !errors.As(err, &commandError) || !errors.Is(err, failure) {
+				t.Fatalf("expected a CommandError wrapping [%s] but got [%v]", failure, err)
+			}
+			for _, kind := range []error{ErrLockTimeout, ErrPermission, ErrChainExists, ErrNoChain, ErrOwnerMatchUnavailable, ErrInvalidCommand} {
+				if errors.Is(err, kind) != (kind == tt.expected) {
+					t.Fatalf("expected error [%s] to match [%v] only but it matches [%s]: %t", err, tt.expected, kind, errors.Is(err, kind))
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteCommands_OwnerMatchUnavailable(t *testing.T) {
+	command := "iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -j RETURN"
+	runner := &scriptedRunner{
+		outputs: map[string]string{command: "iptables v1.8.4 (legacy): Couldn't load match `owner':No such file or directory\n"},
+		errors:  map[string]error{command: errors.New("exit status 2")},
+	}
+	cmd := exec.Command("iptables", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-m", "owner", "--uid-owner", "2102", "-j", "RETURN")
+	err := executeCommands(FirewallConfiguration{Runner: runner}, "iptables", []*exec.Cmd{cmd})
+	if !errors.Is(err, ErrOwnerMatchUnavailable) {
+		t.Fatalf("expected the owner match to be reported unavailable but got [%v]", err)
+	}
+	if !strings.Contains(err.Error(), "load the xt_owner kernel module") {
+		t.Fatalf("expected the error to explain how to fix it but got: %s", err)
+	}
+}
+
+func TestExecuteCommand_OwnerMatchMissingOnLegacy(t *testing.T) {
+	command := "iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -j RETURN"
+	runner := &scriptedRunner{
+		outputs: map[string]string{command: "iptables: No chain/target/match by that name.\n"},
+		errors:  map[string]error{command: errors.New("exit status 1")},
+	}
+	err := executeCommand(FirewallConfiguration{Runner: runner}, exec.Command("iptables", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-m", "owner", "--uid-owner", "2102", "-j", "RETURN"))
+	if !errors.Is(err, ErrOwnerMatchUnavailable) || errors.Is(err, ErrNoChain) {
+		t.Fatalf("expected the owner match to be reported unavailable but got [%v]", err)
+	}
+}
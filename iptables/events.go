@@ -0,0 +1,57 @@
+package iptables
+
+// EventKind identifies the step of the configuration an Event reports.
+type EventKind string
+
+const (
+	// SectionStarted reports that a section of the configuration, such as `adding-rules`, started.
+	SectionStarted EventKind = "section-started"
+	// SectionEnded reports that a section ended, with the error that ended it, if any.
+	SectionEnded EventKind = "section-ended"
+	// CommandRunning reports that a command is about to run.
+	CommandRunning EventKind = "command-running"
+	// CommandResult reports that a command ran, after any retry, with its output and error.
+	CommandResult EventKind = "command-result"
+)
+
+// Event reports the progress of the configuration, as sent to FirewallConfiguration.Events.
+type Event struct {
+	Kind EventKind
+	// Family is the IP family being configured.
+	Family string
+	// Section is the section that started or ended, named as reported to Metrics.ApplyFailed.
+	Section string
+	// Command holds the arguments of the command, before it's wrapped with nsenter, for command events.
+	Command []string
+	// Output is the output of the command, for CommandResult events.
+	Output []byte
+	// Err is the error that ended the section or the command, if any.
+	Err error
+}
+
+// startSection reports that the section of the configuration started.
+func startSection(firewallConfiguration FirewallConfiguration, section string) {
+	sendEvent(firewallConfiguration, Event{Kind: SectionStarted, Section: section})
+}
+
+// endSection reports that the section of the configuration ended with err.
+func endSection(firewallConfiguration FirewallConfiguration, section string, err error) {
+	sendEvent(firewallConfiguration, Event{Kind: SectionEnded, Section: section, Err: err})
+}
+
+// sendEvent sends the event to the configured channel, if any, giving up once the context is done so that an
+// abandoned channel doesn't block the configuration forever.
+func sendEvent(firewallConfiguration FirewallConfiguration, event Event) {
+	if firewallConfiguration.Events == nil {
+		return
+	}
+	event.Family = firewallConfiguration.IPFamily
+	if ctx := firewallConfiguration.ctx; ctx != nil {
+		select {
+		case firewallConfiguration.Events <- event:
+		case <-ctx.Done():
+		}
+		return
+	}
+	firewallConfiguration.Events <- event
+}
@@ -0,0 +1,77 @@
+package iptables
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigureFirewall_Events(t *testing.T) {
+	events := make(chan Event, 1000)
+	runner := &recordingRunner{}
+	err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		SkipStateDump:     true,
+		DisableComments:   true,
+		Runner:            runner,
+		Events:            events,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	close(events)
+
+	sections := make([]string, 0)
+	commands := make([]string, 0)
+	for event := range events {
+		if event.Family != IPv4Family {
+			t.Fatalf("expected the event to be about %s but got %+v", IPv4Family, event)
+		}
+		switch event.Kind {
+		case SectionStarted, SectionEnded:
+			if event.Err != nil {
+				t.Fatalf("unexpected error in event %+v", event)
+			}
+			sections = append(sections, string(event.Kind)+" "+event.Section)
+		case CommandRunning:
+			commands = append(commands, strings.Join(event.Command, " "))
+		case CommandResult:
+			if last := commands[len(commands)-1]; last != strings.Join(event.Command, " ") {
+				t.Fatalf("expected the result of %s but got %+v", last, event)
+			}
+		}
+	}
+
+	expectedSections := []string{
+		"section-started cleanup",
+		"section-ended cleanup",
+		"section-started adding-rules",
+		"section-ended adding-rules",
+	}
+	if !reflect.DeepEqual(sections, expectedSections) {
+		t.Fatalf("expected sections %v but got %v", expectedSections, sections)
+	}
+	if !reflect.DeepEqual(commands, runner.commands) {
+		t.Fatalf("expected an event for every command run\n%v\nbut got\n%v", runner.commands, commands)
+	}
+}
+
+func TestConfigureFirewall_EventsNotReceived(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the configuration must not block on a channel nobody receives from once the context is done
+	err := ConfigureFirewall(ctx, FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		Runner:            &recordingRunner{},
+		Events:            make(chan Event),
+	})
+	if err == nil {
+		t.Fatal("expected an error but got nil")
+	}
+}
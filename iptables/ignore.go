@@ -0,0 +1,170 @@
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/linkerd/linkerd2-proxy-init/ports"
+)
+
+// AddIgnoredPorts widens the ports ignored by the installed proxy-init chains to InboundPortsToIgnore and
+// OutboundPortsToIgnore, without recreating the chains or touching their other rules, e.g. to stop redirecting a port
+// of a running pod. Each port or port range is ignored by its own rule, inserted at the top of the chain unless the
+// rules listed by iptables-save already send it to the IgnoreTarget, such as the multiport rules of ConfigureFirewall
+// or of a previous call, whatever their trace ID. Commands are killed once ctx is done.
+func AddIgnoredPorts(ctx context.Context, firewallConfiguration FirewallConfiguration) error {
+	firewallConfiguration.ctx = ctx
+
+	logger(firewallConfiguration).Info("Tracing this script execution", "traceID", traceID(firewallConfiguration))
+
+	start := time.Now()
+	defer func() {
+		metrics(firewallConfiguration).ApplyDuration(time.Since(start))
+	}()
+
+	if err := validateFirewall(firewallConfiguration); err != nil {
+		return err
+	}
+
+	firewallConfiguration = resolveDirections(resolveBackend(firewallConfiguration))
+
+	if err := checkBinaries(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+
+	if err := checkIgnoreTarget(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		if err := addIgnoredPortsForFamily(familyConfiguration); err != nil {
+			metrics(familyConfiguration).ApplyFailed("adding-rules")
+			return fmt.Errorf("failed to ignore the %s ports: %w", family, err)
+		}
+	}
+	return nil
+}
+
+func addIgnoredPortsForFamily(firewallConfiguration FirewallConfiguration) error {
+	ignored := make(map[string][]ports.PortRange)
+	for _, chain := range proxyInitChains(firewallConfiguration) {
+		if _, ok := ignored[chain.table]; ok {
+			continue
+		}
+		if err := readIgnoredPorts(firewallConfiguration, chain.table, ignored); err != nil {
+			return err
+		}
+	}
+
+	added := 0
+	for _, cmd := range ignoredPortCommands(firewallConfiguration, ignored) {
+		if err := executeCommand(firewallConfiguration, cmd); err != nil {
+			return err
+		}
+		added++
+	}
+	metrics(firewallConfiguration).RulesApplied(added)
+	return nil
+}
+
+// readIgnoredPorts records the port ranges the rules of the table send to the IgnoreTarget, keyed by the table, chain
+// and protocol of the rules. Only the rules matching nothing but a protocol and destination ports are considered, as
+// the others only ignore part of the traffic to the ports. The table is recorded even when it holds no such rules.
+func readIgnoredPorts(firewallConfiguration FirewallConfiguration, table string, ignored map[string][]ports.PortRange) error {
+	ignored[table] = nil
+	if firewallConfiguration.SimulateOnly {
+		return nil
+	}
+	rules, err := readRules(firewallConfiguration, table)
+	if err != nil {
+		return fmt.Errorf("could not read the rules of table %s: %w", table, err)
+	}
+
+	for _, rule := range rules {
+		if rule.Target != ignoreTarget(firewallConfiguration) {
+			continue
+		}
+		protocol, destinations, other := "", []string(nil), false
+		for _, option := range normalizeOptions(rule.Matches) {
+			fields := strings.Fields(option)
+			switch {
+			case len(fields) == 2 && fields[0] == "-p":
+				protocol = fields[1]
+			case len(fields) == 2 && (fields[0] == "--dport" || fields[0] == "--dports"):
+				destinations = strings.Split(fields[1], ",")
+			default:
+				other = true
+			}
+		}
+		if other {
+			continue
+		}
+		key := ignoredPortsKey(table, rule.Chain, protocol)
+		for _, destination := range destinations {
+			if portRange, err := ports.ParsePortRange(strings.Replace(destination, ":", "-", 1)); err == nil {
+				ignored[key] = append(ignored[key], portRange)
+			}
+		}
+	}
+	return nil
+}
+
+// ignoredPortsKey identifies the rules of a chain matching a protocol in the port ranges read by readIgnoredPorts.
+func ignoredPortsKey(table string, chainName string, protocol string) string {
+	return fmt.Sprintf("%s/%s/%s", table, chainName, protocol)
+}
+
+// isIgnored checks whether one of the ignored port ranges includes the port range.
+func isIgnored(ignored []ports.PortRange, portRange ports.PortRange) bool {
+	for _, ignoredRange := range ignored {
+		if ignoredRange.LowerBound <= portRange.LowerBound && portRange.UpperBound <= ignoredRange.UpperBound {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredPortCommands returns the commands inserting a rule per port or port range not ignored yet at the top of the
+// proxy-init chains of the directions that aren't skipped.
+func ignoredPortCommands(firewallConfiguration FirewallConfiguration, ignored map[string][]ports.PortRange) []*exec.Cmd {
+	commands := make([]*exec.Cmd, 0)
+	if !firewallConfiguration.SkipInbound {
+		commands = addIgnoredPortCommands(firewallConfiguration, inboundTable(firewallConfiguration), redirectChainName(firewallConfiguration), firewallConfiguration.InboundPortsToIgnore, ignored, commands)
+	}
+	if !firewallConfiguration.SkipOutbound {
+		commands = addIgnoredPortCommands(firewallConfiguration, natTable(firewallConfiguration), outputChainName(firewallConfiguration), firewallConfiguration.OutboundPortsToIgnore, ignored, commands)
+	}
+	return commands
+}
+
+// addIgnoredPortCommands inserts a rule per port or port range to ignore at the top of the chain, skipping the ones
+// already ignored.
+func addIgnoredPortCommands(firewallConfiguration FirewallConfiguration, table string, chainName string, portsToIgnore []string, ignored map[string][]ports.PortRange, commands []*exec.Cmd) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+	for _, portOrRange := range uniquePortRanges(portsToIgnore) {
+		portRange, err := ports.ParsePortRange(portOrRange)
+		if err != nil {
+			continue
+		}
+		destination := asDestination(portRange)
+		for _, protocol := range protocols(firewallConfiguration) {
+			if isIgnored(ignored[ignoredPortsKey(table, chainName, protocol)], portRange) {
+				logger(firewallConfiguration).Info("The port is already ignored, skipping it", "chain", chainName, "protocol", protocol, "ports", destination)
+				continue
+			}
+			cmd := makeIgnorePorts(binary, table, chainName, 1, protocol, []string{destination}, ignoreTarget(firewallConfiguration), fmt.Sprintf("ignore-port-%s", destination))
+			applyCommentSettings(firewallConfiguration, cmd)
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
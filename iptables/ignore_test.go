@@ -0,0 +1,96 @@
+package iptables
+
+import (
+	"context"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// savingRunner is a CommandRunner keeping the rules appended or inserted by the commands it runs, and listing them
+// in answer to `iptables-save`.
+type savingRunner struct {
+	commands []string
+	rules    []string
+}
+
+func (r *savingRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	command := strings.Join(cmd.Args, " ")
+	r.commands = append(r.commands, command)
+	switch {
+	case len(cmd.Args) > 4 && cmd.Args[3] == "-A":
+		r.rules = append(r.rules, strings.Join(cmd.Args[3:], " "))
+	case len(cmd.Args) > 5 && cmd.Args[3] == "-I":
+		r.rules = append([]string{strings.Join(append([]string{"-A", cmd.Args[4]}, cmd.Args[6:]...), " ")}, r.rules...)
+	case cmd.Args[0] == "iptables-save":
+		return []byte("*nat\n" + strings.Join(r.rules, "\n") + "\nCOMMIT\n"), nil
+	}
+	return nil, nil
+}
+
+func TestAddIgnoredPorts(t *testing.T) {
+	runner := &scriptedRunner{outputs: map[string]string{
+		"iptables-save -t nat": "*nat\n-A PROXY_INIT_REDIRECT -p tcp -m multiport --dports 22 -j RETURN\nCOMMIT\n",
+	}}
+	err := AddIgnoredPorts(context.Background(), FirewallConfiguration{
+		Mode:                  RedirectAllMode,
+		ProxyInboundPort:      4143,
+		ProxyOutgoingPort:     4140,
+		InboundPortsToIgnore:  []string{"22", "9000-9010", "22"},
+		OutboundPortsToIgnore: []string{"3306"},
+		DisableComments:       true,
+		Runner:                runner,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables-save -t nat",
+		"iptables -t nat -I PROXY_INIT_REDIRECT 1 -p tcp --match multiport --dports 9000:9010 -j RETURN",
+		"iptables -t nat -I PROXY_INIT_OUTPUT 1 -p tcp --match multiport --dports 3306 -j RETURN",
+	}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Fatalf("expected only the missing rules to be inserted\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(runner.commands, "\n"))
+	}
+}
+
+func TestAddIgnoredPorts_AfterConfigureFirewall(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                 RedirectAllMode,
+		ProxyInboundPort:     4143,
+		ProxyOutgoingPort:    4140,
+		InboundPortsToIgnore: []string{"4190", "4191"},
+		SkipStateDump:        true,
+	}
+	runner := &savingRunner{}
+	fc.Runner = runner
+	if err := ConfigureFirewall(context.Background(), fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	widened := fc
+	widened.TraceID = "widen"
+	widened.InboundPortsToIgnore = []string{"4190", "4191", "9000"}
+	for i := 0; i < 2; i++ {
+		runner.commands = nil
+		if err := AddIgnoredPorts(context.Background(), widened); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		inserted := make([]string, 0)
+		for _, command := range runner.commands {
+			if strings.Contains(command, " -I ") {
+				inserted = append(inserted, command)
+			}
+		}
+		expected := []string{}
+		if i == 0 {
+			expected = []string{"iptables -t nat -I PROXY_INIT_REDIRECT 1 -p tcp --match multiport --dports 9000 -j RETURN -m comment --comment proxy-init/ignore-port-9000/widen"}
+		}
+		if !reflect.DeepEqual(inserted, expected) {
+			t.Fatalf("call %d: expected\n%s\nbut got\n%s", i+1, strings.Join(expected, "\n"), strings.Join(inserted, "\n"))
+		}
+	}
+}
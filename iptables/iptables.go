@@ -1,9 +1,17 @@
 package iptables
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -25,15 +33,171 @@ const (
 	// IptablesOutputChainName specifies an iptables `OUTPUT` chain.
 	IptablesOutputChainName = "OUTPUT"
 
+	// ProxyInitRedirectChainName specifies the chain holding the rules that redirect incoming traffic to the proxy.
+	ProxyInitRedirectChainName = "PROXY_INIT_REDIRECT"
+
+	// ProxyInitOutputChainName specifies the chain holding the rules that redirect outgoing traffic to the proxy.
+	ProxyInitOutputChainName = "PROXY_INIT_OUTPUT"
+
+	// IptablesPostroutingChainName specifies an iptables `POSTROUTING` chain, responsible for packets about to leave
+	// through a network interface.
+	IptablesPostroutingChainName = "POSTROUTING"
+
+	// ProxyInitPostroutingChainName specifies the chain holding the rules that rewrite the source of redirected traffic.
+	ProxyInitPostroutingChainName = "PROXY_INIT_POSTROUTING"
+
+	// ProxyInitNotrackChainName specifies the chain of the raw table holding the rules that exempt NoTrackPorts from
+	// connection tracking.
+	ProxyInitNotrackChainName = "PROXY_INIT_NOTRACK"
+
 	// IptablesMultiportLimit specifies the maximum number of port references per single iptables command.
 	IptablesMultiportLimit = 15
+
+	// IPv4Family indicates configuring IPv4 rules only, using `iptables`.
+	IPv4Family = "ipv4"
+
+	// IPv6Family indicates configuring IPv6 rules only, using `ip6tables`.
+	IPv6Family = "ipv6"
+
+	// DualStackFamily indicates configuring both IPv4 and IPv6 rules.
+	DualStackFamily = "dual-stack"
+
+	// RedirectProxyMode indicates redirecting inbound traffic to the proxy with the `REDIRECT` target of the nat table.
+	RedirectProxyMode = "redirect"
+
+	// TproxyProxyMode indicates intercepting inbound traffic with the `TPROXY` target of the mangle table, which
+	// preserves the original destination address of the connections.
+	TproxyProxyMode = "tproxy"
+
+	// DefaultTproxyMark specifies the fwmark set on packets intercepted by TPROXY when none is configured.
+	DefaultTproxyMark = 1
+
+	// TproxyRouteTable specifies the routing table that delivers packets marked by TPROXY to the local proxy.
+	TproxyRouteTable = 100
+
+	// maxChainNameLength is the longest chain name iptables accepts.
+	maxChainNameLength = 28
+
+	// maxInterfaceNameLength is the longest network interface name Linux accepts.
+	maxInterfaceNameLength = 15
+
+	// ProxyInitChainPrefix starts the names of the chains PreserveForeignChains allows flushing and deleting.
+	ProxyInitChainPrefix = "PROXY_INIT_"
+
+	// DefaultNatTable specifies the table holding the REDIRECT rules when none is configured.
+	DefaultNatTable = "nat"
+
+	// DefaultCommentPrefix starts the comments identifying the rules when no CommentPrefix is configured.
+	DefaultCommentPrefix = "proxy-init"
+
+	// maxCommentLabelLength is the longest CommentLabel, leaving room for the rest of the comment within the 255
+	// characters the comment match accepts.
+	maxCommentLabelLength = 128
+
+	// maxLogPrefixLength is the longest prefix the LOG target accepts.
+	maxLogPrefixLength = 29
+
+	// maxFwMark is the largest fwmark, which is a 32-bit value.
+	maxFwMark = 0xffffffff
+
+	// DefaultNsenterPath specifies the nsenter binary used to enter the network namespace when none is configured.
+	DefaultNsenterPath = "nsenter"
+
+	// DefaultLoopbackInterface specifies the name of the loopback device when none is configured.
+	DefaultLoopbackInterface = "lo"
+
+	// LegacyBackend indicates using the `iptables-legacy` variant of the iptables binaries.
+	LegacyBackend = "legacy"
+
+	// NftBackend indicates using the `iptables-nft` variant of the iptables binaries.
+	NftBackend = "nft"
+
+	// AutoBackend indicates detecting which iptables variant is in use by looking for existing rules.
+	AutoBackend = "auto"
 )
 
 var (
 	// ExecutionTraceID provides a unique identifier for this script's execution.
-	ExecutionTraceID = strconv.Itoa(int(time.Now().Unix()))
+	ExecutionTraceID = newExecutionTraceID()
 )
 
+// newExecutionTraceID returns an identifier made of the current time in nanoseconds and a random suffix, so that
+// runs starting at the same time, e.g. during rapid pod restarts, still get distinct identifiers.
+func newExecutionTraceID() string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+}
+
+// CommandRunner runs the commands built to configure iptables, returning their output. When the Stderr of the command
+// is set, only the standard output is returned, the standard error being written to Stderr. Otherwise, both are
+// returned combined.
+type CommandRunner interface {
+	Run(cmd *exec.Cmd) ([]byte, error)
+}
+
+// execRunner is the default CommandRunner, executing commands on the host.
+type execRunner struct{}
+
+func (execRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	if cmd.Stderr != nil {
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		err := cmd.Run()
+		return stdout.Bytes(), err
+	}
+	return cmd.CombinedOutput()
+}
+
+// Logger receives the messages emitted while configuring iptables. Besides the message, each entry carries
+// alternating keys and values describing it, such as the chain, port or comment of a rule.
+type Logger interface {
+	Info(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// stdLogger is the default Logger, writing entries as `msg key=value...` lines through the given logger, or through
+// the standard logger when none is given.
+type stdLogger struct {
+	out *log.Logger
+}
+
+func (l stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.print(formatLogEntry(msg, keysAndValues))
+}
+
+func (l stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.print(formatLogEntry("[error] "+msg, keysAndValues))
+}
+
+func (l stdLogger) print(entry string) {
+	if l.out == nil {
+		log.Print(entry)
+		return
+	}
+	l.out.Print(entry)
+}
+
+// formatLogEntry renders a message followed by its fields as `key=value` pairs, quoting values containing spaces.
+func formatLogEntry(msg string, keysAndValues []interface{}) string {
+	var entry strings.Builder
+	entry.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		formatted := fmt.Sprintf("%v", value)
+		if strings.ContainsAny(formatted, " \n") {
+			formatted = strconv.Quote(formatted)
+		}
+		fmt.Fprintf(&entry, " %v=%s", keysAndValues[i], formatted)
+	}
+	return entry.String()
+}
+
 // FirewallConfiguration specifies how to configure a pod's iptables.
 type FirewallConfiguration struct {
 	Mode                   string
@@ -43,137 +207,1880 @@ type FirewallConfiguration struct {
 	ProxyInboundPort       int
 	ProxyOutgoingPort      int
 	ProxyUID               int
+	ProxyGID               int
 	SimulateOnly           bool
 	NetNs                  string
 	UseWaitFlag            bool
+	IPFamily               string
+	Backend                string
+	RedirectUDP            bool
+	InboundCIDRsToIgnore   []string
+	OutboundCIDRsToIgnore  []string
+	ProxyMode              string
+	TproxyMark             int
+	// ProxyAdminPort is the port of the proxy's admin server, whose inbound traffic is ignored along with the traffic
+	// to the proxy's inbound and outbound ports. Optional.
+	ProxyAdminPort int
+	// IgnoreTarget is the target of the rules ignoring InboundPortsToIgnore, OutboundPortsToIgnore,
+	// InboundCIDRsToIgnore and OutboundCIDRsToIgnore, e.g. a chain logging or filtering that traffic. When empty,
+	// RETURN is used. Unless it's RETURN or ACCEPT, the chain must exist in the tables of the proxy-init chains, and
+	// must end with a verdict such as ACCEPT, as traffic falling through it returns to the proxy-init chain and gets
+	// redirected.
+	IgnoreTarget string
+	// OutboundMode is RedirectAllMode or RedirectListedMode, the latter only redirecting outgoing traffic to the
+	// PortsToRedirectOutbound destination ports. When empty, all outgoing traffic is redirected.
+	OutboundMode            string
+	PortsToRedirectOutbound []int
+	// SkipInbound and SkipOutbound leave the incoming, respectively outgoing, traffic alone, for proxies handling a
+	// single direction. Neither the chain nor the jump to it is installed or removed for the skipped direction. The
+	// outgoing traffic is also skipped when ProxyOutgoingPort isn't set.
+	SkipInbound  bool
+	SkipOutbound bool
+	// HasProxyUID and HasProxyGID indicate that ProxyUID, respectively ProxyGID, is set even though it's 0, for
+	// proxies running as root: 0 is a valid ID. Without them, a zero ID is treated as unset and the proxy's traffic
+	// isn't ignored.
+	HasProxyUID bool
+	HasProxyGID bool
+	// ProxyUIDRange ignores the traffic of a range of users, such as those of several sidecars, instead of ProxyUID.
+	// Both bounds are inclusive. The zero value leaves it unset.
+	ProxyUIDRange [2]int
+	// IgnoreICMP leaves the ICMP, or ICMPv6, traffic alone at the top of both chains, so that path MTU discovery and
+	// diagnostics such as ping keep working.
+	IgnoreICMP bool
+	// InsertIgnoredPorts inserts the rules ignoring InboundPortsToIgnore and OutboundPortsToIgnore at the top of their
+	// chain, with `-I`, instead of appending them after the rules for ICMP, established connections, the proxy's own
+	// traffic and the loopback. Either way the ignored ports take precedence over every redirect of their chain, the
+	// rules of a chain being evaluated in order; inserting them also makes them take precedence over the rules which
+	// would otherwise come first, e.g. the redirect of the proxy's traffic to an app container.
+	InsertIgnoredPorts bool
+	// NoTrackPorts exempts the traffic from and to these ports from connection tracking, for high-throughput ports,
+	// with NOTRACK rules in the raw table jumped to from `PREROUTING` and `OUTPUT`. Untracked packets skip the nat
+	// table, so the traffic of these ports is never redirected to the proxy either.
+	NoTrackPorts []int
+	// ProbePorts are the ports the kubelet's liveness and readiness probes connect to, whose inbound traffic is left
+	// alone ahead of every inbound redirect, so that the probes don't fail while the proxy is starting.
+	ProbePorts []int
+	// StrictCleanup aborts the configuration when the chains left behind by a previous run can't be removed. Failures
+	// caused by the chains not existing, as on a first run, are always ignored.
+	StrictCleanup bool
+	// FwMark is the fwmark set on outgoing traffic redirected to the proxy, for `ip rule`s to route it. As the rules
+	// live in the nat table, only the first packet of each connection is marked. When zero, no mark is set.
+	FwMark int
+	// FwMarkMask restricts the bits of the fwmark set by FwMark. When zero, the whole fwmark is set.
+	FwMarkMask int
+	// DisableComments leaves out the comments identifying the rules, for iptables builds lacking the comment match.
+	// The rules are then recognized by the proxy-init chains holding them or jumped to.
+	DisableComments bool
+	// CommentPrefix replaces DefaultCommentPrefix at the start of the comments identifying the rules, so that forks
+	// can tell their rules apart. The trace ID is still appended.
+	CommentPrefix string
+	// CommentLabel is added to the comment of every rule, before the trace ID, e.g. the name of the pod or policy the
+	// rules are applied for, so that the rules can be traced back to it. Optional.
+	CommentLabel string
+	// TraceID replaces ExecutionTraceID at the end of the comments identifying the rules and in the log prefix, e.g.
+	// so that tests can assert the exact commands. When empty, ExecutionTraceID is used.
+	TraceID string
+	// NatTable is the table holding the rules that redirect traffic with REDIRECT. When empty, DefaultNatTable is
+	// used.
+	NatTable string
+	// LogRedirects logs the new inbound connections to the kernel log before they are redirected, with their original
+	// destination. The log prefix ends with as much of the trace ID as fits.
+	LogRedirects bool
+	// LogPackets logs the packets entering the proxy-init chains, and those reaching the rules redirecting them to the
+	// proxy, to the kernel log. The packets in between were ignored.
+	LogPackets bool
+	// LogRateLimit limits the rate of the entries logged by LogPackets, such as `10/second`. When empty, every
+	// packet is logged.
+	LogRateLimit string
+	// IgnoreEstablished leaves the outgoing packets of established and related connections alone, so that the
+	// connections opened before the rules were applied aren't redirected halfway through.
+	IgnoreEstablished bool
+	// RedirectNewOnly only redirects the packets starting a connection, as tracked by conntrack, in both directions,
+	// so that the packets of the flows that were already going on when the rules were applied go through directly.
+	// It eases injecting the proxy into a running pod. TPROXY intercepts every packet of a connection, so it can't be
+	// combined with TproxyProxyMode.
+	RedirectNewOnly bool
+	// IgnoreDNAT leaves the incoming packets already sent to another destination by a DNAT rule alone, at the top of
+	// the redirect chain, such as the NodePort traffic kube-proxy translates in `PREROUTING` before proxy-init.
+	IgnoreDNAT bool
+	// ScopeJumpsToProtocols jumps from `PREROUTING` and `OUTPUT` into the proxy-init chains once per redirected
+	// protocol, with `-p tcp` and, with RedirectUDP, `-p udp`, instead of once for all protocols, so that the traffic
+	// of other protocols never enters the chains.
+	ScopeJumpsToProtocols bool
+	// SkipStateDump leaves out the listings of the nat table before and after applying the rules, which are slow and
+	// noisy on nodes with many rules.
+	SkipStateDump bool
+	// StateDumpTimeout bounds each listing of the nat table before and after applying the rules, which can hang on a
+	// contended xtables lock. A listing that times out is skipped, without failing the configuration. When zero, the
+	// listings are only bounded by the context of the configuration.
+	StateDumpTimeout time.Duration
+	// IgnoreClusterDNS leaves the outgoing DNS queries to the cluster DNS alone, over both TCP and UDP. The addresses
+	// of the cluster DNS are taken from ClusterDNSAddresses or, when empty, from the nameservers of /etc/resolv.conf.
+	IgnoreClusterDNS bool
+	// ClusterDNSAddresses are the addresses of the cluster DNS ignored with IgnoreClusterDNS.
+	ClusterDNSAddresses []string
+	// IgnoreNodeLocal leaves the outgoing traffic to the node alone, e.g. to node-local DNS or the kubelet. The
+	// addresses of the node are taken from NodeAddresses or, when empty, from the interfaces of the network namespace
+	// proxy-init runs in, which must then be the host's, with the pod's configured through NetNs or NetNsPID. As an
+	// init container runs in the pod's network namespace, whose interfaces hold the pod IP, it must set NodeAddresses.
+	IgnoreNodeLocal bool
+	// NodeAddresses are the addresses of the node ignored with IgnoreNodeLocal, of either IP family, e.g. from the
+	// `status.hostIPs` of the pod.
+	NodeAddresses []string
+	// Masquerade rewrites the source of the redirected outgoing traffic to the address of the interface it leaves
+	// through. MASQUERADE and SNAT are only allowed in the POSTROUTING chain, so the rule is held in a dedicated chain
+	// jumped to from POSTROUTING, matching the connections whose destination was rewritten.
+	Masquerade bool
+	// SNATAddress rewrites the source of the redirected outgoing traffic to the address, like Masquerade but with a
+	// fixed address. Only the IP family of the address is affected.
+	SNATAddress string
+	// UseDNAT redirects the traffic to the proxy with DNAT to DNATAddress instead of REDIRECT, for proxies listening
+	// on a specific address only. DNAT of incoming traffic to a loopback address requires the route_localnet sysctl
+	// to be enabled.
+	UseDNAT bool
+	// DNATAddress is the address traffic is sent to with UseDNAT, the loopback address of each IP family unless
+	// configured otherwise. Only the IP family of the address is affected.
+	DNATAddress string
+	// SkipSpecialRanges leaves the outgoing traffic to the link-local and multicast ranges alone, such as the cloud
+	// metadata service at 169.254.169.254.
+	SkipSpecialRanges bool
+	// ReconcileExisting makes ConfigureFirewall apply only the differences with the installed rules, like
+	// ReconcileFirewall, instead of removing the proxy-init chains and adding every rule again, so that a working
+	// configuration is never torn down. Installed rules matching the desired ones are left untouched either way.
+	ReconcileExisting bool
+	// SkipInstalledRules keeps the proxy-init chains and the rules left behind by previous runs instead of removing
+	// them first, and only adds the rules iptables-save doesn't list yet, so that re-running doesn't duplicate rules.
+	// Rules are compared by their fingerprint, ignoring the trace ID of the run that added them, and the missing ones
+	// are appended after the installed ones. It can't be combined with UseIptablesRestore.
+	SkipInstalledRules bool
+	// RollbackOnFailure saves the tables holding the proxy-init chains with iptables-save before applying the rules,
+	// and restores them when the configuration fails or its context is done partway through, so that no partial
+	// configuration is left behind. Every IP family configured so far is rolled back. The routing of TPROXY isn't.
+	RollbackOnFailure bool
+	// IptablesPath and IptablesSavePath are the paths of the iptables and iptables-save binaries managing the IPv4
+	// rules, for images where they aren't on the PATH. When empty, the binaries are looked up on the PATH, and the
+	// iptables-save binary is derived from the iptables one. They take precedence over the Backend.
+	IptablesPath     string
+	IptablesSavePath string
+	// Ip6tablesPath and Ip6tablesSavePath are the IPv6 counterparts of IptablesPath and IptablesSavePath.
+	Ip6tablesPath     string
+	Ip6tablesSavePath string
+	// UseIptablesRestore applies all the rules of an IP family in a single, atomic `iptables-restore` call instead of
+	// running iptables once per rule.
+	UseIptablesRestore bool
+	// CheckMode compares the installed rules with the desired ones without changing anything, failing the
+	// configuration when they differ. Unlike SimulateOnly, it reads the live state.
+	CheckMode bool
+	// VerifyRules reads the rules back once they're applied, failing the configuration when the jumps into the
+	// proxy-init chains are missing, e.g. because another controller removed them.
+	VerifyRules bool
+	// PortRangesToRedirectInbound complements PortsToRedirectInbound with port ranges such as `8000-8100`, each of
+	// which is redirected with a single rule.
+	PortRangesToRedirectInbound []string
+	// InboundPortTargets maps ports of PortsToRedirectInbound to the proxy port their traffic is redirected to,
+	// instead of ProxyInboundPort, for proxies listening on several ports. Unmapped ports go to ProxyInboundPort.
+	InboundPortTargets map[int]int
+	// OutboundPortTargets maps ports of PortsToRedirectOutbound to the proxy port their traffic is redirected to,
+	// instead of ProxyOutgoingPort, e.g. for egress through distinct local listeners. Unmapped ports go to
+	// ProxyOutgoingPort.
+	OutboundPortTargets map[int]int
+	// JumpPosition is the position at which the jumps into the proxy-init chains are inserted in the `PREROUTING` and
+	// `OUTPUT` chains, 1 being the first rule, so that they take precedence over the rules of other components. When
+	// zero, the jumps are appended instead.
+	JumpPosition int
+	// RedirectChainName is the name of the chain redirecting incoming traffic. When empty,
+	// ProxyInitRedirectChainName is used.
+	RedirectChainName string
+	// OutputChainName is the name of the chain redirecting outgoing traffic. When empty, ProxyInitOutputChainName is
+	// used.
+	OutputChainName string
+	// PreserveForeignChains guarantees that the chains and rules of other components are never removed: the chains
+	// flushed and deleted when cleaning up must be named with ProxyInitChainPrefix, and only the jumps carrying the
+	// proxy-init comment are deleted from the `PREROUTING` and `OUTPUT` chains. It can't be combined with
+	// DisableComments, without which the jumps can't be told apart.
+	PreserveForeignChains bool
+	// LoopbackInterface is the name of the loopback device, whose traffic isn't redirected. When empty,
+	// DefaultLoopbackInterface is used.
+	LoopbackInterface string
+	// InboundInterface restricts the redirection of incoming traffic to the packets arriving on that interface, e.g.
+	// the mesh NIC of a multi-homed pod: only they jump from `PREROUTING` into the redirect chain, the traffic of the
+	// other interfaces bypassing it. When empty, the traffic of every interface is redirected.
+	InboundInterface string
+	// OutboundInterface restricts the redirection of outgoing traffic to the packets leaving through that interface:
+	// only they jump from `OUTPUT` into the output chain, the traffic of the other interfaces staying direct. As the
+	// traffic leaving through LoopbackInterface then never enters the output chain, the rules ignoring it and
+	// redirecting the application's loopback traffic to its own pod IP don't apply, so it can't be LoopbackInterface.
+	// When empty, the traffic of every interface is redirected.
+	OutboundInterface string
+	// LoopbackCIDRs are the loopback destinations of the traffic the proxy sends through LoopbackInterface to itself,
+	// which isn't redirected back to the proxy, at most one per IP family. When none is configured for an IP family,
+	// `127.0.0.1/32` or `::1/128` is used.
+	LoopbackCIDRs []string
+	// WaitFlagSeconds bounds how long iptables waits for the xtables lock when UseWaitFlag is set. When zero, iptables
+	// waits indefinitely.
+	WaitFlagSeconds int
+	// WaitInterval is how often iptables tries to acquire the xtables lock when UseWaitFlag is set. When zero, the
+	// iptables default is used.
+	WaitInterval time.Duration
+	// MaxRetries is the number of times a command failing because the xtables lock is held by another process is
+	// retried. Other failures are never retried.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled for every following one.
+	RetryBackoff time.Duration
+	// NsenterPath is the path of the nsenter binary wrapping the commands when NetNs or NetNsPID is set. When empty,
+	// DefaultNsenterPath is looked up on the PATH.
+	NsenterPath string
+	// NetNsPID is the PID of a process whose network namespace is configured, as an alternative to NetNs. When zero,
+	// NetNs is used instead.
+	NetNsPID int
+	// Runner executes the iptables commands. When nil, commands are executed on the host.
+	Runner CommandRunner
+	// Logger receives the progress of the configuration. When nil, entries are written to Output.
+	Logger Logger
+	// Output receives the log entries, including the output of the executed commands, when no Logger is set. When
+	// nil, entries are written through the standard logger.
+	Output io.Writer
+	// Metrics receives measurements of the configuration, such as the number of rules applied and the failures.
+	// When nil, metrics are disabled.
+	Metrics Metrics
+	// Events receives the progress of the configuration as typed events, e.g. for a progress bar, without parsing the
+	// log. Sending blocks until the event is received or the context is done, so the channel must be drained. When
+	// nil, no event is sent.
+	Events chan<- Event
+	// BeforeCommand is called with every command about to run, once wrapped with nsenter and given the wait flags.
+	// Changes to the command, such as to its arguments, affect what runs. It isn't called when SimulateOnly is set.
+	BeforeCommand func(cmd *exec.Cmd)
+	// AfterCommand is called with every command that ran, after any retry, along with its output and the error
+	// returned for it.
+	AfterCommand func(cmd *exec.Cmd, out []byte, err error)
+	// Env is the environment of every command, in the form of `key=value` entries, e.g. to pin PATH or the locale.
+	// When it sets PATH, the binaries are only looked up there. When empty, the environment of the process is
+	// inherited.
+	Env []string
+
+	// ctx bounds the execution of the commands. It is set by ConfigureFirewall and TeardownFirewall.
+	ctx context.Context
 }
 
 //ConfigureFirewall configures a pod's internal iptables to redirect all desired traffic through the proxy, allowing for
 // the pod to join the service mesh. A lot of this logic was based on
 // https://github.com/istio/istio/blob/e83411e/pilot/docker/prepare_proxy.sh
-func ConfigureFirewall(firewallConfiguration FirewallConfiguration) error {
+// Commands are killed once ctx is done, and configuration stops with an error.
+func ConfigureFirewall(ctx context.Context, firewallConfiguration FirewallConfiguration) error {
+	firewallConfiguration.ctx = ctx
+
+	logger(firewallConfiguration).Info("Tracing this script execution", "traceID", traceID(firewallConfiguration))
+
+	start := time.Now()
+	defer func() {
+		metrics(firewallConfiguration).ApplyDuration(time.Since(start))
+	}()
+
+	if err := validateFirewall(firewallConfiguration); err != nil {
+		return err
+	}
+	return configureFirewall(firewallConfiguration)
+}
+
+// validateFirewall validates the configuration and checks that the process is able to apply it, independently of the
+// network namespace it's applied to.
+func validateFirewall(firewallConfiguration FirewallConfiguration) error {
+	if err := firewallConfiguration.Validate(); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("validate")
+		return err
+	}
+
+	if err := checkCapabilities(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+	return nil
+}
+
+// configureFirewall applies a configuration validated by validateFirewall to its network namespace.
+func configureFirewall(firewallConfiguration FirewallConfiguration) error {
+	firewallConfiguration = resolveDirections(resolveBackend(firewallConfiguration))
+
+	if err := checkBinaries(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+
+	if err := checkIgnoreTarget(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+
+	snapshots := make([]tableSnapshot, 0)
+	for _, family := range ipFamilies(firewallConfiguration) {
+		// Each family is configured independently, with the rest of the configuration shared between them.
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		if rollsBack(familyConfiguration) {
+			taken, err := snapshotTables(familyConfiguration)
+			if err != nil {
+				logger(familyConfiguration).Error("Aborting firewall configuration", "error", err)
+				metrics(familyConfiguration).ApplyFailed("snapshot")
+				return err
+			}
+			snapshots = append(snapshots, taken...)
+		}
+		if err := configureFirewallForFamily(familyConfiguration); err != nil {
+			err = fmt.Errorf("failed to configure %s firewall: %w", family, err)
+			if len(snapshots) == 0 {
+				return err
+			}
+			if rollbackErr := rollback(snapshots); rollbackErr != nil {
+				logger(familyConfiguration).Error("Failed to roll back the rules", "error", rollbackErr)
+				metrics(familyConfiguration).ApplyFailed("rollback")
+				return fmt.Errorf("%w, and the rules couldn't be rolled back: %v", err, rollbackErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rollsBack checks whether the configuration changes the rules and is rolled back when that fails.
+func rollsBack(firewallConfiguration FirewallConfiguration) bool {
+	return firewallConfiguration.RollbackOnFailure && !firewallConfiguration.SimulateOnly && !firewallConfiguration.CheckMode
+}
+
+func configureFirewallForFamily(firewallConfiguration FirewallConfiguration) error {
+	binary := iptablesBinary(firewallConfiguration)
+
+	logger(firewallConfiguration).Info("Configuring rules", "family", firewallConfiguration.IPFamily, "binary", binary)
+
+	commands, err := BuildRules(firewallConfiguration)
+	if err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("build")
+		return err
+	}
+	ruleCount := len(commands)
+
+	// The rules are listed once, and only when needed, for the checks and the reconciliation below.
+	snapshot := newRuleSnapshot(firewallConfiguration)
+
+	if firewallConfiguration.CheckMode {
+		if err := checkRules(firewallConfiguration, binary, commands, snapshot); err != nil {
+			logger(firewallConfiguration).Error("The rules are not configured as desired", "family", firewallConfiguration.IPFamily, "error", err)
+			metrics(firewallConfiguration).ApplyFailed("check")
+			return err
+		}
+		logger(firewallConfiguration).Info("The rules are configured as desired", "family", firewallConfiguration.IPFamily)
+		return nil
+	}
+
+	if isAlreadyConfigured(firewallConfiguration, binary, commands, snapshot) {
+		logger(firewallConfiguration).Info("The rules are already configured, leaving them untouched", "family", firewallConfiguration.IPFamily)
+		return nil
+	}
+
+	if firewallConfiguration.ReconcileExisting {
+		startSection(firewallConfiguration, "reconcile")
+		err := reconcileFirewallForFamily(firewallConfiguration, commands, snapshot)
+		endSection(firewallConfiguration, "reconcile", err)
+		if err != nil {
+			logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+			metrics(firewallConfiguration).ApplyFailed("reconcile")
+			return err
+		}
+		return verifyAppliedRules(firewallConfiguration, binary)
+	}
+
+	if !firewallConfiguration.SkipStateDump {
+		logger(firewallConfiguration).Info("State of iptables rules before run")
+		startSection(firewallConfiguration, "current-state")
+		err = dumpState(firewallConfiguration, binary)
+		endSection(firewallConfiguration, "current-state", err)
+		if err != nil {
+			logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+			metrics(firewallConfiguration).ApplyFailed("current-state")
+			return err
+		}
+	}
+
+	startSection(firewallConfiguration, "cleanup")
+	err = removeExistingChains(firewallConfiguration)
+	endSection(firewallConfiguration, "cleanup", err)
+	if err != nil {
+		if firewallConfiguration.StrictCleanup {
+			logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+			metrics(firewallConfiguration).ApplyFailed("cleanup")
+			return fmt.Errorf("failed to remove the existing chains: %w", err)
+		}
+		logger(firewallConfiguration).Error("Failed to remove the existing chains. Startup will continue, but there may be additional errors", "error", err)
+	}
+
+	if firewallConfiguration.UseIptablesRestore {
+		input, remaining, err := makeRestoreInput(binary, commands)
+		if err != nil {
+			logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+			metrics(firewallConfiguration).ApplyFailed("adding-rules")
+			return err
+		}
+		logger(firewallConfiguration).Info("Applying rules with iptables-restore", "input", string(input))
+		commands = append([]*exec.Cmd{makeRestore(binary, input)}, remaining...)
+	}
+
+	logger(firewallConfiguration).Info("Executing commands")
+
+	startSection(firewallConfiguration, "adding-rules")
+	err = executeCommands(firewallConfiguration, binary, commands)
+	endSection(firewallConfiguration, "adding-rules", err)
+	if err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("adding-rules")
+		return err
+	}
+	metrics(firewallConfiguration).RulesApplied(ruleCount)
+
+	if !firewallConfiguration.SkipStateDump {
+		startSection(firewallConfiguration, "current-state")
+		err = dumpState(firewallConfiguration, binary)
+		endSection(firewallConfiguration, "current-state", err)
+		if err != nil {
+			logger(firewallConfiguration).Error("Aborting firewall configuration", "error", err)
+			metrics(firewallConfiguration).ApplyFailed("current-state")
+			return err
+		}
+	}
+
+	return verifyAppliedRules(firewallConfiguration, binary)
+}
 
-	log.Printf("Tracing this script execution as [%s]\n", ExecutionTraceID)
+// dumpState lists the rules of the nat table, within StateDumpTimeout when set. A listing that times out is skipped,
+// as it's only meant for troubleshooting.
+func dumpState(firewallConfiguration FirewallConfiguration, binary string) error {
+	if firewallConfiguration.StateDumpTimeout <= 0 {
+		return executeCommand(firewallConfiguration, makeShowAllRules(binary, natTable(firewallConfiguration)))
+	}
+
+	parent := firewallConfiguration.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, firewallConfiguration.StateDumpTimeout)
+	defer cancel()
+	dumpConfiguration := firewallConfiguration
+	dumpConfiguration.ctx = ctx
+
+	err := executeCommand(dumpConfiguration, makeShowAllRules(binary, natTable(firewallConfiguration)))
+	if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+		logger(firewallConfiguration).Error("Skipping the listing of the rules, which timed out", "timeout", firewallConfiguration.StateDumpTimeout)
+		return nil
+	}
+	return err
+}
+
+// executeCommands runs the commands adding the rules, in order, stopping at the first failure.
+func executeCommands(firewallConfiguration FirewallConfiguration, binary string, commands []*exec.Cmd) error {
+	installed := make(map[string]map[string]bool)
+	for _, cmd := range commands {
+		if firewallConfiguration.SkipInstalledRules {
+			exists, err := ruleExists(firewallConfiguration, binary, cmd, installed)
+			if err != nil {
+				return err
+			}
+			if exists {
+				logger(firewallConfiguration).Info("The rule is already installed, skipping it", "command", cmd.Args)
+				continue
+			}
+		}
+		err := executeCommand(firewallConfiguration, cmd)
+		if chain, ok := createdChain(binary, cmd); ok && isExistingChain(err) && !firewallConfiguration.SkipInstalledRules {
+			err = reuseExistingChain(firewallConfiguration, binary, cmd.Args[2], chain)
+		}
+		if errors.Is(err, ErrOwnerMatchUnavailable) {
+			return fmt.Errorf("the owner match the rules ignoring the proxy's traffic rely on is unavailable, load the xt_owner kernel module on the node: %w", err)
+		}
+		if err != nil && !(firewallConfiguration.SkipInstalledRules && isExistingChain(err)) {
+			return err
+		}
+	}
+	return nil
+}
+
+// reuseExistingChain flushes a chain that couldn't be created because it already exists, e.g. as a previous run
+// crashed and the chain couldn't be removed, so that the rules are added to it from scratch.
+func reuseExistingChain(firewallConfiguration FirewallConfiguration, binary string, table string, chain string) error {
+	logger(firewallConfiguration).Info("The chain already exists, flushing it to reuse it", "table", table, "chain", chain)
+	return executeCommand(firewallConfiguration, makeFlushChain(binary, table, chain))
+}
+
+// ruleExists checks whether the rule the command adds is already installed, comparing its fingerprint with the ones
+// of the rules iptables-save lists, whatever the trace ID of the run that added them. The fingerprints are read once
+// per table and kept in installed. Commands that don't add a rule, and every command when simulating, are reported as
+// not installed.
+func ruleExists(firewallConfiguration FirewallConfiguration, binary string, cmd *exec.Cmd, installed map[string]map[string]bool) (bool, error) {
+	rule, ok := addedRule(binary, cmd)
+	if !ok || firewallConfiguration.SimulateOnly {
+		return false, nil
+	}
+	fingerprints, ok := installed[rule.Table]
+	if !ok {
+		rules, err := readRules(firewallConfiguration, rule.Table)
+		if err != nil {
+			return false, fmt.Errorf("could not read the rules of table %s: %w", rule.Table, err)
+		}
+		fingerprints = make(map[string]bool, len(rules))
+		for _, installedRule := range rules {
+			fingerprints[ruleFingerprint(installedRule)] = true
+		}
+		installed[rule.Table] = fingerprints
+	}
+	return fingerprints[ruleFingerprint(rule)], nil
+}
 
-	log.Println("State of iptables rules before run:")
-	err := executeCommand(firewallConfiguration, makeShowAllRules())
+// verifyAppliedRules reads the rules back once they're applied, when VerifyRules is set.
+func verifyAppliedRules(firewallConfiguration FirewallConfiguration, binary string) error {
+	if !firewallConfiguration.VerifyRules {
+		return nil
+	}
+	startSection(firewallConfiguration, "verify")
+	err := verifyRules(firewallConfiguration, binary)
+	endSection(firewallConfiguration, "verify", err)
 	if err != nil {
-		log.Println("Aborting firewall configuration")
+		logger(firewallConfiguration).Error("The rules are not in place after being applied", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("verify")
 		return err
 	}
+	return nil
+}
+
+// BuildRules returns the commands that add the rules described by the configuration, in the order ConfigureFirewall
+// executes them, without executing anything. When configuring both IP families, the IPv4 rules come first.
+func BuildRules(firewallConfiguration FirewallConfiguration) ([]*exec.Cmd, error) {
+	if err := firewallConfiguration.Validate(); err != nil {
+		return nil, err
+	}
+
+	warnAboutProxyPortOverlaps(firewallConfiguration)
+	warnAboutIgnoredPortOverlaps(firewallConfiguration)
+
+	firewallConfiguration = resolveDirections(firewallConfiguration)
+
+	if firewallConfiguration.IgnoreClusterDNS && !firewallConfiguration.SkipOutbound {
+		addresses, err := clusterDNSAddresses(firewallConfiguration)
+		if err != nil {
+			return nil, err
+		}
+		firewallConfiguration.ClusterDNSAddresses = addresses
+	}
+
+	if firewallConfiguration.IgnoreNodeLocal && !firewallConfiguration.SkipOutbound {
+		addresses, err := nodeAddresses(firewallConfiguration)
+		if err != nil {
+			return nil, err
+		}
+		firewallConfiguration.NodeAddresses = addresses
+	}
+
+	commands := make([]*exec.Cmd, 0)
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+
+		if !familyConfiguration.SkipInbound {
+			commands = addIncomingTrafficRules(commands, familyConfiguration)
+		}
+
+		if !familyConfiguration.SkipOutbound {
+			commands = addOutgoingTrafficRules(commands, familyConfiguration)
+		}
+
+		if len(familyConfiguration.NoTrackPorts) > 0 {
+			commands = addNoTrackRules(commands, familyConfiguration)
+		}
+	}
+
+	for _, cmd := range commands {
+		applyCommentSettings(firewallConfiguration, cmd)
+	}
+	return commands, nil
+}
+
+// applyCommentSettings strips, or sets the configured prefix and label of, the comment set by formatComment in the
+// command.
+func applyCommentSettings(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd) {
+	if firewallConfiguration.DisableComments {
+		cmd.Args = stripComment(cmd.Args)
+		return
+	}
+	if commentPrefix(firewallConfiguration) != DefaultCommentPrefix {
+		cmd.Args = replaceCommentPrefix(cmd.Args, commentPrefix(firewallConfiguration))
+	}
+	if firewallConfiguration.TraceID != "" {
+		cmd.Args = replaceTraceID(cmd.Args, firewallConfiguration.TraceID)
+	}
+	if firewallConfiguration.CommentLabel != "" {
+		cmd.Args = addCommentLabel(cmd.Args, firewallConfiguration.CommentLabel)
+	}
+}
+
+// replaceTraceID replaces ExecutionTraceID at the end of the comment set by formatComment in the arguments of a
+// command.
+func replaceTraceID(args []string, traceID string) []string {
+	replaced := append([]string{}, args...)
+	for i := 0; i < len(replaced)-1; i++ {
+		if replaced[i] == "--comment" && strings.HasSuffix(replaced[i+1], "/"+ExecutionTraceID) {
+			replaced[i+1] = strings.TrimSuffix(replaced[i+1], ExecutionTraceID) + traceID
+		}
+	}
+	return replaced
+}
+
+// addCommentLabel inserts the label before the trace ID of the comment set by formatComment in the arguments of a
+// command.
+func addCommentLabel(args []string, label string) []string {
+	labeled := append([]string{}, args...)
+	for i := 0; i < len(labeled)-1; i++ {
+		if labeled[i] == "--comment" {
+			if j := strings.LastIndex(labeled[i+1], "/"); j >= 0 {
+				labeled[i+1] = labeled[i+1][:j] + "/" + label + labeled[i+1][j:]
+			}
+		}
+	}
+	return labeled
+}
+
+// replaceCommentPrefix replaces the default prefix of the comment set by formatComment in the arguments of a command.
+func replaceCommentPrefix(args []string, prefix string) []string {
+	replaced := append([]string{}, args...)
+	for i := 0; i < len(replaced)-1; i++ {
+		if replaced[i] == "--comment" && strings.HasPrefix(replaced[i+1], DefaultCommentPrefix+"/") {
+			replaced[i+1] = prefix + strings.TrimPrefix(replaced[i+1], DefaultCommentPrefix)
+		}
+	}
+	return replaced
+}
+
+// stripComment removes the comment match from the arguments of a command.
+func stripComment(args []string) []string {
+	stripped := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if i+3 < len(args) && args[i] == "-m" && args[i+1] == "comment" && args[i+2] == "--comment" {
+			i += 3
+			continue
+		}
+		stripped = append(stripped, args[i])
+	}
+	return stripped
+}
+
+// ValidModes returns the redirect modes accepted for Mode and OutboundMode.
+func ValidModes() []string {
+	return []string{RedirectAllMode, RedirectListedMode}
+}
+
+// isValidMode checks whether the mode is one of ValidModes.
+func isValidMode(mode string) bool {
+	for _, valid := range ValidModes() {
+		if mode == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the configuration for values that would otherwise only fail halfway through applying the rules,
+// leaving a partially configured firewall behind.
+func (c FirewallConfiguration) Validate() error {
+	if !isValidMode(c.Mode) {
+		return fmt.Errorf("unknown redirect mode [%s], must be one of %q", c.Mode, ValidModes())
+	}
+
+	if !isValidProxyPort(c.ProxyInboundPort) {
+		return fmt.Errorf("ProxyInboundPort must be set to a port between 1 and 65535, got [%d]", c.ProxyInboundPort)
+	}
+
+	if c.ProxyOutgoingPort != 0 && !isValidProxyPort(c.ProxyOutgoingPort) {
+		return fmt.Errorf("ProxyOutgoingPort must be a port between 1 and 65535 when set, got [%d]", c.ProxyOutgoingPort)
+	}
+
+	if c.ProxyOutgoingPort == 0 && !c.SkipOutbound && len(c.PortsToRedirectOutbound) > 0 {
+		return fmt.Errorf("PortsToRedirectOutbound requires ProxyOutgoingPort to be set")
+	}
+
+	if c.ProxyAdminPort != 0 && !isValidProxyPort(c.ProxyAdminPort) {
+		return fmt.Errorf("ProxyAdminPort must be a port between 1 and 65535 when set, got [%d]", c.ProxyAdminPort)
+	}
+
+	if c.ProxyUID < 0 {
+		return fmt.Errorf("ProxyUID must not be negative, got [%d]", c.ProxyUID)
+	}
+
+	if c.ProxyUIDRange != [2]int{} {
+		if c.ProxyUIDRange[0] < 0 {
+			return fmt.Errorf("ProxyUIDRange must not be negative, got [%d-%d]", c.ProxyUIDRange[0], c.ProxyUIDRange[1])
+		}
+		if c.ProxyUIDRange[0] > c.ProxyUIDRange[1] {
+			return fmt.Errorf("ProxyUIDRange must not start after its end, got [%d-%d]", c.ProxyUIDRange[0], c.ProxyUIDRange[1])
+		}
+		if c.ProxyUID > 0 || c.HasProxyUID {
+			return fmt.Errorf("ProxyUID and ProxyUIDRange can't be used together")
+		}
+	}
+
+	if c.ProxyGID < 0 {
+		return fmt.Errorf("ProxyGID must not be negative, got [%d]", c.ProxyGID)
+	}
+
+	if c.Mode == RedirectListedMode && len(c.PortsToRedirectInbound) == 0 && len(c.PortRangesToRedirectInbound) == 0 {
+		return fmt.Errorf("%s mode requires at least one port to redirect, or no incoming traffic would reach the proxy", RedirectListedMode)
+	}
+
+	if c.OutboundMode != "" && !isValidMode(c.OutboundMode) {
+		return fmt.Errorf("unknown outbound redirect mode [%s], must be one of %q", c.OutboundMode, ValidModes())
+	}
+
+	if c.OutboundMode == RedirectListedMode && len(c.PortsToRedirectOutbound) == 0 {
+		return fmt.Errorf("%s outbound mode requires at least one port to redirect", RedirectListedMode)
+	}
+
+	for port, target := range c.InboundPortTargets {
+		if !containsPort(c.PortsToRedirectInbound, port) {
+			return fmt.Errorf("InboundPortTargets maps port [%d], which isn't in PortsToRedirectInbound", port)
+		}
+		if !isValidProxyPort(target) {
+			return fmt.Errorf("InboundPortTargets must map port [%d] to a port between 1 and 65535, got [%d]", port, target)
+		}
+	}
+
+	for port, target := range c.OutboundPortTargets {
+		if !containsPort(c.PortsToRedirectOutbound, port) {
+			return fmt.Errorf("OutboundPortTargets maps port [%d], which isn't in PortsToRedirectOutbound", port)
+		}
+		if !isValidProxyPort(target) {
+			return fmt.Errorf("OutboundPortTargets must map port [%d] to a port between 1 and 65535, got [%d]", port, target)
+		}
+	}
+
+	for _, port := range append(append([]int{}, c.PortsToRedirectInbound...), c.PortsToRedirectOutbound...) {
+		if !isValidProxyPort(port) {
+			return fmt.Errorf("invalid port to redirect [%d]: must be between 1 and 65535", port)
+		}
+	}
+
+	for _, port := range c.NoTrackPorts {
+		if !isValidProxyPort(port) {
+			return fmt.Errorf("invalid port not to track [%d]: must be between 1 and 65535", port)
+		}
+	}
+
+	for _, port := range c.ProbePorts {
+		if !isValidProxyPort(port) {
+			return fmt.Errorf("invalid probe port [%d]: must be between 1 and 65535", port)
+		}
+	}
+
+	portRanges := append(append(append([]string{}, c.PortRangesToRedirectInbound...), c.InboundPortsToIgnore...), c.OutboundPortsToIgnore...)
+	for _, portRange := range portRanges {
+		parsed, err := ports.ParsePortRange(portRange)
+		if err != nil {
+			return fmt.Errorf("invalid port or port range [%s]: %v", portRange, err)
+		}
+		if parsed.LowerBound == 0 {
+			return fmt.Errorf("invalid port or port range [%s]: ports must be between 1 and 65535", portRange)
+		}
+	}
+
+	for _, cidr := range append(append([]string{}, c.InboundCIDRsToIgnore...), c.OutboundCIDRsToIgnore...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR to ignore [%s]: %v", cidr, err)
+		}
+	}
+
+	for _, address := range c.ClusterDNSAddresses {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid cluster DNS address [%s]", address)
+		}
+	}
+
+	for _, cidr := range c.LoopbackCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid loopback CIDR [%s]: %v", cidr, err)
+		}
+	}
+	for _, family := range []string{IPv4Family, IPv6Family} {
+		if cidrs := cidrsForFamily(c.LoopbackCIDRs, family); len(cidrs) > 1 {
+			return fmt.Errorf("LoopbackCIDRs must hold at most one %s CIDR, got %q", family, cidrs)
+		}
+	}
+
+	if c.IgnoreNodeLocal && len(c.NodeAddresses) == 0 && !runsInHostNamespace(c) {
+		return fmt.Errorf("IgnoreNodeLocal requires NodeAddresses unless NetNs or NetNsPID is set, as the interfaces of the pod's network namespace don't hold the node addresses")
+	}
+
+	for _, address := range c.NodeAddresses {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid node address [%s]", address)
+		}
+	}
+
+	if c.SNATAddress != "" && net.ParseIP(c.SNATAddress) == nil {
+		return fmt.Errorf("invalid SNAT address [%s]", c.SNATAddress)
+	}
+
+	if c.DNATAddress != "" && net.ParseIP(c.DNATAddress) == nil {
+		return fmt.Errorf("invalid DNAT address [%s]", c.DNATAddress)
+	}
+
+	if c.DNATAddress != "" && !c.UseDNAT {
+		return fmt.Errorf("DNATAddress requires UseDNAT")
+	}
+
+	if c.Masquerade && c.SNATAddress != "" {
+		return fmt.Errorf("Masquerade and SNATAddress can't be used together")
+	}
+
+	switch c.IPFamily {
+	case "", IPv4Family, IPv6Family, DualStackFamily:
+	default:
+		return fmt.Errorf("unknown IP family [%s]", c.IPFamily)
+	}
+
+	switch c.Backend {
+	case "", LegacyBackend, NftBackend, AutoBackend:
+	default:
+		return fmt.Errorf("unknown iptables backend [%s]", c.Backend)
+	}
+
+	switch c.ProxyMode {
+	case "", RedirectProxyMode, TproxyProxyMode:
+	default:
+		return fmt.Errorf("unknown proxy mode [%s]", c.ProxyMode)
+	}
+
+	if c.TproxyMark < 0 {
+		return fmt.Errorf("TproxyMark must not be negative, got [%d]", c.TproxyMark)
+	}
+
+	for _, name := range []string{c.RedirectChainName, c.OutputChainName} {
+		if len(name) > maxChainNameLength {
+			return fmt.Errorf("chain names must be at most %d characters long, got [%s]", maxChainNameLength, name)
+		}
+	}
+
+	if len(c.InboundInterface) > maxInterfaceNameLength || strings.ContainsAny(c.InboundInterface, "/ \t\n") {
+		return fmt.Errorf("invalid inbound interface [%s]", c.InboundInterface)
+	}
+
+	if len(c.OutboundInterface) > maxInterfaceNameLength || strings.ContainsAny(c.OutboundInterface, "/ \t\n") {
+		return fmt.Errorf("invalid outbound interface [%s]", c.OutboundInterface)
+	}
+
+	if c.OutboundInterface == loopbackInterface(c) {
+		return fmt.Errorf("OutboundInterface must not be the loopback interface, whose traffic isn't redirected, got [%s]", c.OutboundInterface)
+	}
+
+	if c.PreserveForeignChains {
+		if c.DisableComments {
+			return fmt.Errorf("PreserveForeignChains and DisableComments can't be used together")
+		}
+		for _, name := range []string{redirectChainName(c), outputChainName(c)} {
+			if !strings.HasPrefix(name, ProxyInitChainPrefix) {
+				return fmt.Errorf("PreserveForeignChains requires chain names starting with %s, got [%s]", ProxyInitChainPrefix, name)
+			}
+		}
+	}
+
+	if redirectChainName(c) == outputChainName(c) {
+		return fmt.Errorf("the redirect and output chains must have different names, got [%s]", redirectChainName(c))
+	}
+
+	if c.JumpPosition < 0 {
+		return fmt.Errorf("JumpPosition must not be negative, got [%d]", c.JumpPosition)
+	}
+
+	if c.CheckMode && c.SimulateOnly {
+		return fmt.Errorf("CheckMode and SimulateOnly can't be used together")
+	}
+
+	if c.SkipInstalledRules && c.UseIptablesRestore {
+		return fmt.Errorf("SkipInstalledRules and UseIptablesRestore can't be used together")
+	}
+
+	if c.RedirectNewOnly && c.ProxyMode == TproxyProxyMode {
+		return fmt.Errorf("RedirectNewOnly and TproxyProxyMode can't be used together")
+	}
+
+	if c.WaitFlagSeconds < 0 {
+		return fmt.Errorf("WaitFlagSeconds must not be negative, got [%d]", c.WaitFlagSeconds)
+	}
+
+	if c.WaitInterval < 0 {
+		return fmt.Errorf("WaitInterval must not be negative, got [%s]", c.WaitInterval)
+	}
+
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("MaxRetries must not be negative, got [%d]", c.MaxRetries)
+	}
+
+	if c.StateDumpTimeout < 0 {
+		return fmt.Errorf("StateDumpTimeout must not be negative, got [%s]", c.StateDumpTimeout)
+	}
+
+	if c.RetryBackoff < 0 {
+		return fmt.Errorf("RetryBackoff must not be negative, got [%s]", c.RetryBackoff)
+	}
+
+	if c.NetNsPID < 0 {
+		return fmt.Errorf("NetNsPID must not be negative, got [%d]", c.NetNsPID)
+	}
+
+	if c.NetNsPID > 0 && c.NetNs != "" {
+		return fmt.Errorf("NetNs and NetNsPID can't be used together")
+	}
+
+	if c.SkipInbound && c.SkipOutbound {
+		return fmt.Errorf("SkipInbound and SkipOutbound can't be used together, there would be nothing to configure")
+	}
+
+	if c.SkipInbound && c.ProxyOutgoingPort == 0 {
+		return fmt.Errorf("SkipInbound requires ProxyOutgoingPort to be set, there would be nothing to configure")
+	}
+
+	if c.FwMark < 0 || int64(c.FwMark) > maxFwMark {
+		return fmt.Errorf("FwMark must be between 0 and %#x, got [%d]", int64(maxFwMark), c.FwMark)
+	}
+
+	if c.FwMarkMask < 0 || int64(c.FwMarkMask) > maxFwMark {
+		return fmt.Errorf("FwMarkMask must be between 0 and %#x, got [%d]", int64(maxFwMark), c.FwMarkMask)
+	}
+
+	if int64(c.FwMark)&^fwMarkMask(c) != 0 {
+		return fmt.Errorf("FwMark [%#x] sets bits outside of FwMarkMask [%#x]", c.FwMark, fwMarkMask(c))
+	}
+
+	if len(c.CommentLabel) > maxCommentLabelLength {
+		return fmt.Errorf("CommentLabel must be at most %d characters long, got [%s]", maxCommentLabelLength, c.CommentLabel)
+	}
+
+	if strings.ContainsAny(c.CommentLabel, "\"\n") {
+		return fmt.Errorf("CommentLabel must not contain quotes or line breaks, got [%s]", c.CommentLabel)
+	}
+
+	if strings.ContainsAny(c.TraceID, "/\" \t\n") {
+		return fmt.Errorf("TraceID must not contain slashes, quotes or whitespace, got [%s]", c.TraceID)
+	}
+
+	if len(c.IgnoreTarget) > maxChainNameLength || strings.ContainsAny(c.IgnoreTarget, " \t\n") {
+		return fmt.Errorf("invalid ignore target [%s]", c.IgnoreTarget)
+	}
+
+	return nil
+}
+
+// containsPort checks whether the port is in the list.
+func containsPort(list []int, port int) bool {
+	for _, listed := range list {
+		if listed == port {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidProxyPort checks whether the port can be used as a redirect target or match. Unlike ports.IsValid, it
+// excludes port 0, which can't be connected to.
+func isValidProxyPort(port int) bool {
+	return port > 0 && ports.IsValid(port)
+}
+
+// removeExistingChains deletes the jumps into the chains left behind by previous runs, then flushes and deletes the
+// chains, so they can be recreated from scratch. With SkipInstalledRules, the chains and jumps are kept and only the
+// TPROXY routing configuration is removed. Every step is attempted, and the failures are returned together, except
+// those caused by the chains not existing, as is the case on a first run.
+func removeExistingChains(firewallConfiguration FirewallConfiguration) error {
+	binary := iptablesBinary(firewallConfiguration)
+	var errs multiError
+	cmds := make([]*exec.Cmd, 0)
+	if !firewallConfiguration.SkipInstalledRules {
+		errs = removeJumps(firewallConfiguration)
+		for _, err := range errs {
+			logger(firewallConfiguration).Error("An error occurred while removing the existing jumps", "error", err)
+		}
+		for _, chain := range removableChains(firewallConfiguration) {
+			cmds = append(cmds, makeFlushChain(binary, chain.table, chain.name), makeDeleteChain(binary, chain.table, chain.name))
+		}
+	}
+	if firewallConfiguration.ProxyMode == TproxyProxyMode && !firewallConfiguration.SkipInbound {
+		cmds = append(cmds,
+			makeDeleteTproxyRoutingRule(firewallConfiguration.IPFamily, tproxyMark(firewallConfiguration)),
+			makeFlushTproxyRouteTable(firewallConfiguration.IPFamily))
+	}
+
+	for _, cmd := range cmds {
+		err := executeCommand(firewallConfiguration, cmd)
+		if err == nil {
+			continue
+		}
+		if isMissingObject(err) {
+			logger(firewallConfiguration).Info("Nothing to remove", "command", cmd.Args)
+			continue
+		}
+		logger(firewallConfiguration).Error("An error occurred while removing the existing chains", "command", cmd.Args, "error", err)
+		errs = append(errs, err)
+	}
+	return errs.errorOrNil()
+}
+
+// isMissingObject checks whether the command failed because the chain, rule or routing configuration it refers to
+// doesn't exist, as reported by iptables or ip. Other failures, such as a denied permission, the xtables lock being
+// held or nsenter not finding the namespace, are genuine errors.
+func isMissingObject(err error) bool {
+	for _, message := range []string{"No chain/target/match by that name", "does not exist", "RTNETLINK answers: No such file or directory"} {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyInitJump is a jump from a built-in chain to a proxy-init chain.
+type proxyInitJump struct{ table, chain, target string }
+
+// proxyInitJumps returns the jumps into the proxy-init chains of the directions that aren't skipped.
+func proxyInitJumps(firewallConfiguration FirewallConfiguration) []proxyInitJump {
+	jumps := make([]proxyInitJump, 0, 3)
+	if !firewallConfiguration.SkipInbound {
+		jumps = append(jumps, proxyInitJump{inboundTable(firewallConfiguration), IptablesPreroutingChainName, redirectChainName(firewallConfiguration)})
+	}
+	if !firewallConfiguration.SkipOutbound {
+		jumps = append(jumps, proxyInitJump{natTable(firewallConfiguration), IptablesOutputChainName, outputChainName(firewallConfiguration)})
+	}
+	if rewritesSource(firewallConfiguration) {
+		jumps = append(jumps, proxyInitJump{natTable(firewallConfiguration), IptablesPostroutingChainName, ProxyInitPostroutingChainName})
+	}
+	if len(firewallConfiguration.NoTrackPorts) > 0 {
+		jumps = append(jumps,
+			proxyInitJump{"raw", IptablesPreroutingChainName, ProxyInitNotrackChainName},
+			proxyInitJump{"raw", IptablesOutputChainName, ProxyInitNotrackChainName})
+	}
+	return jumps
+}
+
+// proxyInitChain is a chain created by proxy-init.
+type proxyInitChain struct{ table, name string }
+
+// proxyInitChains returns the chains targeted by proxyInitJumps, each of them once even when several built-in chains
+// jump to it.
+func proxyInitChains(firewallConfiguration FirewallConfiguration) []proxyInitChain {
+	chains := make([]proxyInitChain, 0)
+	seen := make(map[proxyInitChain]bool)
+	for _, jump := range proxyInitJumps(firewallConfiguration) {
+		chain := proxyInitChain{jump.table, jump.target}
+		if !seen[chain] {
+			seen[chain] = true
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
+// removableChains returns the proxy-init chains cleaning up flushes and deletes, leaving out the chains not named
+// with ProxyInitChainPrefix when PreserveForeignChains is set.
+func removableChains(firewallConfiguration FirewallConfiguration) []proxyInitChain {
+	chains := make([]proxyInitChain, 0)
+	for _, chain := range proxyInitChains(firewallConfiguration) {
+		if firewallConfiguration.PreserveForeignChains && !strings.HasPrefix(chain.name, ProxyInitChainPrefix) {
+			logger(firewallConfiguration).Info("Leaving a chain not named by proxy-init", "table", chain.table, "chain", chain.name)
+			continue
+		}
+		chains = append(chains, chain)
+	}
+	return chains
+}
+
+// resolveDirections skips the outgoing traffic when ProxyOutgoingPort isn't set, as there is no port to redirect it
+// to.
+func resolveDirections(firewallConfiguration FirewallConfiguration) FirewallConfiguration {
+	if firewallConfiguration.ProxyOutgoingPort == 0 && !firewallConfiguration.SkipOutbound {
+		logger(firewallConfiguration).Info("No outgoing proxy port, leaving the outgoing traffic alone")
+		firewallConfiguration.SkipOutbound = true
+	}
+	return firewallConfiguration
+}
+
+// rewritesSource checks whether the source of the redirected outgoing traffic of the IP family is rewritten.
+func rewritesSource(firewallConfiguration FirewallConfiguration) bool {
+	if firewallConfiguration.SkipOutbound {
+		return false
+	}
+	return firewallConfiguration.Masquerade || len(addressesForFamily([]string{firewallConfiguration.SNATAddress}, firewallConfiguration.IPFamily)) > 0
+}
+
+// inboundTable returns the table holding the rules that intercept inbound traffic.
+func inboundTable(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.ProxyMode == TproxyProxyMode {
+		return "mangle"
+	}
+	return natTable(firewallConfiguration)
+}
+
+// natTable returns the table holding the rules that redirect traffic to the proxy, DefaultNatTable unless configured
+// otherwise. TPROXY rules are always held in the mangle table.
+func natTable(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.NatTable == "" {
+		return DefaultNatTable
+	}
+	return firewallConfiguration.NatTable
+}
+
+// fwMarkMask returns the mask of the fwmark set on outgoing traffic, covering the whole fwmark unless configured
+// otherwise. It's an int64 since the full mask doesn't fit in the int of 32-bit platforms.
+func fwMarkMask(firewallConfiguration FirewallConfiguration) int64 {
+	if firewallConfiguration.FwMarkMask == 0 {
+		return maxFwMark
+	}
+	return int64(firewallConfiguration.FwMarkMask)
+}
+
+// tproxyMark returns the fwmark set on packets intercepted by TPROXY.
+func tproxyMark(firewallConfiguration FirewallConfiguration) int {
+	if firewallConfiguration.TproxyMark == 0 {
+		return DefaultTproxyMark
+	}
+	return firewallConfiguration.TproxyMark
+}
+
+// ipFamilies returns the IP families that should be configured, in the order they are applied.
+// An empty IPFamily is treated as IPv4 for backwards compatibility.
+func ipFamilies(firewallConfiguration FirewallConfiguration) []string {
+	switch firewallConfiguration.IPFamily {
+	case IPv6Family:
+		return []string{IPv6Family}
+	case DualStackFamily:
+		return []string{IPv4Family, IPv6Family}
+	default:
+		return []string{IPv4Family}
+	}
+}
+
+// iptablesBinary returns the name of the iptables binary that manages rules for the configured IP family and backend.
+// When no backend is configured, the default `iptables` binary on the PATH is used, whichever variant it links to. A
+// configured path takes precedence over both.
+func iptablesBinary(firewallConfiguration FirewallConfiguration) string {
+	binary := "iptables"
+	if firewallConfiguration.IPFamily == IPv6Family {
+		binary = "ip6tables"
+		if firewallConfiguration.Ip6tablesPath != "" {
+			return firewallConfiguration.Ip6tablesPath
+		}
+	} else if firewallConfiguration.IptablesPath != "" {
+		return firewallConfiguration.IptablesPath
+	}
+
+	switch firewallConfiguration.Backend {
+	case LegacyBackend, NftBackend:
+		return fmt.Sprintf("%s-%s", binary, firewallConfiguration.Backend)
+	default:
+		return binary
+	}
+}
+
+// iptablesSaveBinary returns the name of the iptables-save binary matching iptablesBinary, unless a path is configured.
+func iptablesSaveBinary(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.IPFamily == IPv6Family && firewallConfiguration.Ip6tablesSavePath != "" {
+		return firewallConfiguration.Ip6tablesSavePath
+	}
+	if firewallConfiguration.IPFamily != IPv6Family && firewallConfiguration.IptablesSavePath != "" {
+		return firewallConfiguration.IptablesSavePath
+	}
+	return fmt.Sprintf("%s-save", iptablesBinary(firewallConfiguration))
+}
+
+// resolveBackend returns the configuration with the auto backend replaced by the detected one.
+func resolveBackend(firewallConfiguration FirewallConfiguration) FirewallConfiguration {
+	if firewallConfiguration.Backend == AutoBackend {
+		firewallConfiguration.Backend = detectBackend(firewallConfiguration)
+		logger(firewallConfiguration).Info("Detected iptables backend", "backend", firewallConfiguration.Backend)
+	}
+	return firewallConfiguration
+}
+
+// detectBackend picks the iptables backend that already holds rules, as that is the one other components on the
+// host (e.g. kube-proxy) are using. It defaults to the legacy backend when neither or both have rules.
+func detectBackend(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.SimulateOnly {
+		logger(firewallConfiguration).Info("Simulating: cannot detect iptables backend, using the default", "backend", LegacyBackend)
+		return LegacyBackend
+	}
+
+	ruleCount := func(backend string) int {
+		out, err := executeCommandWithOutput(firewallConfiguration, exec.Command(fmt.Sprintf("iptables-%s-save", backend)))
+		if err != nil {
+			logger(firewallConfiguration).Error("Could not list rules", "backend", backend, "error", err)
+			return 0
+		}
+		return countRules(out)
+	}
+
+	if ruleCount(NftBackend) > ruleCount(LegacyBackend) {
+		return NftBackend
+	}
+	return LegacyBackend
+}
+
+// countRules returns the number of rules present in the output of `iptables-save`.
+func countRules(saveOutput []byte) int {
+	count := 0
+	for _, line := range strings.Split(string(saveOutput), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			count++
+		}
+	}
+	return count
+}
+
+// protocols returns the protocols whose traffic is redirected to the proxy.
+func protocols(firewallConfiguration FirewallConfiguration) []string {
+	if firewallConfiguration.RedirectUDP {
+		return []string{"tcp", "udp"}
+	}
+	return []string{"tcp"}
+}
+
+// specialRanges are the link-local and multicast ranges ignored with SkipSpecialRanges.
+var specialRanges = []string{"169.254.0.0/16", "224.0.0.0/4", "fe80::/10", "ff00::/8"}
+
+// cidrsForFamily returns the CIDRs that belong to the given IP family. The CIDRs are expected to be valid.
+func cidrsForFamily(cidrs []string, family string) []string {
+	familyCIDRs := make([]string, 0)
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if (ip.To4() != nil) == (family != IPv6Family) {
+			familyCIDRs = append(familyCIDRs, cidr)
+		}
+	}
+	return familyCIDRs
+}
+
+// redirectChainName returns the name of the chain redirecting incoming traffic, ProxyInitRedirectChainName unless
+// configured otherwise.
+func redirectChainName(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.RedirectChainName == "" {
+		return ProxyInitRedirectChainName
+	}
+	return firewallConfiguration.RedirectChainName
+}
+
+// outputChainName returns the name of the chain redirecting outgoing traffic, ProxyInitOutputChainName unless
+// configured otherwise.
+func outputChainName(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.OutputChainName == "" {
+		return ProxyInitOutputChainName
+	}
+	return firewallConfiguration.OutputChainName
+}
+
+// nsenterArgs returns the nsenter arguments entering the configured network namespace, either by path or through the
+// PID of a process running in it, or nil when commands run in the current namespace.
+func nsenterArgs(firewallConfiguration FirewallConfiguration) []string {
+	if firewallConfiguration.NetNsPID > 0 {
+		return []string{"--target", strconv.Itoa(firewallConfiguration.NetNsPID), "--net"}
+	}
+	if len(firewallConfiguration.NetNs) > 0 {
+		return []string{fmt.Sprintf("--net=%s", firewallConfiguration.NetNs)}
+	}
+	return nil
+}
+
+// nsenterPath returns the nsenter binary, `nsenter` unless configured otherwise.
+func nsenterPath(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.NsenterPath == "" {
+		return DefaultNsenterPath
+	}
+	return firewallConfiguration.NsenterPath
+}
+
+// loopbackInterface returns the name of the loopback device, `lo` unless configured otherwise.
+func loopbackInterface(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.LoopbackInterface == "" {
+		return DefaultLoopbackInterface
+	}
+	return firewallConfiguration.LoopbackInterface
+}
+
+// dnatAddress returns the address traffic is sent to with DNAT for the IP family of the configuration, or an empty
+// string when traffic is redirected with REDIRECT.
+func dnatAddress(firewallConfiguration FirewallConfiguration) string {
+	if !firewallConfiguration.UseDNAT {
+		return ""
+	}
+	if addresses := addressesForFamily([]string{firewallConfiguration.DNATAddress}, firewallConfiguration.IPFamily); len(addresses) > 0 {
+		return addresses[0]
+	}
+	if firewallConfiguration.IPFamily == IPv6Family {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+// proxyUIDOwner returns the `--uid-owner` match of the proxy's users, either ProxyUIDRange or ProxyUID, and whether
+// it is set.
+func proxyUIDOwner(firewallConfiguration FirewallConfiguration) (string, bool) {
+	if r := firewallConfiguration.ProxyUIDRange; r != [2]int{} {
+		return fmt.Sprintf("%d-%d", r[0], r[1]), true
+	}
+	return strconv.Itoa(firewallConfiguration.ProxyUID), firewallConfiguration.ProxyUID > 0 || firewallConfiguration.HasProxyUID
+}
+
+// addICMPRule leaves the ICMP traffic of the IP family alone when IgnoreICMP is set.
+func addICMPRule(firewallConfiguration FirewallConfiguration, table string, chainName string, commands []*exec.Cmd) []*exec.Cmd {
+	if !firewallConfiguration.IgnoreICMP {
+		return commands
+	}
+	protocol := "icmp"
+	if firewallConfiguration.IPFamily == IPv6Family {
+		protocol = "ipv6-icmp"
+	}
+	logger(firewallConfiguration).Info("Will ignore ICMP", "chain", chainName, "protocol", protocol)
+	return append(commands, makeIgnoreProtocol(iptablesBinary(firewallConfiguration), table, chainName, protocol, "ignore-icmp"))
+}
+
+// loopbackAddress returns the loopback destination of the IP family, as configured with LoopbackCIDRs.
+func loopbackAddress(firewallConfiguration FirewallConfiguration) string {
+	if cidrs := cidrsForFamily(firewallConfiguration.LoopbackCIDRs, firewallConfiguration.IPFamily); len(cidrs) > 0 {
+		return cidrs[0]
+	}
+	if firewallConfiguration.IPFamily == IPv6Family {
+		return "::1/128"
+	}
+	return "127.0.0.1/32"
+}
+
+//formatComment is used to format iptables comments in such way that it is possible to identify when the rules were added.
+// This helps debug when iptables has some stale rules from previous runs, something that can happen frequently on minikube.
+func formatComment(text string) string {
+	return fmt.Sprintf("%s/%s/%s", DefaultCommentPrefix, text, ExecutionTraceID)
+}
+
+// logPrefix returns the prefix of the kernel log entries of redirected connections, made of the comment prefix and the
+// end of the trace ID, which is truncated to fit the limit of the LOG target.
+func logPrefix(firewallConfiguration FirewallConfiguration) string {
+	prefix := commentPrefix(firewallConfiguration) + "/"
+	traceID := traceID(firewallConfiguration)
+	if available := maxLogPrefixLength - len(prefix) - 2; len(traceID) > available {
+		if available <= 0 {
+			return prefix[:maxLogPrefixLength-2] + ": "
+		}
+		traceID = traceID[len(traceID)-available:]
+	}
+	return prefix + traceID + ": "
+}
+
+// ignoreTarget returns the target of the rules ignoring the configured ports and CIDRs, RETURN unless configured
+// otherwise.
+func ignoreTarget(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.IgnoreTarget == "" {
+		return "RETURN"
+	}
+	return firewallConfiguration.IgnoreTarget
+}
+
+// traceID returns the trace ID identifying the rules of this run, ExecutionTraceID unless configured otherwise.
+func traceID(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.TraceID == "" {
+		return ExecutionTraceID
+	}
+	return firewallConfiguration.TraceID
+}
+
+// commentPrefix returns the prefix of the comments identifying the rules, DefaultCommentPrefix unless configured
+// otherwise.
+func commentPrefix(firewallConfiguration FirewallConfiguration) string {
+	if firewallConfiguration.CommentPrefix == "" {
+		return DefaultCommentPrefix
+	}
+	return firewallConfiguration.CommentPrefix
+}
+
+func addOutgoingTrafficRules(commands []*exec.Cmd, firewallConfiguration FirewallConfiguration) []*exec.Cmd {
+	outputChainName := outputChainName(firewallConfiguration)
+	redirectChainName := redirectChainName(firewallConfiguration)
+	binary := iptablesBinary(firewallConfiguration)
+	table := natTable(firewallConfiguration)
+
+	commands = append(commands, makeCreateNewChain(binary, table, outputChainName, "redirect-common-chain"))
+	if firewallConfiguration.InsertIgnoredPorts {
+		commands = addRulesForIgnoredPorts(firewallConfiguration, firewallConfiguration.OutboundPortsToIgnore, table, outputChainName, commands)
+	}
+	commands = addICMPRule(firewallConfiguration, table, outputChainName, commands)
+	commands = addPacketLogRule(firewallConfiguration, table, outputChainName, "out", "log-outgoing", commands)
+
+	// Leave the connections opened before the rules were applied, e.g. by a previous proxy, alone.
+	if firewallConfiguration.IgnoreEstablished {
+		logger(firewallConfiguration).Info("Will ignore established connections", "chain", outputChainName)
+		commands = append(commands, makeIgnoreEstablished(binary, table, outputChainName, "ignore-established"))
+	}
+	if firewallConfiguration.RedirectNewOnly {
+		logger(firewallConfiguration).Info("Will only redirect new connections", "chain", outputChainName)
+		commands = append(commands, makeIgnoreNotNew(binary, table, outputChainName, "ignore-not-new-outgoing"))
+	}
+
+	// Ignore traffic from the proxy. The owner and loopback rules match every protocol, so they aren't repeated per protocol.
+	uid, hasUID := proxyUIDOwner(firewallConfiguration)
+	owners := []struct {
+		kind, ownerFlag string
+		id              string
+		set             bool
+		redirectComment string
+		ignoreComment   string
+	}{
+		{"uid", "--uid-owner", uid, hasUID, "redirect-non-loopback-local-traffic", "ignore-proxy-user-id"},
+		{"gid", "--gid-owner", strconv.Itoa(firewallConfiguration.ProxyGID), firewallConfiguration.ProxyGID > 0 || firewallConfiguration.HasProxyGID, "redirect-non-loopback-local-group-traffic", "ignore-proxy-group-id"},
+	}
+	for _, owner := range owners {
+		if !owner.set {
+			logger(firewallConfiguration).Info("Not ignoring any "+owner.kind, "chain", outputChainName)
+			continue
+		}
+		logger(firewallConfiguration).Info("Ignoring "+owner.kind, "chain", outputChainName, owner.kind, owner.id)
+		// Redirect calls originating from the proxy destined for an app container e.g. app -> proxy(outbound) -> proxy(inbound) -> app
+		// TPROXY can't intercept locally generated traffic, so there's no redirect chain to send it to in that mode.
+		if firewallConfiguration.ProxyMode != TproxyProxyMode && !firewallConfiguration.SkipInbound {
+			commands = append(commands, makeRedirectChainForOutgoingTraffic(binary, table, outputChainName, redirectChainName, owner.ownerFlag, owner.id, loopbackInterface(firewallConfiguration), loopbackAddress(firewallConfiguration), owner.redirectComment))
+		}
+		commands = append(commands, makeIgnoreOwner(binary, table, outputChainName, owner.ownerFlag, owner.id, owner.ignoreComment))
+	}
+
+	// Ignore loopback
+	commands = append(commands, makeIgnoreLoopback(binary, table, outputChainName, loopbackInterface(firewallConfiguration), "ignore-loopback"))
+	// Ignore ports
+	if !firewallConfiguration.InsertIgnoredPorts {
+		commands = addRulesForIgnoredPorts(firewallConfiguration, firewallConfiguration.OutboundPortsToIgnore, table, outputChainName, commands)
+	}
+	// Ignore destinations
+	if firewallConfiguration.SkipSpecialRanges {
+		for _, cidr := range cidrsForFamily(specialRanges, firewallConfiguration.IPFamily) {
+			logger(firewallConfiguration).Info("Will ignore special range", "chain", outputChainName, "cidr", cidr)
+			commands = append(commands, makeIgnoreOutboundCIDR(binary, table, outputChainName, cidr, "RETURN", fmt.Sprintf("ignore-special-range-%s", cidr)))
+		}
+	}
+	for _, cidr := range cidrsForFamily(firewallConfiguration.OutboundCIDRsToIgnore, firewallConfiguration.IPFamily) {
+		logger(firewallConfiguration).Info("Will ignore destination", "chain", outputChainName, "cidr", cidr)
+		commands = append(commands, makeIgnoreOutboundCIDR(binary, table, outputChainName, cidr, ignoreTarget(firewallConfiguration), fmt.Sprintf("ignore-outbound-cidr-%s", cidr)))
+	}
+	if firewallConfiguration.IgnoreClusterDNS {
+		for _, address := range addressesForFamily(firewallConfiguration.ClusterDNSAddresses, firewallConfiguration.IPFamily) {
+			logger(firewallConfiguration).Info("Will ignore the cluster DNS", "chain", outputChainName, "address", address)
+			// DNS queries fall back to TCP for large answers, so both protocols are ignored whatever is redirected.
+			for _, protocol := range []string{"tcp", "udp"} {
+				commands = append(commands, makeIgnoreDNS(binary, table, outputChainName, protocol, address, fmt.Sprintf("ignore-cluster-dns-%s-%s", protocol, address)))
+			}
+		}
+	}
+	if firewallConfiguration.IgnoreNodeLocal {
+		for _, address := range addressesForFamily(firewallConfiguration.NodeAddresses, firewallConfiguration.IPFamily) {
+			logger(firewallConfiguration).Info("Will ignore the node", "chain", outputChainName, "address", address)
+			commands = append(commands, makeIgnoreOutboundCIDR(binary, table, outputChainName, address, "RETURN", fmt.Sprintf("ignore-node-local-%s", address)))
+		}
+	}
+
+	commands = addPacketLogRule(firewallConfiguration, table, outputChainName, "out-redirect", "log-outgoing-to-redirect", commands)
+	commands = addRulesForOutboundPortRedirect(firewallConfiguration, outputChainName, commands)
+
+	//Redirect all remaining outbound traffic to the proxy.
+	commands = addJumpsIntoChain(firewallConfiguration, table, IptablesOutputChainName, "", firewallConfiguration.OutboundInterface, outputChainName, "install-proxy-init-output", commands)
+
+	if rewritesSource(firewallConfiguration) {
+		logger(firewallConfiguration).Info("Will rewrite the source of redirected traffic", "chain", ProxyInitPostroutingChainName, "masquerade", firewallConfiguration.Masquerade, "address", firewallConfiguration.SNATAddress)
+		commands = append(commands,
+			makeCreateNewChain(binary, table, ProxyInitPostroutingChainName, "redirect-common-chain"),
+			makeRewriteSource(binary, table, ProxyInitPostroutingChainName, firewallConfiguration.SNATAddress, "rewrite-redirected-source"),
+			makeJumpFromChainToAnotherForAllProtocols(binary, table, IptablesPostroutingChainName, firewallConfiguration.JumpPosition, "", "", ProxyInitPostroutingChainName, "install-proxy-init-postrouting"))
+	}
+	return commands
+}
+
+// addNoTrackRules exempts the traffic from and to NoTrackPorts from connection tracking, in both directions.
+func addNoTrackRules(commands []*exec.Cmd, firewallConfiguration FirewallConfiguration) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+
+	commands = append(commands, makeCreateNewChain(binary, "raw", ProxyInitNotrackChainName, "notrack-chain"))
+	for _, port := range uniquePorts(firewallConfiguration.NoTrackPorts) {
+		logger(firewallConfiguration).Info("Will not track connections", "chain", ProxyInitNotrackChainName, "port", port)
+		for _, protocol := range protocols(firewallConfiguration) {
+			commands = append(commands,
+				makeNoTrack(binary, ProxyInitNotrackChainName, protocol, "--dport", port, fmt.Sprintf("notrack-port-%d", port)),
+				makeNoTrack(binary, ProxyInitNotrackChainName, protocol, "--sport", port, fmt.Sprintf("notrack-port-%d-replies", port)))
+		}
+	}
+	return append(commands,
+		makeJumpFromChainToAnotherForAllProtocols(binary, "raw", IptablesPreroutingChainName, firewallConfiguration.JumpPosition, "", "", ProxyInitNotrackChainName, "install-proxy-init-notrack-prerouting"),
+		makeJumpFromChainToAnotherForAllProtocols(binary, "raw", IptablesOutputChainName, firewallConfiguration.JumpPosition, "", "", ProxyInitNotrackChainName, "install-proxy-init-notrack-output"))
+}
+
+func addIncomingTrafficRules(commands []*exec.Cmd, firewallConfiguration FirewallConfiguration) []*exec.Cmd {
+	redirectChainName := redirectChainName(firewallConfiguration)
+	binary := iptablesBinary(firewallConfiguration)
+	table := inboundTable(firewallConfiguration)
+
+	commands = append(commands, makeCreateNewChain(binary, table, redirectChainName, "redirect-common-chain"))
+	if firewallConfiguration.InsertIgnoredPorts {
+		commands = addRulesForIgnoredPorts(firewallConfiguration, firewallConfiguration.InboundPortsToIgnore, table, redirectChainName, commands)
+	}
+	commands = addICMPRule(firewallConfiguration, table, redirectChainName, commands)
+	if firewallConfiguration.IgnoreDNAT {
+		logger(firewallConfiguration).Info("Will ignore translated destinations", "chain", redirectChainName)
+		commands = append(commands, makeIgnoreDNAT(binary, table, redirectChainName, "ignore-dnat"))
+	}
+	if firewallConfiguration.RedirectNewOnly {
+		logger(firewallConfiguration).Info("Will only redirect new connections", "chain", redirectChainName)
+		commands = append(commands, makeIgnoreNotNew(binary, table, redirectChainName, "ignore-not-new-incoming"))
+	}
+	commands = addPacketLogRule(firewallConfiguration, table, redirectChainName, "in", "log-incoming", commands)
+	if !firewallConfiguration.InsertIgnoredPorts {
+		commands = addRulesForIgnoredPorts(firewallConfiguration, firewallConfiguration.InboundPortsToIgnore, table, redirectChainName, commands)
+	}
+	commands = addRulesForProbePorts(firewallConfiguration, table, redirectChainName, commands)
+	commands = addRulesForProxyPorts(firewallConfiguration, table, redirectChainName, commands)
+	for _, cidr := range cidrsForFamily(firewallConfiguration.InboundCIDRsToIgnore, firewallConfiguration.IPFamily) {
+		logger(firewallConfiguration).Info("Will ignore source", "chain", redirectChainName, "cidr", cidr)
+		commands = append(commands, makeIgnoreInboundCIDR(binary, table, redirectChainName, cidr, ignoreTarget(firewallConfiguration), fmt.Sprintf("ignore-inbound-cidr-%s", cidr)))
+	}
+	commands = addPacketLogRule(firewallConfiguration, table, redirectChainName, "in-redirect", "log-incoming-to-redirect", commands)
+	commands = addRulesForInboundPortRedirect(firewallConfiguration, redirectChainName, commands)
+
+	//Redirect all remaining inbound traffic to the proxy.
+	commands = addJumpsIntoChain(firewallConfiguration, table, IptablesPreroutingChainName, firewallConfiguration.InboundInterface, "", redirectChainName, "install-proxy-init-prerouting", commands)
+
+	if firewallConfiguration.ProxyMode == TproxyProxyMode {
+		// Deliver the packets marked by TPROXY locally, so the proxy's transparent socket can accept them.
+		commands = append(commands, makeTproxyRoutingRule(firewallConfiguration.IPFamily, tproxyMark(firewallConfiguration)))
+		commands = append(commands, makeTproxyLocalRoute(firewallConfiguration.IPFamily, loopbackInterface(firewallConfiguration)))
+	}
+
+	return commands
+}
+
+// addPacketLogRule logs the packets reaching this point of the chain when LogPackets is set. The label tells the log
+// entries apart.
+func addPacketLogRule(firewallConfiguration FirewallConfiguration, table string, chainName string, label string, comment string, commands []*exec.Cmd) []*exec.Cmd {
+	if !firewallConfiguration.LogPackets {
+		return commands
+	}
+	prefix := commentPrefix(firewallConfiguration)
+	if available := maxLogPrefixLength - len(label) - 3; len(prefix) > available {
+		prefix = prefix[:available]
+	}
+	return append(commands, makeLogPackets(iptablesBinary(firewallConfiguration), table, chainName, fmt.Sprintf("%s/%s: ", prefix, label), firewallConfiguration.LogRateLimit, comment))
+}
+
+func addRulesForInboundPortRedirect(firewallConfiguration FirewallConfiguration, chainName string, commands []*exec.Cmd) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+	intercept := func(protocol string, destination string, proxyPort int, comment string) *exec.Cmd {
+		if firewallConfiguration.ProxyMode == TproxyProxyMode {
+			return makeTproxyChainToPort(binary, chainName, protocol, destination, proxyPort, tproxyMark(firewallConfiguration), comment)
+		}
+		if destination == "" {
+			return makeRedirectChainToPort(binary, natTable(firewallConfiguration), chainName, protocol, dnatAddress(firewallConfiguration), proxyPort, comment)
+		}
+		return makeRedirectChainToPortBasedOnDestinationPort(binary, natTable(firewallConfiguration), chainName, protocol, destination, dnatAddress(firewallConfiguration), proxyPort, comment)
+	}
+	// redirect intercepts the traffic, logging its original destination first if configured.
+	redirect := func(protocol string, destination string, proxyPort int, comment string) []*exec.Cmd {
+		if !firewallConfiguration.LogRedirects {
+			return []*exec.Cmd{intercept(protocol, destination, proxyPort, comment)}
+		}
+		return []*exec.Cmd{
+			makeLogChain(binary, inboundTable(firewallConfiguration), chainName, protocol, destination, logPrefix(firewallConfiguration), "log-"+comment),
+			intercept(protocol, destination, proxyPort, comment),
+		}
+	}
 
-	commands := make([]*exec.Cmd, 0)
-
-	commands = addIncomingTrafficRules(commands, firewallConfiguration)
+	if firewallConfiguration.Mode == RedirectAllMode {
+		logger(firewallConfiguration).Info("Will redirect all INPUT ports to proxy", "chain", chainName, "port", firewallConfiguration.ProxyInboundPort)
+		//Create a new chain for redirecting inbound and outbound traffic to the proxy port.
+		for _, protocol := range protocols(firewallConfiguration) {
+			commands = append(commands, redirect(protocol, "", firewallConfiguration.ProxyInboundPort, "redirect-all-incoming-to-proxy-port")...)
+		}
 
-	commands = addOutgoingTrafficRules(commands, firewallConfiguration)
+	} else if firewallConfiguration.Mode == RedirectListedMode {
+		logger(firewallConfiguration).Info("Will redirect some INPUT ports to proxy", "chain", chainName, "port", firewallConfiguration.ProxyInboundPort, "ports", firewallConfiguration.PortsToRedirectInbound, "portRanges", firewallConfiguration.PortRangesToRedirectInbound)
+		type listedDestination struct {
+			destination string
+			proxyPort   int
+		}
+		destinations := make([]listedDestination, 0)
+		for _, port := range uniquePorts(firewallConfiguration.PortsToRedirectInbound) {
+			proxyPort, ok := firewallConfiguration.InboundPortTargets[port]
+			if !ok {
+				proxyPort = firewallConfiguration.ProxyInboundPort
+			}
+			destinations = append(destinations, listedDestination{strconv.Itoa(port), proxyPort})
+		}
+		for _, portRange := range uniquePortRanges(firewallConfiguration.PortRangesToRedirectInbound) {
+			if parsed, err := ports.ParsePortRange(portRange); err == nil {
+				destinations = append(destinations, listedDestination{asDestination(parsed), firewallConfiguration.ProxyInboundPort})
+			}
+		}
+		for _, d := range destinations {
+			for _, protocol := range protocols(firewallConfiguration) {
+				commands = append(commands, redirect(protocol, d.destination, d.proxyPort, fmt.Sprintf("redirect-port-%s-to-proxy-port", d.destination))...)
+			}
+		}
+	}
+	return commands
+}
 
-	commands = append(commands, makeShowAllRules())
+func addRulesForOutboundPortRedirect(firewallConfiguration FirewallConfiguration, chainName string, commands []*exec.Cmd) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+	table := natTable(firewallConfiguration)
 
-	log.Println("Executing commands:")
+	if firewallConfiguration.OutboundMode == RedirectListedMode {
+		// Traffic to other ports reaches the end of the chain and returns to OUTPUT without being redirected.
+		logger(firewallConfiguration).Info("Will redirect some OUTPUT ports to proxy", "chain", chainName, "port", firewallConfiguration.ProxyOutgoingPort, "ports", firewallConfiguration.PortsToRedirectOutbound)
+		for _, port := range uniquePorts(firewallConfiguration.PortsToRedirectOutbound) {
+			destination := strconv.Itoa(port)
+			proxyPort, ok := firewallConfiguration.OutboundPortTargets[port]
+			if !ok {
+				proxyPort = firewallConfiguration.ProxyOutgoingPort
+			}
+			for _, protocol := range protocols(firewallConfiguration) {
+				if firewallConfiguration.FwMark > 0 {
+					commands = append(commands, makeMarkChain(binary, table, chainName, protocol, destination, firewallConfiguration.FwMark, fwMarkMask(firewallConfiguration), fmt.Sprintf("mark-outgoing-port-%s", destination)))
+				}
+				commands = append(commands, makeRedirectChainToPortBasedOnDestinationPort(binary, table, chainName, protocol, destination, dnatAddress(firewallConfiguration), proxyPort, fmt.Sprintf("redirect-outgoing-port-%s-to-proxy-port", destination)))
+			}
+		}
+		return commands
+	}
 
-	for _, cmd := range commands {
-		err := executeCommand(firewallConfiguration, cmd)
-		if err != nil {
-			log.Println("Aborting firewall configuration")
-			return err
+	logger(firewallConfiguration).Info("Redirecting all OUTPUT", "chain", chainName, "port", firewallConfiguration.ProxyOutgoingPort)
+	for _, protocol := range protocols(firewallConfiguration) {
+		if firewallConfiguration.FwMark > 0 {
+			commands = append(commands, makeMarkChain(binary, table, chainName, protocol, "", firewallConfiguration.FwMark, fwMarkMask(firewallConfiguration), "mark-all-outgoing"))
 		}
+		commands = append(commands, makeRedirectChainToPort(binary, table, chainName, protocol, dnatAddress(firewallConfiguration), firewallConfiguration.ProxyOutgoingPort, "redirect-all-outgoing-to-proxy-port"))
 	}
-	return nil
+	return commands
 }
 
-//formatComment is used to format iptables comments in such way that it is possible to identify when the rules were added.
-// This helps debug when iptables has some stale rules from previous runs, something that can happen frequently on minikube.
-func formatComment(text string) string {
-	return fmt.Sprintf("proxy-init/%s/%s", text, ExecutionTraceID)
+// addRulesForProbePorts ignores the traffic of the kubelet's probes to ProbePorts.
+func addRulesForProbePorts(firewallConfiguration FirewallConfiguration, table string, chainName string, commands []*exec.Cmd) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+	for _, destinations := range makeMultiportDestinations(intsToStrings(uniquePorts(firewallConfiguration.ProbePorts))) {
+		logger(firewallConfiguration).Info("Will ignore probe port(s)", "chain", chainName, "ports", destinations)
+		for _, protocol := range protocols(firewallConfiguration) {
+			commands = append(commands, makeIgnorePorts(binary, table, chainName, 0, protocol, destinations, "RETURN", fmt.Sprintf("ignore-probe-ports-%s", strings.Join(destinations, ","))))
+		}
+	}
+	return commands
 }
 
-func addOutgoingTrafficRules(commands []*exec.Cmd, firewallConfiguration FirewallConfiguration) []*exec.Cmd {
-	outputChainName := "PROXY_INIT_OUTPUT"
-	redirectChainName := "PROXY_INIT_REDIRECT"
-	err := executeCommand(firewallConfiguration, makeFlushChain(outputChainName))
-	if err != nil {
-		log.Printf("An error occurred while FLUSHING the chain in addOutgoingTrafficRules. Startup will continue, but there may be additional errors\n [error]: %v", err)
+// addRulesForProxyPorts ignores the inbound traffic to the proxy's own ports, which would otherwise loop through the
+// proxy when they are redirected. Outbound traffic to the same ports of other hosts is still redirected.
+func addRulesForProxyPorts(firewallConfiguration FirewallConfiguration, table string, chainName string, commands []*exec.Cmd) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+	for _, destinations := range makeMultiportDestinations(intsToStrings(proxyPorts(firewallConfiguration))) {
+		logger(firewallConfiguration).Info("Will ignore the proxy's ports", "chain", chainName, "ports", destinations)
+		for _, protocol := range protocols(firewallConfiguration) {
+			commands = append(commands, makeIgnorePorts(binary, table, chainName, 0, protocol, destinations, "RETURN", "ignore-proxy-ports"))
+		}
 	}
+	return commands
+}
 
-	err = executeCommand(firewallConfiguration, makeDeleteChain(outputChainName))
-	if err != nil {
-		log.Printf("An error occurred while DELETING the chain in addOutgoingTrafficRules. Startup will continue, but there may be additional errors\n [error]: %v", err)
+// proxyPorts returns the ports the proxy listens on, without duplicates.
+func proxyPorts(firewallConfiguration FirewallConfiguration) []int {
+	proxyPorts := make([]int, 0)
+	candidates := []int{firewallConfiguration.ProxyInboundPort, firewallConfiguration.ProxyOutgoingPort, firewallConfiguration.ProxyAdminPort}
+	for _, port := range firewallConfiguration.PortsToRedirectInbound {
+		if target, ok := firewallConfiguration.InboundPortTargets[port]; ok {
+			candidates = append(candidates, target)
+		}
 	}
+	for _, port := range firewallConfiguration.PortsToRedirectOutbound {
+		if target, ok := firewallConfiguration.OutboundPortTargets[port]; ok {
+			candidates = append(candidates, target)
+		}
+	}
+	for _, port := range candidates {
+		if port <= 0 {
+			continue
+		}
+		duplicate := false
+		for _, proxyPort := range proxyPorts {
+			duplicate = duplicate || proxyPort == port
+		}
+		if !duplicate {
+			proxyPorts = append(proxyPorts, port)
+		}
+	}
+	return proxyPorts
+}
 
-	commands = append(commands, makeCreateNewChain(outputChainName, "redirect-common-chain"))
-
-	// Ignore traffic from the proxy
-	if firewallConfiguration.ProxyUID > 0 {
-		log.Printf("Ignoring uid %d", firewallConfiguration.ProxyUID)
-		// Redirect calls originating from the proxy destined for an app container e.g. app -> proxy(outbound) -> proxy(inbound) -> app
-		commands = append(commands, makeRedirectChainForOutgoingTraffic(outputChainName, redirectChainName, firewallConfiguration.ProxyUID, "redirect-non-loopback-local-traffic"))
-		commands = append(commands, makeIgnoreUserID(outputChainName, firewallConfiguration.ProxyUID, "ignore-proxy-user-id"))
-	} else {
-		log.Println("Not ignoring any uid")
+// warnAboutProxyPortOverlaps logs the proxy's ports found in the lists of inbound ports to redirect or to ignore.
+// Inbound traffic to these ports is always ignored, so listing them has no effect and likely points to a mistake.
+func warnAboutProxyPortOverlaps(firewallConfiguration FirewallConfiguration) {
+	lists := []struct {
+		name  string
+		ports []string
+	}{
+		{"PortsToRedirectInbound", intsToStrings(firewallConfiguration.PortsToRedirectInbound)},
+		{"PortRangesToRedirectInbound", firewallConfiguration.PortRangesToRedirectInbound},
+		{"InboundPortsToIgnore", firewallConfiguration.InboundPortsToIgnore},
+	}
+	for _, list := range lists {
+		for _, portOrRange := range list.ports {
+			portRange, err := ports.ParsePortRange(portOrRange)
+			if err != nil {
+				continue
+			}
+			for _, port := range proxyPorts(firewallConfiguration) {
+				if port >= portRange.LowerBound && port <= portRange.UpperBound {
+					logger(firewallConfiguration).Info("Warning: "+list.name+" includes a port of the proxy, whose traffic is always ignored", "port", port, "listed", portOrRange)
+				}
+			}
+		}
 	}
+}
 
-	// Ignore loopback
-	commands = append(commands, makeIgnoreLoopback(outputChainName, "ignore-loopback"))
-	// Ignore ports
-	commands = addRulesForIgnoredPorts(firewallConfiguration.OutboundPortsToIgnore, outputChainName, commands)
+// warnAboutIgnoredPortOverlaps logs the ports listed both as redirected and as ignored. Ignoring takes precedence,
+// so such ports are never redirected.
+func warnAboutIgnoredPortOverlaps(firewallConfiguration FirewallConfiguration) {
+	directions := []struct {
+		name                string
+		redirected, ignored []string
+	}{
+		{"inbound", append(intsToStrings(firewallConfiguration.PortsToRedirectInbound), firewallConfiguration.PortRangesToRedirectInbound...), firewallConfiguration.InboundPortsToIgnore},
+		{"outbound", intsToStrings(firewallConfiguration.PortsToRedirectOutbound), firewallConfiguration.OutboundPortsToIgnore},
+	}
+	for _, direction := range directions {
+		for _, redirected := range direction.redirected {
+			redirectedRange, err := ports.ParsePortRange(redirected)
+			if err != nil {
+				continue
+			}
+			for _, ignored := range direction.ignored {
+				ignoredRange, err := ports.ParsePortRange(ignored)
+				if err != nil {
+					continue
+				}
+				if redirectedRange.LowerBound <= ignoredRange.UpperBound && ignoredRange.LowerBound <= redirectedRange.UpperBound {
+					logger(firewallConfiguration).Info("Warning: "+direction.name+" port(s) both redirected and ignored will be ignored", "redirected", redirected, "ignored", ignored)
+				}
+			}
+		}
+	}
+}
 
-	log.Printf("Redirecting all OUTPUT to %d", firewallConfiguration.ProxyOutgoingPort)
-	commands = append(commands, makeRedirectChainToPort(outputChainName, firewallConfiguration.ProxyOutgoingPort, "redirect-all-outgoing-to-proxy-port"))
+func intsToStrings(ints []int) []string {
+	strs := make([]string, 0, len(ints))
+	for _, i := range ints {
+		strs = append(strs, strconv.Itoa(i))
+	}
+	return strs
+}
 
-	//Redirect all remaining outbound traffic to the proxy.
-	commands = append(commands, makeJumpFromChainToAnotherForAllProtocols(IptablesOutputChainName, outputChainName, "install-proxy-init-output"))
+// addRulesForIgnoredPorts ignores the traffic to the given ports. With InsertIgnoredPorts, the rules are inserted at
+// the top of the chain, in the order they're generated, and are expected to be the first rules generated for it.
+func addRulesForIgnoredPorts(firewallConfiguration FirewallConfiguration, portsToIgnore []string, table string, chainName string, commands []*exec.Cmd) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+	position := 0
+	for _, portOrRange := range portsToIgnore {
+		if _, err := ports.ParsePortRange(portOrRange); err != nil {
+			logger(firewallConfiguration).Error("Invalid port configuration", "port", portOrRange, "error", err)
+		}
+	}
+	// Coalescing the ports keeps the number of rules, and of iptables invocations, down when thousands of ports are
+	// ignored.
+	for _, destinations := range makeMultiportDestinations(coalescePortRanges(uniquePortRanges(portsToIgnore))) {
+		logger(firewallConfiguration).Info("Will ignore port(s)", "chain", chainName, "ports", destinations)
+		for _, protocol := range protocols(firewallConfiguration) {
+			if firewallConfiguration.InsertIgnoredPorts {
+				position++
+			}
+			commands = append(commands, makeIgnorePorts(binary, table, chainName, position, protocol, destinations, ignoreTarget(firewallConfiguration), fmt.Sprintf("ignore-port-%s", strings.Join(destinations, ","))))
+		}
+	}
 	return commands
 }
 
-func addIncomingTrafficRules(commands []*exec.Cmd, firewallConfiguration FirewallConfiguration) []*exec.Cmd {
-	redirectChainName := "PROXY_INIT_REDIRECT"
-	err := executeCommand(firewallConfiguration, makeFlushChain(redirectChainName))
-	if err != nil {
-		log.Printf("An error occurred while FLUSHING the chain in addIncomingTrafficRules. Startup will continue, but there may be additional errors\n [error]: %v", err)
+// uniquePorts returns the ports sorted in ascending order, without duplicates, so that the same rules are generated
+// whatever the order of the configuration.
+func uniquePorts(portList []int) []int {
+	unique := make([]int, 0, len(portList))
+	seen := make(map[int]bool, len(portList))
+	for _, port := range portList {
+		if !seen[port] {
+			seen[port] = true
+			unique = append(unique, port)
+		}
 	}
+	sort.Ints(unique)
+	return unique
+}
 
-	err = executeCommand(firewallConfiguration, makeDeleteChain(redirectChainName))
-	if err != nil {
-		log.Printf("An error occurred while DELETING the chain in addIncomingTrafficRules. Startup will continue, but there may be additional errors\n [error]: %v", err)
+// uniquePortRanges returns the valid ports and port ranges sorted by their bounds, without duplicates. Ports given
+// both as a single port and as a single port range, such as `80` and `80-80`, are considered duplicates.
+func uniquePortRanges(portRanges []string) []string {
+	parsed := make([]ports.PortRange, 0, len(portRanges))
+	seen := make(map[ports.PortRange]bool, len(portRanges))
+	for _, portOrRange := range portRanges {
+		portRange, err := ports.ParsePortRange(portOrRange)
+		if err != nil || seen[portRange] {
+			continue
+		}
+		seen[portRange] = true
+		parsed = append(parsed, portRange)
 	}
+	sort.Slice(parsed, func(i, j int) bool {
+		if parsed[i].LowerBound != parsed[j].LowerBound {
+			return parsed[i].LowerBound < parsed[j].LowerBound
+		}
+		return parsed[i].UpperBound < parsed[j].UpperBound
+	})
 
-	commands = append(commands, makeCreateNewChain(redirectChainName, "redirect-common-chain"))
-	commands = addRulesForIgnoredPorts(firewallConfiguration.InboundPortsToIgnore, redirectChainName, commands)
-	commands = addRulesForInboundPortRedirect(firewallConfiguration, redirectChainName, commands)
-
-	//Redirect all remaining inbound traffic to the proxy.
-	commands = append(commands, makeJumpFromChainToAnotherForAllProtocols(IptablesPreroutingChainName, redirectChainName, "install-proxy-init-prerouting"))
-
-	return commands
+	unique := make([]string, 0, len(parsed))
+	for _, portRange := range parsed {
+		if portRange.LowerBound == portRange.UpperBound {
+			unique = append(unique, strconv.Itoa(portRange.LowerBound))
+		} else {
+			unique = append(unique, fmt.Sprintf("%d-%d", portRange.LowerBound, portRange.UpperBound))
+		}
+	}
+	return unique
 }
 
-func addRulesForInboundPortRedirect(firewallConfiguration FirewallConfiguration, chainName string, commands []*exec.Cmd) []*exec.Cmd {
-	if firewallConfiguration.Mode == RedirectAllMode {
-		log.Print("Will redirect all INPUT ports to proxy")
-		//Create a new chain for redirecting inbound and outbound traffic to the proxy port.
-		commands = append(commands, makeRedirectChainToPort(chainName,
-			firewallConfiguration.ProxyInboundPort,
-			"redirect-all-incoming-to-proxy-port"))
-
-	} else if firewallConfiguration.Mode == RedirectListedMode {
-		log.Printf("Will redirect some INPUT ports to proxy: %v", firewallConfiguration.PortsToRedirectInbound)
-		for _, port := range firewallConfiguration.PortsToRedirectInbound {
-			commands = append(commands, makeRedirectChainToPortBasedOnDestinationPort(chainName,
-				port,
-				firewallConfiguration.ProxyInboundPort,
-				fmt.Sprintf("redirect-port-%d-to-proxy-port", port)))
+// coalescePortRanges merges the overlapping and contiguous ports and port ranges returned by uniquePortRanges, so
+// that `80`, `81` and `82-90` become `80-90`.
+func coalescePortRanges(portRanges []string) []string {
+	merged := make([]ports.PortRange, 0, len(portRanges))
+	for _, portOrRange := range portRanges {
+		portRange, err := ports.ParsePortRange(portOrRange)
+		if err != nil {
+			continue
+		}
+		if last := len(merged) - 1; last >= 0 && portRange.LowerBound <= merged[last].UpperBound+1 {
+			if portRange.UpperBound > merged[last].UpperBound {
+				merged[last].UpperBound = portRange.UpperBound
+			}
+			continue
 		}
+		merged = append(merged, portRange)
 	}
-	return commands
-}
 
-func addRulesForIgnoredPorts(portsToIgnore []string, chainName string, commands []*exec.Cmd) []*exec.Cmd {
-	for _, destinations := range makeMultiportDestinations(portsToIgnore) {
-		log.Printf("Will ignore port(s) %s on chain %s", destinations, chainName)
-		commands = append(commands, makeIgnorePorts(chainName, destinations, fmt.Sprintf("ignore-port-%s", strings.Join(destinations, ","))))
+	coalesced := make([]string, 0, len(merged))
+	for _, portRange := range merged {
+		if portRange.LowerBound == portRange.UpperBound {
+			coalesced = append(coalesced, strconv.Itoa(portRange.LowerBound))
+		} else {
+			coalesced = append(coalesced, fmt.Sprintf("%d-%d", portRange.LowerBound, portRange.UpperBound))
+		}
 	}
-	return commands
+	return coalesced
 }
 
 func makeMultiportDestinations(portsToIgnore []string) [][]string {
@@ -199,145 +2106,581 @@ func makeMultiportDestinations(portsToIgnore []string) [][]string {
 			}
 			destinations = append(destinations, asDestination(portRange))
 			destinationPortCount += portCount
-		} else {
-			log.Printf("Invalid port configuration of \"%s\": %s", portOrRange, err.Error())
 		}
 	}
 	return append(destinationSlices, destinations)
 }
 
 func executeCommand(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd) error {
+	_, err := executeCommandWithOutput(firewallConfiguration, cmd)
+	return err
+}
+
+// executeCommandWithOutput behaves like executeCommand, additionally returning the command's output.
+func executeCommandWithOutput(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd) ([]byte, error) {
 	originalCmd := strings.Trim(fmt.Sprintf("%v", cmd.Args), "[]")
-	log.Printf("> %s", originalCmd)
+	logger(firewallConfiguration).Info("Executing command", "command", originalCmd)
+	commandArgs := append([]string{}, cmd.Args...)
+	sendEvent(firewallConfiguration, Event{Kind: CommandRunning, Command: commandArgs})
 
-	if firewallConfiguration.UseWaitFlag {
-		log.Print("Setting UseWaitFlag: iptables will wait for xtables to become available")
-		cmd.Args = append(cmd.Args, "-w")
+	if firewallConfiguration.UseWaitFlag && supportsWaitFlag(cmd) {
+		logger(firewallConfiguration).Info("Setting UseWaitFlag: iptables will wait for xtables to become available")
+		cmd.Args = append(cmd.Args, waitFlagArgs(firewallConfiguration)...)
 	}
 
 	if !firewallConfiguration.SimulateOnly {
 		// wrap up the cmd with nsenter if we were givin a netns
-		if len(firewallConfiguration.NetNs) > 0 {
-			netnsArg := fmt.Sprintf("--net=%s", firewallConfiguration.NetNs)
-			originalCmdAsArgs := strings.Split(originalCmd, " ")
-			nsenterArgs := []string{
-				netnsArg,
+		if netnsArgs := nsenterArgs(firewallConfiguration); len(netnsArgs) > 0 {
+			// cmd.Args rather than originalCmd, to keep the wait flags and arguments containing spaces
+			finalArgs := append(netnsArgs, cmd.Args...)
+
+			logger(firewallConfiguration).Info("Wrapping command with nsenter", "args", finalArgs)
+			stdin := cmd.Stdin
+			cmd = exec.Command(nsenterPath(firewallConfiguration), finalArgs...)
+			cmd.Stdin = stdin
+		}
+
+		if len(firewallConfiguration.Env) > 0 {
+			cmd.Env = firewallConfiguration.Env
+		}
+		if firewallConfiguration.BeforeCommand != nil {
+			firewallConfiguration.BeforeCommand(cmd)
+		}
+		out, err := runWithRetries(firewallConfiguration, cmd, originalCmd)
+		if firewallConfiguration.AfterCommand != nil {
+			firewallConfiguration.AfterCommand(cmd, out, err)
+		}
+		sendEvent(firewallConfiguration, Event{Kind: CommandResult, Command: commandArgs, Output: out, Err: err})
+		return out, err
+	}
+	sendEvent(firewallConfiguration, Event{Kind: CommandResult, Command: commandArgs})
+	return nil, nil
+}
+
+// runWithRetries runs the command, retrying it while the xtables lock is held by another process, up to MaxRetries
+// times.
+func runWithRetries(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd, originalCmd string) ([]byte, error) {
+	var out, stderr []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		out, stderr, err = runCommand(firewallConfiguration, cmd)
+		logger(firewallConfiguration).Info("Command output", "command", originalCmd, "output", string(out))
+		if len(stderr) > 0 {
+			if err != nil {
+				logger(firewallConfiguration).Error("Command error output", "command", originalCmd, "stderr", string(stderr))
+			} else {
+				logger(firewallConfiguration).Info("Command error output", "command", originalCmd, "stderr", string(stderr))
 			}
-			finalArgs := append(nsenterArgs, originalCmdAsArgs...)
+		}
+		if ctx := firewallConfiguration.ctx; err != nil && ctx != nil && ctx.Err() != nil {
+			return out, contextError(cmd, ctx.Err())
+		}
+		if err == nil || attempt >= firewallConfiguration.MaxRetries || !(isLockContention(stderr) || isLockContention(out)) {
+			break
+		}
 
-			log.Printf(">> nsenter %v", finalArgs)
-			cmd = exec.Command("nsenter", finalArgs...)
+		backoff := firewallConfiguration.RetryBackoff << uint(attempt)
+		logger(firewallConfiguration).Info("Retrying command held up by the xtables lock", "command", originalCmd, "attempt", attempt+1, "backoff", backoff)
+		if err := sleep(firewallConfiguration.ctx, backoff); err != nil {
+			return out, contextError(cmd, err)
 		}
+	}
+	if err != nil {
+		// the standard error explains the failure, unless the runner only provided combined output
+		detail := stderr
+		if len(bytes.TrimSpace(detail)) == 0 {
+			detail = out
+		}
+		return out, newCommandError(cmd.Args, err, strings.TrimSpace(string(detail)))
+	}
+	return out, nil
+}
+
+// supportsWaitFlag checks whether the command understands the wait flag. Only iptables and iptables-restore do;
+// iptables-save rejects it on many versions, and the `ip` commands used for TPROXY routing don't take the lock.
+func supportsWaitFlag(cmd *exec.Cmd) bool {
+	return cmd.Args[0] != "ip" && !strings.HasSuffix(cmd.Args[0], "-save")
+}
+
+// waitFlagArgs returns the arguments making iptables wait for the xtables lock.
+func waitFlagArgs(firewallConfiguration FirewallConfiguration) []string {
+	args := []string{"-w"}
+	if firewallConfiguration.WaitFlagSeconds > 0 {
+		args = append(args, strconv.Itoa(firewallConfiguration.WaitFlagSeconds))
+	}
+	if firewallConfiguration.WaitInterval > 0 {
+		args = append(args, "-W", strconv.FormatInt(firewallConfiguration.WaitInterval.Microseconds(), 10))
+	}
+	return args
+}
 
-		out, err := cmd.CombinedOutput()
-		log.Printf("< %s\n", string(out))
+// runCommand runs a fresh copy of cmd bound to the configured context, so that the same command can be attempted
+// more than once. It returns the standard output and error of the command separately.
+func runCommand(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd) ([]byte, []byte, error) {
+	name := cmd.Args[0]
+	if _, ok := envPath(cmd.Env); ok {
+		path, err := lookPathInEnv(cmd.Env, name)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		name = path
 	}
-	return nil
+	run := exec.Command(name, cmd.Args[1:]...)
+	if ctx := firewallConfiguration.ctx; ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		run = exec.CommandContext(ctx, name, cmd.Args[1:]...)
+	}
+	run.Args[0] = cmd.Args[0]
+	run.Env = cmd.Env
+	// rewind the input consumed by a previous attempt
+	if seeker, ok := cmd.Stdin.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+	}
+	run.Stdin = cmd.Stdin
+	var stderr bytes.Buffer
+	run.Stderr = &stderr
+	out, err := commandRunner(firewallConfiguration).Run(run)
+	return out, stderr.Bytes(), err
+}
+
+// isLockContention checks whether a command failed because another process was holding the xtables lock, rather
+// than because of the command itself. Such failures are worth retrying.
+func isLockContention(out []byte) bool {
+	return bytes.Contains(out, []byte("holding the xtables lock")) ||
+		bytes.Contains(out, []byte("Resource temporarily unavailable"))
+}
+
+// sleep waits for the given duration, returning early with the context's error when it's done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// contextError describes a command that couldn't complete because its context is done.
+func contextError(cmd *exec.Cmd, err error) error {
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("command %q timed out: %w", cmd.Args, err)
+	}
+	return fmt.Errorf("command %q was cancelled: %w", cmd.Args, err)
+}
+
+// logger returns the configured Logger, falling back to writing entries to the configured Output.
+func logger(firewallConfiguration FirewallConfiguration) Logger {
+	if firewallConfiguration.Logger != nil {
+		return firewallConfiguration.Logger
+	}
+	if firewallConfiguration.Output != nil {
+		return stdLogger{out: log.New(firewallConfiguration.Output, "", log.LstdFlags)}
+	}
+	return stdLogger{}
+}
+
+// commandRunner returns the configured CommandRunner, falling back to executing commands on the host.
+func commandRunner(firewallConfiguration FirewallConfiguration) CommandRunner {
+	if firewallConfiguration.Runner == nil {
+		return execRunner{}
+	}
+	return firewallConfiguration.Runner
+}
+
+// makeIgnoreEstablished ignores the packets of established connections and those related to them.
+func makeIgnoreEstablished(binary string, table string, chainName string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
+		"-A", chainName,
+		"-m", "conntrack",
+		"--ctstate", "ESTABLISHED,RELATED",
+		"-j", "RETURN",
+		"-m", "comment",
+		"--comment", formatComment(comment))
+}
+
+// makeIgnoreNotNew ignores the packets that don't start a connection.
+func makeIgnoreNotNew(binary string, table string, chainName string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
+		"-A", chainName,
+		"-m", "conntrack",
+		"!", "--ctstate", "NEW",
+		"-j", "RETURN",
+		"-m", "comment",
+		"--comment", formatComment(comment))
+}
+
+// makeIgnoreDNAT ignores the packets whose destination was translated by a DNAT rule.
+func makeIgnoreDNAT(binary string, table string, chainName string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
+		"-A", chainName,
+		"-m", "conntrack",
+		"--ctstate", "DNAT",
+		"-j", "RETURN",
+		"-m", "comment",
+		"--comment", formatComment(comment))
 }
 
-func makeIgnoreUserID(chainName string, uid int, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+// makeIgnoreOwner ignores the traffic of the given owner, matched with either `--uid-owner` or `--gid-owner`. The
+// owner is an ID or a range of IDs such as `2102-2110`.
+func makeIgnoreOwner(binary string, table string, chainName string, ownerFlag string, owner string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-A", chainName,
 		"-m", "owner",
-		"--uid-owner", strconv.Itoa(uid),
+		ownerFlag, owner,
 		"-j", "RETURN",
 		"-m", "comment",
 		"--comment", formatComment(comment))
 }
 
-func makeCreateNewChain(name string, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeCreateNewChain(binary string, table string, name string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-N", name,
 		"-m", "comment",
 		"--comment", formatComment(comment))
 }
 
-func makeFlushChain(name string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeFlushChain(binary string, table string, name string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-F", name)
 }
 
-func makeDeleteChain(name string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeDeleteChain(binary string, table string, name string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-X", name)
 }
 
-func makeRedirectChainToPort(chainName string, portToRedirect int, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeRedirectChainToPort(binary string, table string, chainName string, protocol string, dnatAddress string, portToRedirect int, comment string) *exec.Cmd {
+	args := append([]string{
+		"-t", table,
 		"-A", chainName,
-		"-p", "tcp",
-		"-j", "REDIRECT",
-		"--to-port", strconv.Itoa(portToRedirect),
+		"-p", protocol},
+		redirectTarget(dnatAddress, portToRedirect)...)
+	return exec.Command(binary, append(args,
 		"-m", "comment",
-		"--comment", formatComment(comment))
+		"--comment", formatComment(comment))...)
 }
 
-func makeIgnorePorts(chainName string, destinations []string, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+// redirectTarget returns the target sending traffic to the port, with DNAT to the address or, when empty, with
+// REDIRECT to the primary address of the incoming interface.
+func redirectTarget(dnatAddress string, port int) []string {
+	if dnatAddress == "" {
+		return []string{"-j", "REDIRECT", "--to-port", strconv.Itoa(port)}
+	}
+	return []string{"-j", "DNAT", "--to-destination", net.JoinHostPort(dnatAddress, strconv.Itoa(port))}
+}
+
+// makeMarkChain sets the fwmark of the traffic to the destination port or port range, or of all the traffic when
+// destination is empty. MARK doesn't terminate the chain, so the traffic still reaches the following rules.
+func makeMarkChain(binary string, table string, chainName string, protocol string, destination string, mark int, mask int64, comment string) *exec.Cmd {
+	args := []string{
+		"-t", table,
 		"-A", chainName,
-		"-p", "tcp",
+		"-p", protocol,
+	}
+	if destination != "" {
+		args = append(args, "--destination-port", destination)
+	}
+	return exec.Command(binary, append(args,
+		"-j", "MARK",
+		"--set-xmark", fmt.Sprintf("%#x/%#x", mark, mask),
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
+}
+
+// makeIgnorePorts sends the traffic to the ports to the target, usually RETURN, appending the rule to the chain or
+// inserting it at the given position when it's positive.
+func makeIgnorePorts(binary string, table string, chainName string, position int, protocol string, destinations []string, target string, comment string) *exec.Cmd {
+	args := []string{"-t", table, "-A", chainName}
+	if position > 0 {
+		args = []string{"-t", table, "-I", chainName, strconv.Itoa(position)}
+	}
+	return exec.Command(binary, append(args,
+		"-p", protocol,
 		"--match", "multiport",
 		"--dports", strings.Join(destinations, ","),
+		"-j", target,
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
+}
+
+func makeIgnoreOutboundCIDR(binary string, table string, chainName string, cidr string, target string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
+		"-A", chainName,
+		"-d", cidr,
+		"-j", target,
+		"-m", "comment",
+		"--comment", formatComment(comment))
+}
+
+// makeRewriteSource rewrites the source of the connections whose destination was rewritten, such as by REDIRECT, to
+// the address or, when empty, to the address of the outgoing interface.
+func makeRewriteSource(binary string, table string, chainName string, address string, comment string) *exec.Cmd {
+	target := []string{"-j", "MASQUERADE"}
+	if address != "" {
+		target = []string{"-j", "SNAT", "--to-source", address}
+	}
+	args := append([]string{
+		"-t", table,
+		"-A", chainName,
+		"-m", "conntrack",
+		"--ctstate", "DNAT"},
+		target...)
+	return exec.Command(binary, append(args,
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
+}
+
+func makeNoTrack(binary string, chainName string, protocol string, portFlag string, port int, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", "raw",
+		"-A", chainName,
+		"-p", protocol,
+		portFlag, strconv.Itoa(port),
+		"-j", "NOTRACK",
+		"-m", "comment",
+		"--comment", formatComment(comment))
+}
+
+func makeIgnoreProtocol(binary string, table string, chainName string, protocol string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
+		"-A", chainName,
+		"-p", protocol,
 		"-j", "RETURN",
 		"-m", "comment",
 		"--comment", formatComment(comment))
 }
 
-func makeIgnoreLoopback(chainName string, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeIgnoreDNS(binary string, table string, chainName string, protocol string, address string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-A", chainName,
-		"-o", "lo",
+		"-p", protocol,
+		"-d", address,
+		"--dport", "53",
 		"-j", "RETURN",
 		"-m", "comment",
 		"--comment", formatComment(comment))
 }
 
-func makeRedirectChainToPortBasedOnDestinationPort(chainName string, destinationPort int, portToRedirect int, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeIgnoreInboundCIDR(binary string, table string, chainName string, cidr string, target string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-A", chainName,
-		"-p", "tcp",
-		"--destination-port", strconv.Itoa(destinationPort),
-		"-j", "REDIRECT",
-		"--to-port", strconv.Itoa(portToRedirect),
+		"-s", cidr,
+		"-j", target,
 		"-m", "comment",
 		"--comment", formatComment(comment))
 }
 
-func makeJumpFromChainToAnotherForAllProtocols(chainName string, targetChain string, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeIgnoreLoopback(binary string, table string, chainName string, loopbackInterface string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-A", chainName,
-		"-j", targetChain,
+		"-o", loopbackInterface,
+		"-j", "RETURN",
+		"-m", "comment",
+		"--comment", formatComment(comment))
+}
+
+func makeRedirectChainToPortBasedOnDestinationPort(binary string, table string, chainName string, protocol string, destination string, dnatAddress string, portToRedirect int, comment string) *exec.Cmd {
+	args := append([]string{
+		"-t", table,
+		"-A", chainName,
+		"-p", protocol,
+		"--destination-port", destination},
+		redirectTarget(dnatAddress, portToRedirect)...)
+	return exec.Command(binary, append(args,
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
+}
+
+// makeLogChain logs the new connections to the destination port or port range, or all new connections when
+// destination is empty. LOG doesn't terminate the chain, so the traffic still reaches the following rules.
+func makeLogChain(binary string, table string, chainName string, protocol string, destination string, prefix string, comment string) *exec.Cmd {
+	args := []string{
+		"-t", table,
+		"-A", chainName,
+		"-p", protocol,
+	}
+	if destination != "" {
+		args = append(args, "--destination-port", destination)
+	}
+	return exec.Command(binary, append(args,
+		"-m", "conntrack",
+		"--ctstate", "NEW",
+		"-j", "LOG",
+		"--log-prefix", prefix,
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
+}
+
+// makeLogPackets logs all the packets reaching the rule, at most at the given rate when it isn't empty.
+func makeLogPackets(binary string, table string, chainName string, prefix string, rateLimit string, comment string) *exec.Cmd {
+	args := []string{
+		"-t", table,
+		"-A", chainName,
+	}
+	if rateLimit != "" {
+		args = append(args, "-m", "limit", "--limit", rateLimit)
+	}
+	return exec.Command(binary, append(args,
+		"-j", "LOG",
+		"--log-prefix", prefix,
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
+}
+
+// makeTproxyChainToPort intercepts traffic with the TPROXY target, optionally only for the given destination port(s).
+func makeTproxyChainToPort(binary string, chainName string, protocol string, destination string, portToRedirect int, mark int, comment string) *exec.Cmd {
+	args := []string{
+		"-t", "mangle",
+		"-A", chainName,
+		"-p", protocol,
+	}
+	if destination != "" {
+		args = append(args, "--destination-port", destination)
+	}
+	args = append(args,
+		"-j", "TPROXY",
+		"--on-port", strconv.Itoa(portToRedirect),
+		"--tproxy-mark", fmt.Sprintf("%d/%d", mark, mark),
 		"-m", "comment",
 		"--comment", formatComment(comment))
+	return exec.Command(binary, args...)
+}
+
+func makeTproxyRoutingRule(family string, mark int) *exec.Cmd {
+	return exec.Command("ip", ipFamilyFlag(family), "rule", "add",
+		"fwmark", strconv.Itoa(mark),
+		"lookup", strconv.Itoa(TproxyRouteTable))
+}
+
+func makeDeleteTproxyRoutingRule(family string, mark int) *exec.Cmd {
+	return exec.Command("ip", ipFamilyFlag(family), "rule", "del",
+		"fwmark", strconv.Itoa(mark),
+		"lookup", strconv.Itoa(TproxyRouteTable))
+}
+
+func makeTproxyLocalRoute(family string, loopbackInterface string) *exec.Cmd {
+	destination := "0.0.0.0/0"
+	if family == IPv6Family {
+		destination = "::/0"
+	}
+	return exec.Command("ip", ipFamilyFlag(family), "route", "add",
+		"local", destination,
+		"dev", loopbackInterface,
+		"table", strconv.Itoa(TproxyRouteTable))
+}
+
+func makeFlushTproxyRouteTable(family string) *exec.Cmd {
+	return exec.Command("ip", ipFamilyFlag(family), "route", "flush",
+		"table", strconv.Itoa(TproxyRouteTable))
+}
+
+func makeListRoutingRules(family string) *exec.Cmd {
+	return exec.Command("ip", ipFamilyFlag(family), "rule", "show")
+}
+
+func makeListTproxyRoutes(family string) *exec.Cmd {
+	return exec.Command("ip", ipFamilyFlag(family), "route", "show",
+		"table", strconv.Itoa(TproxyRouteTable))
+}
+
+// ipFamilyFlag returns the flag selecting the given IP family in `ip` commands.
+func ipFamilyFlag(family string) string {
+	if family == IPv6Family {
+		return "-6"
+	}
+	return "-4"
+}
+
+// addJumpsIntoChain jumps from the built-in chain into the proxy-init chain, once for all protocols or, with
+// ScopeJumpsToProtocols, once per redirected protocol.
+func addJumpsIntoChain(firewallConfiguration FirewallConfiguration, table string, chainName string, inInterface string, outInterface string, targetChain string, comment string, commands []*exec.Cmd) []*exec.Cmd {
+	binary := iptablesBinary(firewallConfiguration)
+	if !firewallConfiguration.ScopeJumpsToProtocols {
+		return append(commands, makeJumpFromChainToAnotherForAllProtocols(binary, table, chainName, firewallConfiguration.JumpPosition, inInterface, outInterface, targetChain, comment))
+	}
+	for _, protocol := range protocols(firewallConfiguration) {
+		commands = append(commands, makeJumpFromChainToAnotherForProtocol(binary, table, chainName, firewallConfiguration.JumpPosition, inInterface, outInterface, protocol, targetChain, fmt.Sprintf("%s-%s", comment, protocol)))
+	}
+	return commands
+}
+
+// makeJumpFromChainToAnotherForProtocol behaves like makeJumpFromChainToAnotherForAllProtocols for the traffic of
+// the protocol only.
+func makeJumpFromChainToAnotherForProtocol(binary string, table string, chainName string, position int, inInterface string, outInterface string, protocol string, targetChain string, comment string) *exec.Cmd {
+	args := []string{"-t", table, "-A", chainName}
+	if position > 0 {
+		args = []string{"-t", table, "-I", chainName, strconv.Itoa(position)}
+	}
+	if inInterface != "" {
+		args = append(args, "-i", inInterface)
+	}
+	if outInterface != "" {
+		args = append(args, "-o", outInterface)
+	}
+	return exec.Command(binary, append(args,
+		"-p", protocol,
+		"-j", targetChain,
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
+}
+
+// makeJumpFromChainToAnotherForAllProtocols appends the jump to the chain, or inserts it at the given position when
+// it's positive. When inInterface or outInterface isn't empty, only the packets arriving or leaving through that
+// interface jump.
+func makeJumpFromChainToAnotherForAllProtocols(binary string, table string, chainName string, position int, inInterface string, outInterface string, targetChain string, comment string) *exec.Cmd {
+	args := []string{"-t", table, "-A", chainName}
+	if position > 0 {
+		args = []string{"-t", table, "-I", chainName, strconv.Itoa(position)}
+	}
+	if inInterface != "" {
+		args = append(args, "-i", inInterface)
+	}
+	if outInterface != "" {
+		args = append(args, "-o", outInterface)
+	}
+	return exec.Command(binary, append(args,
+		"-j", targetChain,
+		"-m", "comment",
+		"--comment", formatComment(comment))...)
 }
 
-func makeRedirectChainForOutgoingTraffic(chainName string, redirectChainName string, uid int, comment string) *exec.Cmd {
-	return exec.Command("iptables",
-		"-t", "nat",
+func makeRedirectChainForOutgoingTraffic(binary string, table string, chainName string, redirectChainName string, ownerFlag string, owner string, loopbackInterface string, loopback string, comment string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
 		"-A", chainName,
 		"-m", "owner",
-		"--uid-owner", strconv.Itoa(uid),
-		"-o", "lo",
-		"!", "-d 127.0.0.1/32",
+		ownerFlag, owner,
+		"-o", loopbackInterface,
+		"!", "-d", loopback,
 		"-j", redirectChainName,
 		"-m", "comment",
 		"--comment", formatComment(comment))
 }
 
-func makeShowAllRules() *exec.Cmd {
-	return exec.Command("iptables", "-t", "nat", "-vnL")
+func makeShowAllRules(binary string, table string) *exec.Cmd {
+	return exec.Command(binary, "-t", table, "-vnL")
 }
 
 // asDestination formats the provided `PortRange` for output in commands.
@@ -1,8 +1,19 @@
 package iptables
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMakeMultiportDestinations(t *testing.T) {
@@ -22,8 +33,2290 @@ func TestMakeMultiportDestinations_Split(t *testing.T) {
 		[][]string{{"22:23", "25:27", "33:34", "35", "37:38", "50:54", "56", "58", "60", "63"}, {"70:72"}})
 }
 
+func TestUniquePorts(t *testing.T) {
+	unique := uniquePorts([]int{8080, 80, 443, 80, 8080})
+	if !reflect.DeepEqual(unique, []int{80, 443, 8080}) {
+		t.Fatalf("expected [80 443 8080] but got %v", unique)
+	}
+}
+
+func TestUniquePortRanges(t *testing.T) {
+	unique := uniquePortRanges([]string{"33", "25-27", "22-22", "22", "not-a-number", "25-27", "25-26"})
+	if !reflect.DeepEqual(unique, []string{"22", "25-26", "25-27", "33"}) {
+		t.Fatalf("expected [22 25-26 25-27 33] but got %v", unique)
+	}
+}
+
+func TestCoalescePortRanges(t *testing.T) {
+	coalesced := coalescePortRanges(uniquePortRanges([]string{"82-90", "80", "81", "85", "100", "102", "103-104", "200-300", "250-260"}))
+	if expected := []string{"80-90", "100", "102-104", "200-300"}; !reflect.DeepEqual(coalesced, expected) {
+		t.Fatalf("expected %v but got %v", expected, coalesced)
+	}
+}
+
+func TestBuildRules_ManyIgnoredPorts(t *testing.T) {
+	portsToIgnore := make([]string, 0)
+	for port := 10000; port < 12000; port++ {
+		portsToIgnore = append(portsToIgnore, strconv.Itoa(port))
+	}
+	for port := 20000; port < 20040; port += 2 {
+		portsToIgnore = append(portsToIgnore, strconv.Itoa(port))
+	}
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                 RedirectAllMode,
+		ProxyInboundPort:     4143,
+		ProxyOutgoingPort:    4140,
+		InboundPortsToIgnore: portsToIgnore,
+		SkipOutbound:         true,
+		DisableComments:      true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "--dports 10000:11999") || strings.Contains(command, "--dports 20026") {
+			found = append(found, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 10000:11999,20000,20002,20004,20006,20008,20010,20012,20014,20016,20018,20020,20022,20024 -j RETURN",
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 20026,20028,20030,20032,20034,20036,20038 -j RETURN",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+}
+
 func assertEqual(t *testing.T, check [][]string, expected [][]string) {
 	if !reflect.DeepEqual(check, expected) {
 		t.Fatalf("mismatch: got \"%s\" expected \"%s\"", check, expected)
 	}
 }
+
+func TestIPFamilies(t *testing.T) {
+	for _, tt := range []struct {
+		family   string
+		expected []string
+	}{
+		{"", []string{IPv4Family}},
+		{IPv4Family, []string{IPv4Family}},
+		{IPv6Family, []string{IPv6Family}},
+		{DualStackFamily, []string{IPv4Family, IPv6Family}},
+	} {
+		families := ipFamilies(FirewallConfiguration{IPFamily: tt.family})
+		if !reflect.DeepEqual(families, tt.expected) {
+			t.Fatalf("expected families %v for %q but got %v", tt.expected, tt.family, families)
+		}
+	}
+}
+
+func TestMakeRedirectChainForOutgoingTraffic(t *testing.T) {
+	cmd := makeRedirectChainForOutgoingTraffic("iptables", "nat", "PROXY_INIT_OUTPUT", "PROXY_INIT_REDIRECT", "--uid-owner", "2102", "lo", "127.0.0.1/32", "test")
+	expected := []string{
+		"iptables",
+		"-t", "nat",
+		"-A", "PROXY_INIT_OUTPUT",
+		"-m", "owner",
+		"--uid-owner", "2102",
+		"-o", "lo",
+		"!", "-d", "127.0.0.1/32",
+		"-j", "PROXY_INIT_REDIRECT",
+		"-m", "comment",
+		"--comment", formatComment("test"),
+	}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Fatalf("expected args %q but got %q", expected, cmd.Args)
+	}
+}
+
+func TestMakeRedirectChainForOutgoingTraffic_IPv6(t *testing.T) {
+	cmd := makeRedirectChainForOutgoingTraffic(iptablesBinary(FirewallConfiguration{IPFamily: IPv6Family}), "nat", "PROXY_INIT_OUTPUT", "PROXY_INIT_REDIRECT", "--uid-owner", "2102", "lo", loopbackAddress(FirewallConfiguration{IPFamily: IPv6Family}), "test")
+	if cmd.Args[0] != "ip6tables" {
+		t.Fatalf("expected ip6tables binary but got %s", cmd.Args[0])
+	}
+	if !strings.Contains(strings.Join(cmd.Args, " "), "::1/128") {
+		t.Fatalf("expected IPv6 loopback address in %v", cmd.Args)
+	}
+}
+
+func TestIptablesBinary(t *testing.T) {
+	for _, tt := range []struct {
+		family   string
+		backend  string
+		expected string
+	}{
+		{IPv4Family, "", "iptables"},
+		{IPv6Family, "", "ip6tables"},
+		{IPv4Family, LegacyBackend, "iptables-legacy"},
+		{IPv4Family, NftBackend, "iptables-nft"},
+		{IPv6Family, NftBackend, "ip6tables-nft"},
+	} {
+		binary := iptablesBinary(FirewallConfiguration{IPFamily: tt.family, Backend: tt.backend})
+		if binary != tt.expected {
+			t.Fatalf("expected binary %s for family %q and backend %q but got %s", tt.expected, tt.family, tt.backend, binary)
+		}
+	}
+}
+
+func TestIptablesBinary_Paths(t *testing.T) {
+	fc := FirewallConfiguration{
+		Backend:           NftBackend,
+		IptablesPath:      "/sbin/iptables",
+		IptablesSavePath:  "/sbin/iptables-save",
+		Ip6tablesPath:     "/sbin/ip6tables",
+		Ip6tablesSavePath: "",
+	}
+	for _, tt := range []struct {
+		family       string
+		expected     string
+		expectedSave string
+	}{
+		{IPv4Family, "/sbin/iptables", "/sbin/iptables-save"},
+		{IPv6Family, "/sbin/ip6tables", "/sbin/ip6tables-save"},
+	} {
+		fc.IPFamily = tt.family
+		if binary := iptablesBinary(fc); binary != tt.expected {
+			t.Fatalf("expected binary %s for family %q but got %s", tt.expected, tt.family, binary)
+		}
+		if binary := iptablesSaveBinary(fc); binary != tt.expectedSave {
+			t.Fatalf("expected save binary %s for family %q but got %s", tt.expectedSave, tt.family, binary)
+		}
+	}
+
+	if binary := iptablesSaveBinary(FirewallConfiguration{Backend: LegacyBackend}); binary != "iptables-legacy-save" {
+		t.Fatalf("expected save binary iptables-legacy-save but got %s", binary)
+	}
+}
+
+func TestCountRules(t *testing.T) {
+	saveOutput := []byte(`# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+:KUBE-SERVICES - [0:0]
+-A PREROUTING -j KUBE-SERVICES
+-A KUBE-SERVICES -d 10.96.0.1/32 -p tcp -j KUBE-SVC-NPX46M4PTMTKRN6Y
+COMMIT
+`)
+	if count := countRules(saveOutput); count != 2 {
+		t.Fatalf("expected 2 rules but got %d", count)
+	}
+}
+
+// recordingRunner is a CommandRunner that records the commands it's asked to run instead of executing them.
+type recordingRunner struct {
+	commands []string
+}
+
+func (r *recordingRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	r.commands = append(r.commands, strings.Join(cmd.Args, " "))
+	return nil, nil
+}
+
+func TestConfigureFirewall(t *testing.T) {
+	runner := &recordingRunner{}
+	err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		InboundPortsToIgnore:   []string{"4190"},
+		OutboundPortsToIgnore:  []string{"443"},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProxyUID:               2102,
+		Runner:                 runner,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables-save",
+		"iptables -t nat -vnL",
+		"iptables -t nat -S PREROUTING",
+		"iptables -t nat -S OUTPUT",
+		"iptables -t nat -F PROXY_INIT_REDIRECT",
+		"iptables -t nat -X PROXY_INIT_REDIRECT",
+		"iptables -t nat -F PROXY_INIT_OUTPUT",
+		"iptables -t nat -X PROXY_INIT_OUTPUT",
+		"iptables -t nat -N PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-common-chain"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4190 -j RETURN -m comment --comment " + formatComment("ignore-port-4190"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4143,4140 -j RETURN -m comment --comment " + formatComment("ignore-proxy-ports"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 8080 -j REDIRECT --to-port 4143 -m comment --comment " + formatComment("redirect-port-8080-to-proxy-port"),
+		"iptables -t nat -A PREROUTING -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("install-proxy-init-prerouting"),
+		"iptables -t nat -N PROXY_INIT_OUTPUT -m comment --comment " + formatComment("redirect-common-chain"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -o lo ! -d 127.0.0.1/32 -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-non-loopback-local-traffic"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -j RETURN -m comment --comment " + formatComment("ignore-proxy-user-id"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -o lo -j RETURN -m comment --comment " + formatComment("ignore-loopback"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --match multiport --dports 443 -j RETURN -m comment --comment " + formatComment("ignore-port-443"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp -j REDIRECT --to-port 4140 -m comment --comment " + formatComment("redirect-all-outgoing-to-proxy-port"),
+		"iptables -t nat -A OUTPUT -j PROXY_INIT_OUTPUT -m comment --comment " + formatComment("install-proxy-init-output"),
+		"iptables -t nat -vnL",
+	}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Fatalf("unexpected commands:\ngot:\n%s\nexpected:\n%s", strings.Join(runner.commands, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestBuildRules(t *testing.T) {
+	t.Run("It builds rules for every IP family without executing them", func(t *testing.T) {
+		runner := &recordingRunner{}
+		commands, err := BuildRules(FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			IPFamily:          DualStackFamily,
+			Runner:            runner,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 0 {
+			t.Fatalf("expected no commands to be executed but got %v", runner.commands)
+		}
+		if len(commands) != 16 {
+			t.Fatalf("expected 16 commands but got %d", len(commands))
+		}
+		if commands[0].Args[0] != "iptables" || commands[len(commands)-1].Args[0] != "ip6tables" {
+			t.Fatalf("expected IPv4 rules followed by IPv6 rules but got %s and %s", commands[0].Args, commands[len(commands)-1].Args)
+		}
+	})
+
+	t.Run("It rejects unknown modes", func(t *testing.T) {
+		if _, err := BuildRules(FirewallConfiguration{Mode: "redirect-some"}); err == nil {
+			t.Fatal("expected error but got nil")
+		}
+	})
+}
+
+func TestBuildRules_RedirectUDP(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{53},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		RedirectUDP:            true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	redirects := make([]string, 0)
+	for _, cmd := range commands {
+		args := strings.Join(cmd.Args, " ")
+		if strings.Contains(args, "-j REDIRECT") {
+			redirects = append(redirects, args[:strings.Index(args, " -j REDIRECT")])
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 53",
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p udp --destination-port 53",
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp",
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p udp",
+	}
+	if !reflect.DeepEqual(redirects, expected) {
+		t.Fatalf("expected redirects %q but got %q", expected, redirects)
+	}
+}
+
+func TestBuildRules_OutboundCIDRsToIgnore(t *testing.T) {
+	t.Run("It ignores each CIDR with the rules of its IP family", func(t *testing.T) {
+		commands, err := BuildRules(FirewallConfiguration{
+			Mode:                  RedirectAllMode,
+			ProxyInboundPort:      4143,
+			ProxyOutgoingPort:     4140,
+			IPFamily:              DualStackFamily,
+			OutboundCIDRsToIgnore: []string{"10.0.0.0/8", "fd00::/8"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		ignores := make([]string, 0)
+		for _, cmd := range commands {
+			args := strings.Join(cmd.Args, " ")
+			if strings.Contains(args, " -d ") {
+				ignores = append(ignores, args[:strings.Index(args, " -m comment")])
+			}
+		}
+		expected := []string{
+			"iptables -t nat -A PROXY_INIT_OUTPUT -d 10.0.0.0/8 -j RETURN",
+			"ip6tables -t nat -A PROXY_INIT_OUTPUT -d fd00::/8 -j RETURN",
+		}
+		if !reflect.DeepEqual(ignores, expected) {
+			t.Fatalf("expected ignores %q but got %q", expected, ignores)
+		}
+	})
+
+	t.Run("It rejects malformed CIDRs", func(t *testing.T) {
+		_, err := BuildRules(FirewallConfiguration{
+			Mode:                  RedirectAllMode,
+			OutboundCIDRsToIgnore: []string{"10.0.0.1"},
+		})
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+	})
+}
+
+func TestBuildRules_InboundCIDRsToIgnore(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                 RedirectAllMode,
+		ProxyInboundPort:     4143,
+		ProxyOutgoingPort:    4140,
+		InboundCIDRsToIgnore: []string{"10.1.2.3/32"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -N PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-common-chain"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4143,4140 -j RETURN -m comment --comment " + formatComment("ignore-proxy-ports"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -s 10.1.2.3/32 -j RETURN -m comment --comment " + formatComment("ignore-inbound-cidr-10.1.2.3/32"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp -j REDIRECT --to-port 4143 -m comment --comment " + formatComment("redirect-all-incoming-to-proxy-port"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i, expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_PortRangesToRedirectInbound(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                        RedirectListedMode,
+		PortsToRedirectInbound:      []int{80},
+		PortRangesToRedirectInbound: []string{"8000-8100", "9090-9090"},
+		ProxyInboundPort:            4143,
+		ProxyOutgoingPort:           4140,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 80 -j REDIRECT --to-port 4143 -m comment --comment " + formatComment("redirect-port-80-to-proxy-port"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 8000:8100 -j REDIRECT --to-port 4143 -m comment --comment " + formatComment("redirect-port-8000:8100-to-proxy-port"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 9090 -j REDIRECT --to-port 4143 -m comment --comment " + formatComment("redirect-port-9090-to-proxy-port"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i+2].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i+2, expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_TproxyProxyMode(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		InboundPortsToIgnore:   []string{"4190"},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProxyUID:               2102,
+		ProxyMode:              TproxyProxyMode,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t mangle -N PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-common-chain"),
+		"iptables -t mangle -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4190 -j RETURN -m comment --comment " + formatComment("ignore-port-4190"),
+		"iptables -t mangle -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4143,4140 -j RETURN -m comment --comment " + formatComment("ignore-proxy-ports"),
+		"iptables -t mangle -A PROXY_INIT_REDIRECT -p tcp --destination-port 8080 -j TPROXY --on-port 4143 --tproxy-mark 1/1 -m comment --comment " + formatComment("redirect-port-8080-to-proxy-port"),
+		"iptables -t mangle -A PREROUTING -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("install-proxy-init-prerouting"),
+		"ip -4 rule add fwmark 1 lookup 100",
+		"ip -4 route add local 0.0.0.0/0 dev lo table 100",
+		"iptables -t nat -N PROXY_INIT_OUTPUT -m comment --comment " + formatComment("redirect-common-chain"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -j RETURN -m comment --comment " + formatComment("ignore-proxy-user-id"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i, expectedCommand, command)
+		}
+	}
+}
+
+func TestFormatLogEntry(t *testing.T) {
+	for _, tt := range []struct {
+		msg           string
+		keysAndValues []interface{}
+		expected      string
+	}{
+		{"Executing commands", nil, "Executing commands"},
+		{"Will ignore port(s)", []interface{}{"chain", "PROXY_INIT_OUTPUT", "ports", []string{"22", "25:27"}}, "Will ignore port(s) chain=PROXY_INIT_OUTPUT ports=\"[22 25:27]\""},
+		{"Ignoring uid", []interface{}{"uid", 2102, "chain"}, "Ignoring uid uid=2102 chain=(missing)"},
+	} {
+		if entry := formatLogEntry(tt.msg, tt.keysAndValues); entry != tt.expected {
+			t.Fatalf("expected entry [%s] but got [%s]", tt.expected, entry)
+		}
+	}
+}
+
+func TestConfigureFirewall_Output(t *testing.T) {
+	var output bytes.Buffer
+	err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		SimulateOnly:      true,
+		Output:            &output,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	lines := strings.Split(output.String(), "\n")
+	before, executing := -1, -1
+	for i, line := range lines {
+		if strings.HasSuffix(line, "State of iptables rules before run") {
+			before = i
+		}
+		if strings.HasSuffix(line, "Executing commands") {
+			executing = i
+		}
+	}
+	if before < 0 || executing < 0 || before > executing {
+		t.Fatalf("expected the current state to be dumped before executing commands, got:\n%s", output.String())
+	}
+	if !strings.Contains(lines[len(lines)-2], `command="iptables -t nat -vnL"`) {
+		t.Fatalf("expected the end state to be dumped last, got:\n%s", output.String())
+	}
+}
+
+func TestNewExecutionTraceID(t *testing.T) {
+	first, second := newExecutionTraceID(), newExecutionTraceID()
+	if first == second {
+		t.Fatalf("expected distinct trace IDs but got %s twice", first)
+	}
+	if strings.Contains(first, "/") {
+		t.Fatalf("trace ID %s must not contain the comment separator", first)
+	}
+}
+
+func TestValidModes(t *testing.T) {
+	for _, mode := range ValidModes() {
+		fc := FirewallConfiguration{
+			Mode:                    mode,
+			OutboundMode:            mode,
+			PortsToRedirectInbound:  []int{8080},
+			PortsToRedirectOutbound: []int{443},
+			ProxyInboundPort:        4143,
+			ProxyOutgoingPort:       4140,
+		}
+		if err := fc.Validate(); err != nil {
+			t.Fatalf("expected mode [%s] to be valid but got: %s", mode, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyUID:          2102,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		modify func(*FirewallConfiguration)
+		check  string
+	}{
+		{"unknown mode", func(c *FirewallConfiguration) { c.Mode = "redirect-some" }, "unknown redirect mode"},
+		{"unset inbound port", func(c *FirewallConfiguration) { c.ProxyInboundPort = 0 }, "ProxyInboundPort must be set"},
+		{"out of range outgoing port", func(c *FirewallConfiguration) { c.ProxyOutgoingPort = 65536 }, "ProxyOutgoingPort must be a port"},
+		{"outbound ports without outgoing port", func(c *FirewallConfiguration) {
+			c.ProxyOutgoingPort = 0
+			c.PortsToRedirectOutbound = []int{443}
+		}, "PortsToRedirectOutbound requires ProxyOutgoingPort"},
+		{"skipped inbound without outgoing port", func(c *FirewallConfiguration) {
+			c.ProxyOutgoingPort = 0
+			c.SkipInbound = true
+		}, "SkipInbound requires ProxyOutgoingPort"},
+		{"out of range admin port", func(c *FirewallConfiguration) { c.ProxyAdminPort = -1 }, "ProxyAdminPort must be a port"},
+		{"negative uid", func(c *FirewallConfiguration) { c.ProxyUID = -2 }, "ProxyUID must not be negative"},
+		{"empty redirect list", func(c *FirewallConfiguration) { c.Mode = RedirectListedMode }, "no incoming traffic would reach the proxy"},
+		{"port 0 to redirect", func(c *FirewallConfiguration) {
+			c.Mode = RedirectListedMode
+			c.PortsToRedirectInbound = []int{0}
+		}, "invalid port to redirect"},
+		{"invalid port to ignore", func(c *FirewallConfiguration) { c.InboundPortsToIgnore = []string{"0-22"} }, "invalid port or port range"},
+		{"unknown IP family", func(c *FirewallConfiguration) { c.IPFamily = "ipv5" }, "unknown IP family"},
+		{"too long chain name", func(c *FirewallConfiguration) { c.RedirectChainName = "PROXY_INIT_REDIRECT_FOR_MESH_ONE" }, "at most 28 characters"},
+		{"same chain names", func(c *FirewallConfiguration) { c.OutputChainName = ProxyInitRedirectChainName }, "must have different names"},
+		{"unknown outbound mode", func(c *FirewallConfiguration) { c.OutboundMode = "redirect-some" }, "unknown outbound redirect mode"},
+		{"check before add with iptables-restore", func(c *FirewallConfiguration) {
+			c.SkipInstalledRules = true
+			c.UseIptablesRestore = true
+		}, "SkipInstalledRules and UseIptablesRestore can't be used together"},
+		{"too long comment label", func(c *FirewallConfiguration) { c.CommentLabel = strings.Repeat("a", 129) }, "at most 128 characters"},
+		{"quoted comment label", func(c *FirewallConfiguration) { c.CommentLabel = `"web"` }, "must not contain quotes"},
+		{"trace ID with a slash", func(c *FirewallConfiguration) { c.TraceID = "run/1" }, "TraceID must not contain slashes"},
+		{"empty outbound redirect list", func(c *FirewallConfiguration) { c.OutboundMode = RedirectListedMode }, "outbound mode requires at least one port"},
+		{"negative jump position", func(c *FirewallConfiguration) { c.JumpPosition = -1 }, "JumpPosition must not be negative"},
+		{"check and simulate", func(c *FirewallConfiguration) {
+			c.CheckMode = true
+			c.SimulateOnly = true
+		}, "can't be used together"},
+		{"negative retries", func(c *FirewallConfiguration) { c.MaxRetries = -1 }, "MaxRetries must not be negative"},
+		{"new connections only with TPROXY", func(c *FirewallConfiguration) {
+			c.RedirectNewOnly = true
+			c.ProxyMode = TproxyProxyMode
+		}, "can't be used together"},
+		{"node local without node addresses", func(c *FirewallConfiguration) { c.IgnoreNodeLocal = true }, "IgnoreNodeLocal requires NodeAddresses"},
+		{"inbound interface with a slash", func(c *FirewallConfiguration) { c.InboundInterface = "eth0/1" }, "invalid inbound interface"},
+		{"outbound interface with whitespace", func(c *FirewallConfiguration) { c.OutboundInterface = "eth 1" }, "invalid outbound interface"},
+		{"loopback outbound interface", func(c *FirewallConfiguration) { c.OutboundInterface = "lo" }, "OutboundInterface must not be the loopback interface"},
+		{"foreign chain names", func(c *FirewallConfiguration) {
+			c.PreserveForeignChains = true
+			c.OutputChainName = "NODE_AGENT_OUTPUT"
+		}, "requires chain names starting with PROXY_INIT_"},
+		{"preserving foreign chains without comments", func(c *FirewallConfiguration) {
+			c.PreserveForeignChains = true
+			c.DisableComments = true
+		}, "can't be used together"},
+		{"ignore target with whitespace", func(c *FirewallConfiguration) { c.IgnoreTarget = "LOG AND ACCEPT" }, "invalid ignore target"},
+		{"negative state dump timeout", func(c *FirewallConfiguration) { c.StateDumpTimeout = -time.Second }, "StateDumpTimeout must not be negative"},
+		{"inbound port target for an unlisted port", func(c *FirewallConfiguration) { c.InboundPortTargets = map[int]int{8080: 4144} }, "isn't in PortsToRedirectInbound"},
+		{"invalid inbound port target", func(c *FirewallConfiguration) {
+			c.Mode = RedirectListedMode
+			c.PortsToRedirectInbound = []int{8080}
+			c.InboundPortTargets = map[int]int{8080: 0}
+		}, "must map port [8080] to a port between 1 and 65535"},
+		{"outbound port target for an unlisted port", func(c *FirewallConfiguration) { c.OutboundPortTargets = map[int]int{443: 4145} }, "isn't in PortsToRedirectOutbound"},
+		{"invalid outbound port target", func(c *FirewallConfiguration) {
+			c.OutboundMode = RedirectListedMode
+			c.PortsToRedirectOutbound = []int{443}
+			c.OutboundPortTargets = map[int]int{443: 70000}
+		}, "must map port [443] to a port between 1 and 65535"},
+		{"fwmark outside of its mask", func(c *FirewallConfiguration) {
+			c.FwMark = 0x3
+			c.FwMarkMask = 0xff00
+		}, "sets bits outside of FwMarkMask"},
+		{"skip both directions", func(c *FirewallConfiguration) {
+			c.SkipInbound = true
+			c.SkipOutbound = true
+		}, "nothing to configure"},
+		{"netns by path and PID", func(c *FirewallConfiguration) {
+			c.NetNs = "/var/run/netns/test"
+			c.NetNsPID = 42
+		}, "NetNs and NetNsPID can't be used together"},
+		{"invalid cluster DNS address", func(c *FirewallConfiguration) { c.ClusterDNSAddresses = []string{"kube-dns"} }, "invalid cluster DNS address"},
+		{"two IPv4 loopback CIDRs", func(c *FirewallConfiguration) { c.LoopbackCIDRs = []string{"127.0.0.1/32", "127.0.0.0/8"} }, "at most one ipv4 CIDR"},
+		{"invalid node address", func(c *FirewallConfiguration) { c.NodeAddresses = []string{"node-1"} }, "invalid node address"},
+		{"invalid SNAT address", func(c *FirewallConfiguration) { c.SNATAddress = "gateway" }, "invalid SNAT address"},
+		{"invalid DNAT address", func(c *FirewallConfiguration) {
+			c.UseDNAT = true
+			c.DNATAddress = "localhost"
+		}, "invalid DNAT address"},
+		{"DNAT address without DNAT", func(c *FirewallConfiguration) { c.DNATAddress = "127.0.0.2" }, "DNATAddress requires UseDNAT"},
+		{"negative UID range", func(c *FirewallConfiguration) { c.ProxyUIDRange = [2]int{-1, 2102} }, "ProxyUIDRange must not be negative"},
+		{"reversed UID range", func(c *FirewallConfiguration) { c.ProxyUIDRange = [2]int{2110, 2102} }, "ProxyUIDRange must not start after its end"},
+		{"UID and UID range", func(c *FirewallConfiguration) {
+			c.ProxyUID = 2102
+			c.ProxyUIDRange = [2]int{2102, 2110}
+		}, "ProxyUID and ProxyUIDRange can't be used together"},
+		{"masquerade and SNAT", func(c *FirewallConfiguration) {
+			c.Masquerade = true
+			c.SNATAddress = "10.0.0.1"
+		}, "Masquerade and SNATAddress can't be used together"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.modify(&config)
+			err := config.Validate()
+			if err == nil {
+				t.Fatal("expected error but got nil")
+			}
+			if !strings.Contains(err.Error(), tt.check) {
+				t.Fatalf("expected error to contain [%s] but got [%s]", tt.check, err)
+			}
+		})
+	}
+}
+
+func TestExecuteCommand_WrapsErrors(t *testing.T) {
+	failure := errors.New("exit status 1")
+	runner := &scriptedRunner{
+		outputs: map[string]string{"iptables -t nat -N PROXY_INIT_REDIRECT": "iptables: Chain already exists.\n"},
+		errors:  map[string]error{"iptables -t nat -N PROXY_INIT_REDIRECT": failure},
+	}
+
+	err := executeCommand(FirewallConfiguration{Runner: runner}, exec.Command("iptables", "-t", "nat", "-N", "PROXY_INIT_REDIRECT"))
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected error to wrap [%s] but got [%s]", failure, err)
+	}
+	expected := `command ["iptables" "-t" "nat" "-N" "PROXY_INIT_REDIRECT"] failed: exit status 1: iptables: Chain already exists.`
+	if err.Error() != expected {
+		t.Fatalf("expected error [%s] but got [%s]", expected, err)
+	}
+}
+
+func TestWaitFlagArgs(t *testing.T) {
+	for _, tt := range []struct {
+		seconds  int
+		interval time.Duration
+		expected []string
+	}{
+		{0, 0, []string{"-w"}},
+		{5, 0, []string{"-w", "5"}},
+		{5, 100 * time.Millisecond, []string{"-w", "5", "-W", "100000"}},
+	} {
+		args := waitFlagArgs(FirewallConfiguration{UseWaitFlag: true, WaitFlagSeconds: tt.seconds, WaitInterval: tt.interval})
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Fatalf("expected args %v for %ds and %s but got %v", tt.expected, tt.seconds, tt.interval, args)
+		}
+	}
+}
+
+func TestExecuteCommand_Retries(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		output   string
+		attempts int
+	}{
+		{"It retries failures caused by the xtables lock", "Another app is currently holding the xtables lock. Perhaps you want to use the -w option?\n", 3},
+		{"It doesn't retry other failures", "iptables: Chain already exists.\n", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			command := "iptables -t nat -N PROXY_INIT_REDIRECT"
+			runner := &scriptedRunner{
+				outputs: map[string]string{command: tt.output},
+				errors:  map[string]error{command: errors.New("exit status 4")},
+			}
+
+			err := executeCommand(FirewallConfiguration{Runner: runner, MaxRetries: 2, RetryBackoff: time.Millisecond}, exec.Command("iptables", "-t", "nat", "-N", "PROXY_INIT_REDIRECT"))
+			if err == nil {
+				t.Fatal("expected error but got nil")
+			}
+			if len(runner.commands) != tt.attempts {
+				t.Fatalf("expected %d attempts but got %d", tt.attempts, len(runner.commands))
+			}
+		})
+	}
+}
+
+// stderrRunner is a CommandRunner writing a fixed standard output and error, failing when the error isn't empty.
+type stderrRunner struct {
+	stdout, stderr string
+}
+
+func (r stderrRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	if r.stderr == "" {
+		return []byte(r.stdout), nil
+	}
+	if _, err := cmd.Stderr.Write([]byte(r.stderr)); err != nil {
+		return nil, err
+	}
+	return []byte(r.stdout), errors.New("exit status 1")
+}
+
+func TestExecuteCommand_Stderr(t *testing.T) {
+	t.Run("It returns the standard output alone", func(t *testing.T) {
+		out, err := executeCommandWithOutput(FirewallConfiguration{Runner: stderrRunner{stdout: "*nat\nCOMMIT\n"}}, exec.Command("iptables-save", "-t", "nat"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(out) != "*nat\nCOMMIT\n" {
+			t.Fatalf("unexpected output %q", out)
+		}
+	})
+
+	t.Run("It explains failures with the standard error", func(t *testing.T) {
+		runner := stderrRunner{stdout: "Chain PREROUTING (policy ACCEPT)", stderr: "iptables: Permission denied (you must be root).\n"}
+		_, err := executeCommandWithOutput(FirewallConfiguration{Runner: runner}, exec.Command("iptables", "-t", "nat", "-vnL"))
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if !strings.HasSuffix(err.Error(), ": exit status 1: iptables: Permission denied (you must be root).") {
+			t.Fatalf("expected the error to end with the standard error but got: %s", err)
+		}
+	})
+}
+
+// envRunner is a CommandRunner recording the binary and environment of the commands it runs.
+type envRunner struct {
+	paths []string
+	envs  [][]string
+}
+
+func (r *envRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	r.paths = append(r.paths, cmd.Path)
+	r.envs = append(r.envs, cmd.Env)
+	return nil, nil
+}
+
+func TestExecuteCommand_Env(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-init-env")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Run("It runs the commands with the environment, looking the binaries up in its PATH", func(t *testing.T) {
+		runner := &envRunner{}
+		env := []string{"PATH=" + dir, "LC_ALL=C"}
+		if err := executeCommand(FirewallConfiguration{Runner: runner, Env: env}, exec.Command("iptables", "-t", "nat", "-S")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(runner.envs, [][]string{env}) || !reflect.DeepEqual(runner.paths, []string{filepath.Join(dir, "iptables")}) {
+			t.Fatalf("unexpected binaries %v or environments %v", runner.paths, runner.envs)
+		}
+	})
+
+	t.Run("It fails when the binary isn't in the PATH of the environment", func(t *testing.T) {
+		runner := &envRunner{}
+		err := executeCommand(FirewallConfiguration{Runner: runner, Env: []string{"PATH=" + dir}}, exec.Command("ip6tables", "-t", "nat", "-S"))
+		if !errors.Is(err, exec.ErrNotFound) {
+			t.Fatalf("expected the binary not to be found but got %v", err)
+		}
+		if len(runner.paths) != 0 {
+			t.Fatalf("expected nothing to run but got %v", runner.paths)
+		}
+	})
+
+	t.Run("It inherits the environment of the process by default", func(t *testing.T) {
+		runner := &envRunner{}
+		if err := executeCommand(FirewallConfiguration{Runner: runner}, exec.Command("iptables", "-t", "nat", "-S")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if runner.envs[0] != nil {
+			t.Fatalf("expected the environment to be inherited but got %v", runner.envs[0])
+		}
+	})
+}
+
+func TestExecuteCommand_Hooks(t *testing.T) {
+	failure := errors.New("exit status 1")
+	runner := &scriptedRunner{
+		outputs: map[string]string{"iptables -t nat -N PROXY_INIT_REDIRECT -w": "iptables: Chain already exists."},
+		errors:  map[string]error{"iptables -t nat -N PROXY_INIT_REDIRECT -w": failure},
+	}
+	var before, after []string
+	var afterErr error
+	fc := FirewallConfiguration{
+		Runner: runner,
+		BeforeCommand: func(cmd *exec.Cmd) {
+			before = append(before, strings.Join(cmd.Args, " "))
+			cmd.Args = append(cmd.Args, "-w")
+		},
+		AfterCommand: func(cmd *exec.Cmd, out []byte, err error) {
+			after = append(after, strings.Join(cmd.Args, " ")+": "+string(out))
+			afterErr = err
+		},
+	}
+
+	err := executeCommand(fc, exec.Command("iptables", "-t", "nat", "-N", "PROXY_INIT_REDIRECT"))
+	if !errors.Is(err, ErrChainExists) || afterErr != err {
+		t.Fatalf("expected AfterCommand to receive the returned error but got [%v] and [%v]", afterErr, err)
+	}
+	if !reflect.DeepEqual(before, []string{"iptables -t nat -N PROXY_INIT_REDIRECT"}) {
+		t.Fatalf("unexpected commands passed to BeforeCommand: %v", before)
+	}
+	if !reflect.DeepEqual(after, []string{"iptables -t nat -N PROXY_INIT_REDIRECT -w: iptables: Chain already exists."}) {
+		t.Fatalf("unexpected commands passed to AfterCommand: %v", after)
+	}
+	if !reflect.DeepEqual(runner.commands, []string{"iptables -t nat -N PROXY_INIT_REDIRECT -w"}) {
+		t.Fatalf("expected the rewritten command to run but got %v", runner.commands)
+	}
+
+	fc.SimulateOnly = true
+	before, after = nil, nil
+	if err := executeCommand(fc, exec.Command("iptables", "-t", "nat", "-N", "PROXY_INIT_REDIRECT")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(before) != 0 || len(after) != 0 {
+		t.Fatalf("expected no hook to be called when simulating but got %v and %v", before, after)
+	}
+}
+
+func TestExecuteCommand_Nsenter(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		fc       FirewallConfiguration
+		expected string
+	}{
+		{"It runs commands in the current namespace by default", FirewallConfiguration{}, "iptables -t nat -N PROXY_INIT_REDIRECT"},
+		{"It enters the namespace by path", FirewallConfiguration{NetNs: "/var/run/netns/test"}, "nsenter --net=/var/run/netns/test iptables -t nat -N PROXY_INIT_REDIRECT"},
+		{"It enters the namespace by PID", FirewallConfiguration{NetNsPID: 42}, "nsenter --target 42 --net iptables -t nat -N PROXY_INIT_REDIRECT"},
+		{"It uses the configured nsenter binary", FirewallConfiguration{NetNsPID: 42, NsenterPath: "/usr/bin/nsenter"}, "/usr/bin/nsenter --target 42 --net iptables -t nat -N PROXY_INIT_REDIRECT"},
+		{"It keeps the wait flag", FirewallConfiguration{NetNsPID: 42, UseWaitFlag: true}, "nsenter --target 42 --net iptables -t nat -N PROXY_INIT_REDIRECT -w"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &recordingRunner{}
+			tt.fc.Runner = runner
+			if err := executeCommand(tt.fc, exec.Command("iptables", "-t", "nat", "-N", "PROXY_INIT_REDIRECT")); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(runner.commands) != 1 || runner.commands[0] != tt.expected {
+				t.Fatalf("expected command %q but got %q", tt.expected, runner.commands)
+			}
+		})
+	}
+}
+
+func TestBuildRules_RootProxyUID(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		set      bool
+		expected bool
+	}{
+		{"It ignores the traffic of root when the UID is set", true, true},
+		{"It treats a zero UID as unset otherwise", false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := BuildRules(FirewallConfiguration{
+				Mode:              RedirectAllMode,
+				ProxyInboundPort:  4143,
+				ProxyOutgoingPort: 4140,
+				ProxyUID:          0,
+				HasProxyUID:       tt.set,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			rule := "iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 0 -j RETURN -m comment --comment " + formatComment("ignore-proxy-user-id")
+			found := false
+			for _, cmd := range commands {
+				found = found || strings.Join(cmd.Args, " ") == rule
+			}
+			if found != tt.expected {
+				t.Fatalf("expected rule %q to be present: %t", rule, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildRules_ProxyUIDRange(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyUIDRange:     [2]int{2102, 2110},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102-2110 -o lo ! -d 127.0.0.1/32 -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-non-loopback-local-traffic"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102-2110 -j RETURN -m comment --comment " + formatComment("ignore-proxy-user-id"),
+	}
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "--uid-owner") {
+			found = append(found, command)
+		}
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("unexpected rules:\ngot:\n%s\nexpected:\n%s", strings.Join(found, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestBuildRules_ProxyGID(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyGID:          3000,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --gid-owner 3000 -o lo ! -d 127.0.0.1/32 -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-non-loopback-local-group-traffic"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --gid-owner 3000 -j RETURN -m comment --comment " + formatComment("ignore-proxy-group-id"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i+5].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i+5, expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_LoopbackInterface(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyUID:          2102,
+		LoopbackInterface: "lo0",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -o lo0 ! -d 127.0.0.1/32 -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-non-loopback-local-traffic"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -j RETURN -m comment --comment " + formatComment("ignore-proxy-user-id"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -o lo0 -j RETURN -m comment --comment " + formatComment("ignore-loopback"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i+5].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i+5, expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_ChainNames(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyUID:          2102,
+		RedirectChainName: "MESH_A_REDIRECT",
+		OutputChainName:   "MESH_A_OUTPUT",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, cmd := range commands {
+		command := strings.Join(cmd.Args, " ")
+		if strings.Contains(command, "PROXY_INIT_") {
+			t.Fatalf("expected only the configured chain names to be used but got\n%s", command)
+		}
+	}
+	expected := "iptables -t nat -A MESH_A_OUTPUT -m owner --uid-owner 2102 -o lo ! -d 127.0.0.1/32 -j MESH_A_REDIRECT -m comment --comment " + formatComment("redirect-non-loopback-local-traffic")
+	if command := strings.Join(commands[5].Args, " "); command != expected {
+		t.Fatalf("expected command to be\n%s\nbut got\n%s", expected, command)
+	}
+}
+
+func TestBuildRules_OutboundListedMode(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                    RedirectAllMode,
+		OutboundMode:            RedirectListedMode,
+		PortsToRedirectOutbound: []int{443, 80, 443},
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -o lo -j RETURN -m comment --comment " + formatComment("ignore-loopback"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --destination-port 80 -j REDIRECT --to-port 4140 -m comment --comment " + formatComment("redirect-outgoing-port-80-to-proxy-port"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --destination-port 443 -j REDIRECT --to-port 4140 -m comment --comment " + formatComment("redirect-outgoing-port-443-to-proxy-port"),
+		"iptables -t nat -A OUTPUT -j PROXY_INIT_OUTPUT -m comment --comment " + formatComment("install-proxy-init-output"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i+5].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i+5, expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_InboundPortTargets(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080, 9090},
+		InboundPortTargets:     map[int]int{9090: 4144},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4143,4140,4144 -j RETURN -m comment --comment " + formatComment("ignore-proxy-ports"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 8080 -j REDIRECT --to-port 4143 -m comment --comment " + formatComment("redirect-port-8080-to-proxy-port"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 9090 -j REDIRECT --to-port 4144 -m comment --comment " + formatComment("redirect-port-9090-to-proxy-port"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i+1].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i+1, expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_ManyProxyPorts(t *testing.T) {
+	redirected, targets := make([]int, 0), make(map[int]int)
+	for port := 8001; port <= 8014; port++ {
+		redirected = append(redirected, port)
+		targets[port] = port + 1000
+	}
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: redirected,
+		InboundPortTargets:     targets,
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ignored := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "ignore-proxy-ports") {
+			ignored = append(ignored, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4143,4140,9001,9002,9003,9004,9005,9006,9007,9008,9009,9010,9011,9012,9013 -j RETURN -m comment --comment " + formatComment("ignore-proxy-ports"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 9014 -j RETURN -m comment --comment " + formatComment("ignore-proxy-ports"),
+	}
+	if !reflect.DeepEqual(ignored, expected) {
+		t.Fatalf("expected the proxy's ports to be ignored within the multiport limit\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(ignored, "\n"))
+	}
+}
+
+func TestBuildRules_OutboundPortTargets(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                    RedirectAllMode,
+		OutboundMode:            RedirectListedMode,
+		PortsToRedirectOutbound: []int{443, 8080},
+		OutboundPortTargets:     map[int]int{443: 4145},
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --destination-port 443 -j REDIRECT --to-port 4145 -m comment --comment " + formatComment("redirect-outgoing-port-443-to-proxy-port"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --destination-port 8080 -j REDIRECT --to-port 4140 -m comment --comment " + formatComment("redirect-outgoing-port-8080-to-proxy-port"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[len(commands)-3+i].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command\n%s\nbut got\n%s", expectedCommand, command)
+		}
+	}
+
+	ignoreProxyPorts := "iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4143,4140,4145 -j RETURN -m comment --comment " + formatComment("ignore-proxy-ports")
+	if command := strings.Join(commands[1].Args, " "); command != ignoreProxyPorts {
+		t.Fatalf("expected command\n%s\nbut got\n%s", ignoreProxyPorts, command)
+	}
+}
+
+func TestBuildRules_FwMark(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                    RedirectAllMode,
+		OutboundMode:            RedirectListedMode,
+		PortsToRedirectOutbound: []int{80},
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+		FwMark:                  0x100,
+		FwMarkMask:              0xff00,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --destination-port 80 -j MARK --set-xmark 0x100/0xff00 -m comment --comment " + formatComment("mark-outgoing-port-80"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --destination-port 80 -j REDIRECT --to-port 4140 -m comment --comment " + formatComment("redirect-outgoing-port-80-to-proxy-port"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[len(commands)-3+i].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command\n%s\nbut got\n%s", expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_DisableComments(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		DisableComments:   true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, cmd := range commands {
+		if line := strings.Join(cmd.Args, " "); strings.Contains(line, "comment") {
+			t.Fatalf("expected no comment but got %s", line)
+		}
+	}
+	expected := "iptables -t nat -A OUTPUT -j PROXY_INIT_OUTPUT"
+	if last := strings.Join(commands[len(commands)-1].Args, " "); last != expected {
+		t.Fatalf("expected command\n%s\nbut got\n%s", expected, last)
+	}
+}
+
+func TestBuildRules_CommentPrefix(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		CommentPrefix:     "my-mesh",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "iptables -t nat -A OUTPUT -j PROXY_INIT_OUTPUT -m comment --comment my-mesh/install-proxy-init-output/" + ExecutionTraceID
+	if last := strings.Join(commands[len(commands)-1].Args, " "); last != expected {
+		t.Fatalf("expected command\n%s\nbut got\n%s", expected, last)
+	}
+}
+
+func TestBuildRules_LoopbackCIDRs(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyUID:          2102,
+		IPFamily:          DualStackFamily,
+		LoopbackCIDRs:     []string{"127.0.0.0/8"},
+		DisableComments:   true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	loops := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "-o lo ! -d") {
+			loops = append(loops, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -o lo ! -d 127.0.0.0/8 -j PROXY_INIT_REDIRECT",
+		"ip6tables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -o lo ! -d ::1/128 -j PROXY_INIT_REDIRECT",
+	}
+	if !reflect.DeepEqual(loops, expected) {
+		t.Fatalf("expected loop rules\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(loops, "\n"))
+	}
+}
+
+func TestBuildRules_ScopeJumpsToProtocols(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                  RedirectAllMode,
+		ProxyInboundPort:      4143,
+		ProxyOutgoingPort:     4140,
+		RedirectUDP:           true,
+		ScopeJumpsToProtocols: true,
+		JumpPosition:          1,
+		DisableComments:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	jumps := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, " PREROUTING ") || strings.Contains(command, " OUTPUT ") {
+			jumps = append(jumps, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -I PREROUTING 1 -p tcp -j PROXY_INIT_REDIRECT",
+		"iptables -t nat -I PREROUTING 1 -p udp -j PROXY_INIT_REDIRECT",
+		"iptables -t nat -I OUTPUT 1 -p tcp -j PROXY_INIT_OUTPUT",
+		"iptables -t nat -I OUTPUT 1 -p udp -j PROXY_INIT_OUTPUT",
+	}
+	if !reflect.DeepEqual(jumps, expected) {
+		t.Fatalf("expected jumps\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(jumps, "\n"))
+	}
+}
+
+func TestBuildRules_TraceID(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		SkipOutbound:      true,
+		CommentLabel:      "web",
+		TraceID:           "golden",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -N PROXY_INIT_REDIRECT -m comment --comment proxy-init/redirect-common-chain/web/golden",
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4143,4140 -j RETURN -m comment --comment proxy-init/ignore-proxy-ports/web/golden",
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp -j REDIRECT --to-port 4143 -m comment --comment proxy-init/redirect-all-incoming-to-proxy-port/web/golden",
+		"iptables -t nat -A PREROUTING -j PROXY_INIT_REDIRECT -m comment --comment proxy-init/install-proxy-init-prerouting/web/golden",
+	}
+	actual := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		actual = append(actual, strings.Join(cmd.Args, " "))
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected commands\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestBuildRules_CommentLabel(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		CommentPrefix:     "my-mesh",
+		CommentLabel:      "default/web-7d4b9",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "iptables -t nat -A OUTPUT -j PROXY_INIT_OUTPUT -m comment --comment my-mesh/install-proxy-init-output/default/web-7d4b9/" + ExecutionTraceID
+	if last := strings.Join(commands[len(commands)-1].Args, " "); last != expected {
+		t.Fatalf("expected command\n%s\nbut got\n%s", expected, last)
+	}
+	for _, cmd := range commands {
+		if rule, ok := addedRule("iptables", cmd); ok && rule.TraceID() != ExecutionTraceID {
+			t.Fatalf("expected the trace ID to end the comment of %s", strings.Join(cmd.Args, " "))
+		}
+	}
+}
+
+func TestBuildRules_NatTable(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyUID:          2102,
+		FwMark:            1,
+		NatTable:          "sandbox",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, cmd := range commands {
+		if cmd.Args[1] != "-t" || cmd.Args[2] != "sandbox" {
+			t.Fatalf("expected every rule in table sandbox but got %s", strings.Join(cmd.Args, " "))
+		}
+	}
+}
+
+func TestBuildRules_LogRedirects(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		LogRedirects:           true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 8080 -m conntrack --ctstate NEW -j LOG --log-prefix " + logPrefix(FirewallConfiguration{}) + " -m comment --comment " + formatComment("log-redirect-port-8080-to-proxy-port"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --destination-port 8080 -j REDIRECT --to-port 4143 -m comment --comment " + formatComment("redirect-port-8080-to-proxy-port"),
+	}
+	for i, expectedCommand := range expected {
+		if command := strings.Join(commands[i+2].Args, " "); command != expectedCommand {
+			t.Fatalf("expected command %d to be\n%s\nbut got\n%s", i+2, expectedCommand, command)
+		}
+	}
+}
+
+func TestBuildRules_LogPackets(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		LogPackets:        true,
+		LogRateLimit:      "10/second",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -m limit --limit 10/second -j LOG --log-prefix proxy-init/in:  -m comment --comment " + formatComment("log-incoming"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -m limit --limit 10/second -j LOG --log-prefix proxy-init/in-redirect:  -m comment --comment " + formatComment("log-incoming-to-redirect"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m limit --limit 10/second -j LOG --log-prefix proxy-init/out:  -m comment --comment " + formatComment("log-outgoing"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m limit --limit 10/second -j LOG --log-prefix proxy-init/out-redirect:  -m comment --comment " + formatComment("log-outgoing-to-redirect"),
+	}
+	logged := make([]string, 0)
+	for _, cmd := range commands {
+		if line := strings.Join(cmd.Args, " "); strings.Contains(line, "-j LOG") {
+			logged = append(logged, line)
+		}
+	}
+	if !reflect.DeepEqual(logged, expected) {
+		t.Fatalf("expected log rules\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(logged, "\n"))
+	}
+	if strings.Join(commands[1].Args, " ") != expected[0] {
+		t.Fatalf("expected the incoming packets to be logged first but got %s", strings.Join(commands[1].Args, " "))
+	}
+}
+
+func TestBuildRules_IgnoreEstablished(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		IgnoreEstablished: true,
+		SkipInbound:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "iptables -t nat -A PROXY_INIT_OUTPUT -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN -m comment --comment " + formatComment("ignore-established")
+	if command := strings.Join(commands[1].Args, " "); command != expected {
+		t.Fatalf("expected the first rule of the output chain to be\n%s\nbut got\n%s", expected, command)
+	}
+}
+
+func TestBuildRules_RewriteSource(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		fc       FirewallConfiguration
+		expected []string
+	}{
+		{
+			name: "It masquerades the redirected traffic",
+			fc:   FirewallConfiguration{Masquerade: true},
+			expected: []string{
+				"iptables -t nat -N PROXY_INIT_POSTROUTING -m comment --comment " + formatComment("redirect-common-chain"),
+				"iptables -t nat -A PROXY_INIT_POSTROUTING -m conntrack --ctstate DNAT -j MASQUERADE -m comment --comment " + formatComment("rewrite-redirected-source"),
+				"iptables -t nat -A POSTROUTING -j PROXY_INIT_POSTROUTING -m comment --comment " + formatComment("install-proxy-init-postrouting"),
+			},
+		},
+		{
+			name: "It rewrites the source of the redirected traffic of the family of the address",
+			fc:   FirewallConfiguration{SNATAddress: "fd00::1", IPFamily: DualStackFamily},
+			expected: []string{
+				"ip6tables -t nat -N PROXY_INIT_POSTROUTING -m comment --comment " + formatComment("redirect-common-chain"),
+				"ip6tables -t nat -A PROXY_INIT_POSTROUTING -m conntrack --ctstate DNAT -j SNAT --to-source fd00::1 -m comment --comment " + formatComment("rewrite-redirected-source"),
+				"ip6tables -t nat -A POSTROUTING -j PROXY_INIT_POSTROUTING -m comment --comment " + formatComment("install-proxy-init-postrouting"),
+			},
+		},
+		{
+			name:     "It leaves the source alone by default",
+			fc:       FirewallConfiguration{},
+			expected: []string{},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := tt.fc
+			fc.Mode = RedirectAllMode
+			fc.ProxyInboundPort = 4143
+			fc.ProxyOutgoingPort = 4140
+			commands, err := BuildRules(fc)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			found := make([]string, 0)
+			for _, cmd := range commands {
+				if command := strings.Join(cmd.Args, " "); strings.Contains(command, "POSTROUTING") {
+					found = append(found, command)
+				}
+			}
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Fatalf("unexpected rules:\ngot:\n%s\nexpected:\n%s", strings.Join(found, "\n"), strings.Join(tt.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestBuildRules_UseDNAT(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		IPFamily:          DualStackFamily,
+		UseDNAT:           true,
+		DNATAddress:       "127.0.0.2",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp -j DNAT --to-destination 127.0.0.2:4143 -m comment --comment " + formatComment("redirect-all-incoming-to-proxy-port"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp -j DNAT --to-destination 127.0.0.2:4140 -m comment --comment " + formatComment("redirect-all-outgoing-to-proxy-port"),
+		"ip6tables -t nat -A PROXY_INIT_REDIRECT -p tcp -j DNAT --to-destination [::1]:4143 -m comment --comment " + formatComment("redirect-all-incoming-to-proxy-port"),
+		"ip6tables -t nat -A PROXY_INIT_OUTPUT -p tcp -j DNAT --to-destination [::1]:4140 -m comment --comment " + formatComment("redirect-all-outgoing-to-proxy-port"),
+	}
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "-j DNAT") || strings.Contains(command, "-j REDIRECT") {
+			found = append(found, command)
+		}
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("unexpected redirects:\ngot:\n%s\nexpected:\n%s", strings.Join(found, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestBuildRules_SkipSpecialRanges(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		IPFamily:          DualStackFamily,
+		SkipSpecialRanges: true,
+		SkipInbound:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -d 169.254.0.0/16 -j RETURN -m comment --comment " + formatComment("ignore-special-range-169.254.0.0/16"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -d 224.0.0.0/4 -j RETURN -m comment --comment " + formatComment("ignore-special-range-224.0.0.0/4"),
+		"ip6tables -t nat -A PROXY_INIT_OUTPUT -d fe80::/10 -j RETURN -m comment --comment " + formatComment("ignore-special-range-fe80::/10"),
+		"ip6tables -t nat -A PROXY_INIT_OUTPUT -d ff00::/8 -j RETURN -m comment --comment " + formatComment("ignore-special-range-ff00::/8"),
+	}
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "ignore-special-range") {
+			found = append(found, command)
+		}
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("unexpected rules:\ngot:\n%s\nexpected:\n%s", strings.Join(found, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestBuildRules_IgnoreICMP(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		IPFamily:          DualStackFamily,
+		IgnoreICMP:        true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the ICMP rules come right after the creation of each chain
+	expected := map[string]string{
+		"iptables -t nat -N PROXY_INIT_REDIRECT":  "iptables -t nat -A PROXY_INIT_REDIRECT -p icmp -j RETURN -m comment --comment " + formatComment("ignore-icmp"),
+		"iptables -t nat -N PROXY_INIT_OUTPUT":    "iptables -t nat -A PROXY_INIT_OUTPUT -p icmp -j RETURN -m comment --comment " + formatComment("ignore-icmp"),
+		"ip6tables -t nat -N PROXY_INIT_REDIRECT": "ip6tables -t nat -A PROXY_INIT_REDIRECT -p ipv6-icmp -j RETURN -m comment --comment " + formatComment("ignore-icmp"),
+		"ip6tables -t nat -N PROXY_INIT_OUTPUT":   "ip6tables -t nat -A PROXY_INIT_OUTPUT -p ipv6-icmp -j RETURN -m comment --comment " + formatComment("ignore-icmp"),
+	}
+	found := 0
+	for i, cmd := range commands[:len(commands)-1] {
+		creation := strings.Join(cmd.Args[:5], " ")
+		if rule, ok := expected[creation]; ok {
+			found++
+			if next := strings.Join(commands[i+1].Args, " "); next != rule {
+				t.Fatalf("expected\n%s\nafter\n%s\nbut got\n%s", rule, creation, next)
+			}
+		}
+	}
+	if found != len(expected) {
+		t.Fatalf("expected %d chains to be created but found %d", len(expected), found)
+	}
+}
+
+func TestBuildRules_IgnoreDNAT(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		IgnoreDNAT:        true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -N PROXY_INIT_REDIRECT -m comment --comment " + formatComment("redirect-common-chain"),
+		"iptables -t nat -A PROXY_INIT_REDIRECT -m conntrack --ctstate DNAT -j RETURN -m comment --comment " + formatComment("ignore-dnat"),
+	}
+	actual := []string{strings.Join(commands[0].Args, " "), strings.Join(commands[1].Args, " ")}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+	for _, cmd := range commands[2:] {
+		if strings.Contains(strings.Join(cmd.Args, " "), "DNAT") {
+			t.Fatalf("expected the translated destinations to only be ignored by the redirect chain, got %s", strings.Join(cmd.Args, " "))
+		}
+	}
+}
+
+func TestBuildRules_RedirectNewOnly(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		RedirectNewOnly:   true,
+		DisableComments:   true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "--ctstate") {
+			found = append(found, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -m conntrack ! --ctstate NEW -j RETURN",
+		"iptables -t nat -A PROXY_INIT_OUTPUT -m conntrack ! --ctstate NEW -j RETURN",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+	if second := strings.Join(commands[1].Args, " "); second != expected[0] {
+		t.Fatalf("expected the packets of existing flows to be ignored before anything else but got %s", second)
+	}
+}
+
+func TestBuildRules_InboundInterface(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		InboundInterface:  "eth1",
+		DisableComments:   true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, " -j PROXY_INIT_") {
+			found = append(found, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PREROUTING -i eth1 -j PROXY_INIT_REDIRECT",
+		"iptables -t nat -A OUTPUT -j PROXY_INIT_OUTPUT",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+}
+
+func TestBuildRules_OutboundInterface(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                  RedirectAllMode,
+		ProxyInboundPort:      4143,
+		ProxyOutgoingPort:     4140,
+		OutboundInterface:     "eth1",
+		ScopeJumpsToProtocols: true,
+		RedirectUDP:           true,
+		DisableComments:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, " -j PROXY_INIT_OUTPUT") {
+			found = append(found, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A OUTPUT -o eth1 -p tcp -j PROXY_INIT_OUTPUT",
+		"iptables -t nat -A OUTPUT -o eth1 -p udp -j PROXY_INIT_OUTPUT",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+}
+
+func TestBuildRules_IgnoreTarget(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                  RedirectAllMode,
+		ProxyInboundPort:      4143,
+		ProxyOutgoingPort:     4140,
+		InboundPortsToIgnore:  []string{"4190"},
+		OutboundCIDRsToIgnore: []string{"10.0.0.0/8"},
+		IgnoreTarget:          "AUDIT_IGNORED",
+		DisableComments:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "-j AUDIT_IGNORED") {
+			found = append(found, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 4190 -j AUDIT_IGNORED",
+		"iptables -t nat -A PROXY_INIT_OUTPUT -d 10.0.0.0/8 -j AUDIT_IGNORED",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "4143,4140") && !strings.Contains(command, "-j RETURN") {
+			t.Fatalf("expected the proxy's own ports to still be returned but got %s", command)
+		}
+	}
+}
+
+func TestBuildRules_InsertIgnoredPorts(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		insert   bool
+		expected []string
+	}{
+		{
+			name: "appended after the rules for the proxy's traffic",
+			expected: []string{
+				"iptables -t nat -N PROXY_INIT_OUTPUT -m comment --comment " + formatComment("redirect-common-chain"),
+				"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -j RETURN -m comment --comment " + formatComment("ignore-proxy-user-id"),
+				"iptables -t nat -A PROXY_INIT_OUTPUT -o lo -j RETURN -m comment --comment " + formatComment("ignore-loopback"),
+				"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp --match multiport --dports 25,443 -j RETURN -m comment --comment " + formatComment("ignore-port-25,443"),
+			},
+		},
+		{
+			name:   "inserted at the top of the chain",
+			insert: true,
+			expected: []string{
+				"iptables -t nat -N PROXY_INIT_OUTPUT -m comment --comment " + formatComment("redirect-common-chain"),
+				"iptables -t nat -I PROXY_INIT_OUTPUT 1 -p tcp --match multiport --dports 25,443 -j RETURN -m comment --comment " + formatComment("ignore-port-25,443"),
+				"iptables -t nat -A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -j RETURN -m comment --comment " + formatComment("ignore-proxy-user-id"),
+				"iptables -t nat -A PROXY_INIT_OUTPUT -o lo -j RETURN -m comment --comment " + formatComment("ignore-loopback"),
+			},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := BuildRules(FirewallConfiguration{
+				Mode:                  RedirectAllMode,
+				ProxyInboundPort:      4143,
+				ProxyOutgoingPort:     4140,
+				ProxyUID:              2102,
+				SkipInbound:           true,
+				OutboundPortsToIgnore: []string{"443", "25"},
+				InsertIgnoredPorts:    tt.insert,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var actual []string
+			for _, cmd := range commands {
+				line := strings.Join(cmd.Args, " ")
+				if strings.Contains(line, "-N PROXY_INIT_OUTPUT") || strings.Contains(line, "ignore-proxy-user-id") || strings.Contains(line, "ignore-loopback") || strings.Contains(line, "ignore-port-") {
+					actual = append(actual, line)
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(tt.expected, "\n"), strings.Join(actual, "\n"))
+			}
+		})
+	}
+}
+
+func TestBuildRules_NoOutgoingPort(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:             RedirectAllMode,
+		ProxyInboundPort: 4143,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, cmd := range commands {
+		line := strings.Join(cmd.Args, " ")
+		if strings.Contains(line, ProxyInitOutputChainName) || strings.Contains(line, "--to-port 0") {
+			t.Fatalf("expected the outgoing traffic to be left alone but got %s", line)
+		}
+	}
+	if len(commands) == 0 {
+		t.Fatalf("expected the inbound rules to be built")
+	}
+}
+
+func TestBuildRules_ProbePorts(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProbePorts:             []int{9090, 8081, 9090},
+		SkipOutbound:           true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	probes, redirect := -1, -1
+	for i, cmd := range commands {
+		line := strings.Join(cmd.Args, " ")
+		if strings.Contains(line, "ignore-probe-ports") {
+			expected := "iptables -t nat -A PROXY_INIT_REDIRECT -p tcp --match multiport --dports 8081,9090 -j RETURN -m comment --comment " + formatComment("ignore-probe-ports-8081,9090")
+			if line != expected {
+				t.Fatalf("expected\n%s\nbut got\n%s", expected, line)
+			}
+			probes = i
+		}
+		if strings.Contains(line, "REDIRECT --to-port") && redirect < 0 {
+			redirect = i
+		}
+	}
+	if probes < 0 || redirect < 0 || probes > redirect {
+		t.Fatalf("expected the probe ports to be ignored ahead of the redirects, got indices %d and %d", probes, redirect)
+	}
+}
+
+func TestBuildRules_NoTrackPorts(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		NoTrackPorts:      []int{9000, 8000, 9000},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t raw -N PROXY_INIT_NOTRACK -m comment --comment " + formatComment("notrack-chain"),
+		"iptables -t raw -A PROXY_INIT_NOTRACK -p tcp --dport 8000 -j NOTRACK -m comment --comment " + formatComment("notrack-port-8000"),
+		"iptables -t raw -A PROXY_INIT_NOTRACK -p tcp --sport 8000 -j NOTRACK -m comment --comment " + formatComment("notrack-port-8000-replies"),
+		"iptables -t raw -A PROXY_INIT_NOTRACK -p tcp --dport 9000 -j NOTRACK -m comment --comment " + formatComment("notrack-port-9000"),
+		"iptables -t raw -A PROXY_INIT_NOTRACK -p tcp --sport 9000 -j NOTRACK -m comment --comment " + formatComment("notrack-port-9000-replies"),
+		"iptables -t raw -A PREROUTING -j PROXY_INIT_NOTRACK -m comment --comment " + formatComment("install-proxy-init-notrack-prerouting"),
+		"iptables -t raw -A OUTPUT -j PROXY_INIT_NOTRACK -m comment --comment " + formatComment("install-proxy-init-notrack-output"),
+	}
+	var actual []string
+	for _, cmd := range commands {
+		if line := strings.Join(cmd.Args, " "); strings.Contains(line, "-t raw") {
+			actual = append(actual, line)
+		}
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+
+	if _, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		NoTrackPorts:      []int{70000},
+	}); err == nil || !strings.Contains(err.Error(), "invalid port not to track [70000]") {
+		t.Fatalf("expected an invalid port error but got %v", err)
+	}
+}
+
+func TestLogPrefix(t *testing.T) {
+	defer func(traceID string) { ExecutionTraceID = traceID }(ExecutionTraceID)
+	ExecutionTraceID = "1792110052978683261-1bce407c"
+
+	for _, tt := range []struct {
+		prefix   string
+		expected string
+	}{
+		{"", "proxy-init/8683261-1bce407c: "},
+		{"mesh", "mesh/0052978683261-1bce407c: "},
+		{"a-very-long-comment-prefix-for-a-fork", "a-very-long-comment-prefix-: "},
+	} {
+		prefix := logPrefix(FirewallConfiguration{CommentPrefix: tt.prefix})
+		if prefix != tt.expected {
+			t.Fatalf("expected log prefix %q but got %q", tt.expected, prefix)
+		}
+		if len(prefix) > maxLogPrefixLength {
+			t.Fatalf("expected log prefix %q to be at most %d characters long", prefix, maxLogPrefixLength)
+		}
+	}
+}
+
+func TestProxyPorts(t *testing.T) {
+	for _, tt := range []struct {
+		inbound, outgoing, admin int
+		expected                 []int
+	}{
+		{4143, 4140, 0, []int{4143, 4140}},
+		{4143, 4140, 4191, []int{4143, 4140, 4191}},
+		{8080, 8080, 0, []int{8080}},
+	} {
+		proxyPorts := proxyPorts(FirewallConfiguration{ProxyInboundPort: tt.inbound, ProxyOutgoingPort: tt.outgoing, ProxyAdminPort: tt.admin})
+		if !reflect.DeepEqual(proxyPorts, tt.expected) {
+			t.Fatalf("expected proxy ports %v but got %v", tt.expected, proxyPorts)
+		}
+	}
+}
+
+func TestBuildRules_WarnsAboutIgnoredPortOverlaps(t *testing.T) {
+	var output bytes.Buffer
+	_, err := BuildRules(FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080, 9090},
+		InboundPortsToIgnore:   []string{"8000-8100"},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		Output:                 &output,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !strings.Contains(output.String(), "both redirected and ignored will be ignored redirected=8080 ignored=8000-8100") {
+		t.Fatalf("expected a warning about port 8080 but got:\n%s", output.String())
+	}
+	if strings.Contains(output.String(), "redirected=9090") {
+		t.Fatalf("expected no warning about port 9090 but got:\n%s", output.String())
+	}
+}
+
+func TestBuildRules_JumpPosition(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		JumpPosition:      1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables -t nat -I PREROUTING 1 -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("install-proxy-init-prerouting"),
+		"iptables -t nat -I OUTPUT 1 -j PROXY_INIT_OUTPUT -m comment --comment " + formatComment("install-proxy-init-output"),
+	}
+	jumps := []string{strings.Join(commands[3].Args, " "), strings.Join(commands[len(commands)-1].Args, " ")}
+	if !reflect.DeepEqual(jumps, expected) {
+		t.Fatalf("expected jumps\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(jumps, "\n"))
+	}
+}
+
+func TestBuildRules_SkipDirection(t *testing.T) {
+	t.Run("It only configures outgoing traffic when skipping inbound", func(t *testing.T) {
+		commands, err := BuildRules(FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			ProxyUID:          2102,
+			SkipInbound:       true,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for _, cmd := range commands {
+			if line := strings.Join(cmd.Args, " "); strings.Contains(line, "PROXY_INIT_REDIRECT") || strings.Contains(line, "PREROUTING") {
+				t.Fatalf("expected no inbound rule but got %s", line)
+			}
+		}
+		if last := strings.Join(commands[len(commands)-1].Args, " "); !strings.Contains(last, "-A OUTPUT -j PROXY_INIT_OUTPUT") {
+			t.Fatalf("expected the jump to the output chain but got %s", last)
+		}
+	})
+
+	t.Run("It only configures incoming traffic when skipping outbound", func(t *testing.T) {
+		commands, err := BuildRules(FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			SkipOutbound:      true,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for _, cmd := range commands {
+			if line := strings.Join(cmd.Args, " "); strings.Contains(line, "PROXY_INIT_OUTPUT") {
+				t.Fatalf("expected no outbound rule but got %s", line)
+			}
+		}
+		if last := strings.Join(commands[len(commands)-1].Args, " "); !strings.Contains(last, "-A PREROUTING -j PROXY_INIT_REDIRECT") {
+			t.Fatalf("expected the jump to the redirect chain but got %s", last)
+		}
+	})
+}
+
+func TestIsMissingObject(t *testing.T) {
+	for _, tt := range []struct {
+		output   string
+		expected bool
+	}{
+		{"iptables: No chain/target/match by that name.", true},
+		{"iptables: Chain 'PROXY_INIT_OUTPUT' does not exist", true},
+		{"RTNETLINK answers: No such file or directory", true},
+		{"iptables v1.8.4 (legacy): can't initialize iptables table `nat': Permission denied (you must be root)", false},
+		{"Another app is currently holding the xtables lock. Perhaps you want to use the -w option?", false},
+		{"nsenter: cannot open /var/run/netns/test: No such file or directory", false},
+	} {
+		err := fmt.Errorf("command %q failed: %w: %s", []string{"iptables"}, errors.New("exit status 1"), tt.output)
+		if missing := isMissingObject(err); missing != tt.expected {
+			t.Fatalf("expected %t for output %q but got %t", tt.expected, tt.output, missing)
+		}
+	}
+}
+
+func TestConfigureFirewall_SkipStateDump(t *testing.T) {
+	runner := &recordingRunner{}
+	err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		SkipStateDump:     true,
+		Runner:            runner,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, command := range runner.commands {
+		if strings.HasSuffix(command, "-vnL") {
+			t.Fatalf("expected the rules not to be listed but got %s", command)
+		}
+	}
+}
+
+func TestConfigureFirewall_PreserveForeignChains(t *testing.T) {
+	runner := &scriptedRunner{
+		outputs: map[string]string{
+			"iptables -t nat -S PREROUTING": `-P PREROUTING ACCEPT
+-A PREROUTING -j NODE_AGENT_PREROUTING
+-A PREROUTING -j PROXY_INIT_REDIRECT
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+`,
+			"iptables -t nat -S OUTPUT": `-P OUTPUT ACCEPT
+-A OUTPUT -j NODE_AGENT_OUTPUT
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output/1234" -j PROXY_INIT_OUTPUT
+`,
+		},
+	}
+	firewallConfiguration := FirewallConfiguration{
+		Mode:                  RedirectAllMode,
+		ProxyInboundPort:      4143,
+		ProxyOutgoingPort:     4140,
+		PreserveForeignChains: true,
+		Runner:                runner,
+	}
+	if err := ConfigureFirewall(context.Background(), firewallConfiguration); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := TeardownFirewall(context.Background(), firewallConfiguration); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, command := range runner.commands {
+		args := strings.Fields(command)
+		for i := 0; i < len(args)-1; i++ {
+			switch args[i] {
+			case "-F", "-X":
+				if !strings.HasPrefix(args[i+1], ProxyInitChainPrefix) {
+					t.Fatalf("expected only the proxy-init chains to be removed but got %s", command)
+				}
+			case "-D":
+				if !strings.Contains(command, "--comment proxy-init/") {
+					t.Fatalf("expected only the jumps of proxy-init to be deleted but got %s", command)
+				}
+			}
+		}
+		if strings.Contains(command, "NODE_AGENT") {
+			t.Fatalf("expected the foreign chains to be left alone but got %s", command)
+		}
+	}
+}
+
+// installedRulesRunner is a CommandRunner listing the installed rules of the nat table in answer to iptables-save,
+// reporting the chains to create as existing.
+type installedRulesRunner struct {
+	commands  []string
+	installed []string
+}
+
+func (r *installedRulesRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	command := strings.Join(cmd.Args, " ")
+	r.commands = append(r.commands, command)
+	switch {
+	case command == "iptables-save -t nat":
+		return []byte("*nat\n" + strings.Join(r.installed, "\n") + "\nCOMMIT\n"), nil
+	case strings.Contains(command, " -N "):
+		return []byte("iptables: Chain already exists.\n"), errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestConfigureFirewall_ExistingChain(t *testing.T) {
+	runner := &scriptedRunner{
+		outputs: map[string]string{
+			"iptables -t nat -X PROXY_INIT_REDIRECT": "iptables v1.8.4 (legacy): CHAIN_DEL failed (Too many links): chain PROXY_INIT_REDIRECT\n",
+			"iptables -t nat -N PROXY_INIT_REDIRECT": "iptables: Chain already exists.\n",
+		},
+		errors: map[string]error{
+			"iptables -t nat -X PROXY_INIT_REDIRECT": errors.New("exit status 1"),
+			"iptables -t nat -N PROXY_INIT_REDIRECT": errors.New("exit status 1"),
+		},
+	}
+	err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		SkipStateDump:     true,
+		DisableComments:   true,
+		Runner:            runner,
+	})
+	if err != nil {
+		t.Fatalf("expected the existing chain to be reused but got: %s", err)
+	}
+
+	for i, command := range runner.commands {
+		if command == "iptables -t nat -N PROXY_INIT_REDIRECT" {
+			if next := runner.commands[i+1]; next != "iptables -t nat -F PROXY_INIT_REDIRECT" {
+				t.Fatalf("expected the existing chain to be flushed but got %s", next)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected the chain to be created but got %v", runner.commands)
+}
+
+func TestConfigureFirewall_SkipInstalledRules(t *testing.T) {
+	t.Run("It keeps the chains and skips the installed rules", func(t *testing.T) {
+		runner := &installedRulesRunner{installed: []string{
+			"-A OUTPUT -j PROXY_INIT_OUTPUT",
+			"-A PROXY_INIT_OUTPUT -o lo -j RETURN",
+		}}
+		err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+			Mode:               RedirectAllMode,
+			ProxyInboundPort:   4143,
+			ProxyOutgoingPort:  4140,
+			SkipInbound:        true,
+			SkipStateDump:      true,
+			DisableComments:    true,
+			SkipInstalledRules: true,
+			Runner:             runner,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		added := make([]string, 0)
+		for _, command := range runner.commands {
+			if strings.Contains(command, " -F ") || strings.Contains(command, " -X ") || strings.Contains(command, " -D ") {
+				t.Fatalf("expected the installed chains and rules to be kept but got %s", command)
+			}
+			if strings.Contains(command, " -A ") {
+				added = append(added, command)
+			}
+		}
+		expected := []string{
+			"iptables -t nat -A PROXY_INIT_OUTPUT -p tcp -j REDIRECT --to-port 4140",
+		}
+		if !reflect.DeepEqual(added, expected) {
+			t.Fatalf("expected the missing rules to be added\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(added, "\n"))
+		}
+	})
+
+	t.Run("It skips the rules of a previous run with comments", func(t *testing.T) {
+		runner := &installedRulesRunner{installed: []string{
+			`-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output/1234" -j PROXY_INIT_OUTPUT`,
+		}}
+		err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+			Mode:               RedirectAllMode,
+			ProxyInboundPort:   4143,
+			ProxyOutgoingPort:  4140,
+			SkipInbound:        true,
+			SkipStateDump:      true,
+			SkipInstalledRules: true,
+			Runner:             runner,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for _, command := range runner.commands {
+			if strings.Contains(command, " -A OUTPUT ") {
+				t.Fatalf("expected the installed jump not to be added again but got %s", command)
+			}
+		}
+	})
+}
+
+func TestRemoveExistingChains(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		StrictCleanup:     true,
+		SkipStateDump:     true,
+	}
+
+	t.Run("It deletes the jumps before deleting the chains", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{
+				"iptables -t nat -S PREROUTING": "-P PREROUTING ACCEPT\n" +
+					"-A PREROUTING -m comment --comment \"proxy-init/install-proxy-init-prerouting/1234\" -j PROXY_INIT_REDIRECT\n",
+				"iptables -t nat -S OUTPUT": "-P OUTPUT ACCEPT\n" +
+					"-A OUTPUT -m comment --comment \"proxy-init/install-proxy-init-output/1234\" -j PROXY_INIT_OUTPUT\n",
+			},
+		}
+		fc.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), fc); err != nil {
+			t.Fatalf("expected a re-run to succeed in strict mode but got: %s", err)
+		}
+
+		expected := []string{
+			"iptables -t nat -S PREROUTING",
+			"iptables -t nat -D PREROUTING -m comment --comment proxy-init/install-proxy-init-prerouting/1234 -j PROXY_INIT_REDIRECT",
+			"iptables -t nat -S OUTPUT",
+			"iptables -t nat -D OUTPUT -m comment --comment proxy-init/install-proxy-init-output/1234 -j PROXY_INIT_OUTPUT",
+			"iptables -t nat -F PROXY_INIT_REDIRECT",
+			"iptables -t nat -X PROXY_INIT_REDIRECT",
+			"iptables -t nat -F PROXY_INIT_OUTPUT",
+			"iptables -t nat -X PROXY_INIT_OUTPUT",
+		}
+		if got := runner.commands[1 : 1+len(expected)]; !reflect.DeepEqual(got, expected) {
+			t.Fatalf("unexpected cleanup commands:\ngot:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+		}
+	})
+
+	newFailingRunner := func() *scriptedRunner {
+		return &scriptedRunner{
+			outputs: map[string]string{
+				"iptables -t nat -F PROXY_INIT_REDIRECT": "iptables: No chain/target/match by that name.\n",
+				"iptables -t nat -X PROXY_INIT_REDIRECT": "iptables: No chain/target/match by that name.\n",
+				"iptables -t nat -X PROXY_INIT_OUTPUT":   "iptables v1.8.4 (legacy): can't initialize iptables table `nat': Permission denied (you must be root)\n",
+			},
+			errors: map[string]error{
+				"iptables -t nat -F PROXY_INIT_REDIRECT": errors.New("exit status 1"),
+				"iptables -t nat -X PROXY_INIT_REDIRECT": errors.New("exit status 1"),
+				"iptables -t nat -X PROXY_INIT_OUTPUT":   errors.New("exit status 3"),
+			},
+		}
+	}
+
+	t.Run("It only reports the failures not caused by missing chains", func(t *testing.T) {
+		runner := newFailingRunner()
+		fc.Runner = runner
+
+		err := removeExistingChains(fc)
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if len(err.(multiError)) != 1 || !strings.Contains(err.Error(), "Permission denied") {
+			t.Fatalf("expected a single error about the output chain but got: %s", err)
+		}
+		if len(runner.commands) != 6 {
+			t.Fatalf("expected all 6 commands to be attempted but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It carries on by default", func(t *testing.T) {
+		nonStrict := fc
+		nonStrict.StrictCleanup = false
+		nonStrict.Runner = newFailingRunner()
+		if err := ConfigureFirewall(context.Background(), nonStrict); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	})
+
+	t.Run("It aborts in strict mode", func(t *testing.T) {
+		fc.Runner = newFailingRunner()
+		err := ConfigureFirewall(context.Background(), fc)
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if !strings.Contains(err.Error(), "failed to remove the existing chains") {
+			t.Fatalf("expected a cleanup error but got: %s", err)
+		}
+	})
+}
+
+func TestConfigureFirewall_Context(t *testing.T) {
+	t.Run("It stops once the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		runner := &recordingRunner{}
+
+		err := ConfigureFirewall(ctx, FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			Runner:            runner,
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error to wrap [%s] but got [%v]", context.Canceled, err)
+		}
+		if len(runner.commands) != 0 {
+			t.Fatalf("expected no command to run but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It reports commands past the deadline as timed out", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 0)
+		defer cancel()
+
+		err := executeCommand(FirewallConfiguration{Runner: &recordingRunner{}, ctx: ctx}, exec.Command("iptables", "-t", "nat", "-vnL"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected error to wrap [%s] but got [%v]", context.DeadlineExceeded, err)
+		}
+		if !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("expected a timeout error but got [%s]", err)
+		}
+	})
+}
+
+// hangingDumpRunner lets the listings of the rules hang until they are killed.
+type hangingDumpRunner struct {
+	commands []string
+}
+
+func (r *hangingDumpRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	command := strings.Join(cmd.Args, " ")
+	r.commands = append(r.commands, command)
+	if strings.HasSuffix(command, " -vnL") {
+		time.Sleep(20 * time.Millisecond)
+		return nil, errors.New("signal: killed")
+	}
+	return nil, nil
+}
+
+func TestConfigureFirewall_StateDumpTimeout(t *testing.T) {
+	runner := &hangingDumpRunner{}
+	err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		StateDumpTimeout:  time.Millisecond,
+		Runner:            runner,
+	})
+	if err != nil {
+		t.Fatalf("expected the listings that timed out to be skipped but got: %s", err)
+	}
+
+	dumps := 0
+	for _, command := range runner.commands {
+		if strings.HasSuffix(command, " -vnL") {
+			dumps++
+		}
+	}
+	if dumps != 2 {
+		t.Fatalf("expected the rules to be listed before and after being applied but got %v", runner.commands)
+	}
+}
+
+func TestSupportsWaitFlag(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		expected bool
+	}{
+		{[]string{"iptables", "-t", "nat", "-vnL"}, true},
+		{[]string{"ip6tables-nft", "-t", "nat", "-N", "PROXY_INIT_REDIRECT"}, true},
+		{[]string{"iptables-restore", "--noflush"}, true},
+		{[]string{"iptables-save", "-t", "nat"}, false},
+		{[]string{"iptables-legacy-save"}, false},
+		{[]string{"ip", "-4", "rule", "add", "fwmark", "1", "lookup", "100"}, false},
+	} {
+		if supports := supportsWaitFlag(exec.Command(tt.args[0], tt.args[1:]...)); supports != tt.expected {
+			t.Fatalf("expected wait flag support for %v to be %t", tt.args, tt.expected)
+		}
+	}
+}
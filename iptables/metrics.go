@@ -0,0 +1,34 @@
+package iptables
+
+import (
+	"time"
+)
+
+// Metrics receives measurements of ConfigureFirewall, so that slow or failing configurations can be alerted on. It
+// is meant to be backed by a metrics library, e.g. by the Prometheus collectors `proxy_init_rules_applied_total`,
+// `proxy_init_apply_duration_seconds` and `proxy_init_apply_failures_total{section=...}`.
+type Metrics interface {
+	// RulesApplied is called with the number of rules applied for an IP family.
+	RulesApplied(count int)
+	// ApplyDuration is called with the time ConfigureFirewall or ReconcileFirewall took, whether it succeeded or not.
+	ApplyDuration(duration time.Duration)
+	// ApplyFailed is called when ConfigureFirewall or ReconcileFirewall fails, with the section that failed:
+	// `validate`, `preflight`, `build`, `check`, `snapshot`, `cleanup`, `current-state`, `adding-rules`, `verify`,
+	// `reconcile` or `rollback`.
+	ApplyFailed(section string)
+}
+
+// noopMetrics is the default Metrics, discarding the measurements.
+type noopMetrics struct{}
+
+func (noopMetrics) RulesApplied(int)            {}
+func (noopMetrics) ApplyDuration(time.Duration) {}
+func (noopMetrics) ApplyFailed(string)          {}
+
+// metrics returns the configured Metrics, falling back to discarding the measurements.
+func metrics(firewallConfiguration FirewallConfiguration) Metrics {
+	if firewallConfiguration.Metrics == nil {
+		return noopMetrics{}
+	}
+	return firewallConfiguration.Metrics
+}
@@ -0,0 +1,76 @@
+package iptables
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingMetrics is a Metrics that records the measurements it receives.
+type recordingMetrics struct {
+	rulesApplied int
+	durations    []time.Duration
+	failures     []string
+}
+
+func (m *recordingMetrics) RulesApplied(count int) {
+	m.rulesApplied += count
+}
+
+func (m *recordingMetrics) ApplyDuration(duration time.Duration) {
+	m.durations = append(m.durations, duration)
+}
+
+func (m *recordingMetrics) ApplyFailed(section string) {
+	m.failures = append(m.failures, section)
+}
+
+func TestConfigureFirewall_Metrics(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		IPFamily:          DualStackFamily,
+	}
+
+	t.Run("It records the rules applied", func(t *testing.T) {
+		m := &recordingMetrics{}
+		fc.Metrics = m
+		fc.Runner = &recordingRunner{}
+
+		if err := ConfigureFirewall(context.Background(), fc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if m.rulesApplied != 16 {
+			t.Fatalf("expected 16 rules to be applied but got %d", m.rulesApplied)
+		}
+		if len(m.durations) != 1 {
+			t.Fatalf("expected a single duration but got %v", m.durations)
+		}
+		if len(m.failures) != 0 {
+			t.Fatalf("expected no failures but got %v", m.failures)
+		}
+	})
+
+	t.Run("It records the section that failed", func(t *testing.T) {
+		m := &recordingMetrics{}
+		fc.Metrics = m
+		fc.Runner = &scriptedRunner{
+			errors: map[string]error{"iptables -t nat -vnL": errors.New("exit status 1")},
+		}
+
+		if err := ConfigureFirewall(context.Background(), fc); err == nil {
+			t.Fatal("expected error but got nil")
+		}
+
+		if !reflect.DeepEqual(m.failures, []string{"current-state"}) {
+			t.Fatalf("expected a current-state failure but got %v", m.failures)
+		}
+		if len(m.durations) != 1 {
+			t.Fatalf("expected a single duration but got %v", m.durations)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+)
+
+// interfaceAddrs lists the addresses of the interfaces of the network namespace proxy-init runs in.
+var interfaceAddrs = net.InterfaceAddrs
+
+// nodeAddresses returns the addresses of the node to ignore: the configured NodeAddresses or, when none are
+// configured, the addresses of the interfaces of the host, as seen when running in its network namespace.
+func nodeAddresses(firewallConfiguration FirewallConfiguration) ([]string, error) {
+	if len(firewallConfiguration.NodeAddresses) > 0 {
+		return firewallConfiguration.NodeAddresses, nil
+	}
+	if !runsInHostNamespace(firewallConfiguration) {
+		return nil, fmt.Errorf("could not read the node addresses: the interfaces of the pod's network namespace don't hold them, configure NodeAddresses")
+	}
+
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the node addresses: %w", err)
+	}
+	addresses := parseInterfaceAddresses(addrs)
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("could not read the node addresses: no address found on the interfaces")
+	}
+	return addresses, nil
+}
+
+// runsInHostNamespace checks whether proxy-init runs outside of the network namespace it configures, entering it with
+// nsenter, as done from the host network namespace, e.g. as a CNI plugin.
+func runsInHostNamespace(firewallConfiguration FirewallConfiguration) bool {
+	return firewallConfiguration.NetNs != "" || firewallConfiguration.NetNsPID > 0
+}
+
+// parseInterfaceAddresses returns the addresses of the interfaces, without duplicates. Loopback addresses are
+// already ignored and link-local ones can't be matched without their zone, so both are skipped.
+func parseInterfaceAddresses(addrs []net.Addr) []string {
+	addresses := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		}
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		addresses = append(addresses, ip.String())
+	}
+	return addresses
+}
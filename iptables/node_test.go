@@ -0,0 +1,109 @@
+package iptables
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInterfaceAddresses(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("192.168.1.5"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPAddr{IP: net.ParseIP("fd00::5")},
+		&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)},
+	}
+
+	addresses := parseInterfaceAddresses(addrs)
+	expected := []string{"10.0.0.5", "192.168.1.5", "fd00::5"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("expected addresses %v but got %v", expected, addresses)
+	}
+}
+
+func TestNodeAddresses(t *testing.T) {
+	defer func(f func() ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+
+	t.Run("It fails when the interfaces can't be listed", func(t *testing.T) {
+		interfaceAddrs = func() ([]net.Addr, error) { return nil, errors.New("no interfaces") }
+		if _, err := nodeAddresses(FirewallConfiguration{NetNs: "/var/run/netns/pod"}); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("It fails without any address besides loopback", func(t *testing.T) {
+		interfaceAddrs = func() ([]net.Addr, error) {
+			return []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)}}, nil
+		}
+		if _, err := nodeAddresses(FirewallConfiguration{NetNs: "/var/run/netns/pod"}); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("It reads the addresses of the interfaces", func(t *testing.T) {
+		interfaceAddrs = func() ([]net.Addr, error) {
+			return []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)}}, nil
+		}
+		addresses, err := nodeAddresses(FirewallConfiguration{NetNs: "/var/run/netns/pod"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(addresses, []string{"10.0.0.5"}) {
+			t.Fatalf("expected the address of the interface but got %v", addresses)
+		}
+	})
+
+	t.Run("It doesn't read the interfaces of the pod's network namespace", func(t *testing.T) {
+		interfaceAddrs = func() ([]net.Addr, error) {
+			return []net.Addr{&net.IPNet{IP: net.ParseIP("10.244.0.7"), Mask: net.CIDRMask(24, 32)}}, nil
+		}
+		if _, err := nodeAddresses(FirewallConfiguration{}); err == nil || !strings.Contains(err.Error(), "configure NodeAddresses") {
+			t.Fatalf("expected an error asking for the node addresses but got %v", err)
+		}
+	})
+
+	t.Run("It prefers the configured addresses", func(t *testing.T) {
+		addresses, err := nodeAddresses(FirewallConfiguration{NodeAddresses: []string{"10.0.0.6"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(addresses, []string{"10.0.0.6"}) {
+			t.Fatalf("expected the configured address but got %v", addresses)
+		}
+	})
+}
+
+func TestBuildRules_IgnoreNodeLocal(t *testing.T) {
+	commands, err := BuildRules(FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		IPFamily:          DualStackFamily,
+		IgnoreNodeLocal:   true,
+		NodeAddresses:     []string{"10.0.0.5", "192.168.1.5", "fd00::5"},
+		SkipInbound:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := make([]string, 0)
+	for _, cmd := range commands {
+		if command := strings.Join(cmd.Args, " "); strings.Contains(command, "ignore-node-local") {
+			found = append(found, command)
+		}
+	}
+	expected := []string{
+		"iptables -t nat -A PROXY_INIT_OUTPUT -d 10.0.0.5 -j RETURN -m comment --comment " + formatComment("ignore-node-local-10.0.0.5"),
+		"iptables -t nat -A PROXY_INIT_OUTPUT -d 192.168.1.5 -j RETURN -m comment --comment " + formatComment("ignore-node-local-192.168.1.5"),
+		"ip6tables -t nat -A PROXY_INIT_OUTPUT -d fd00::5 -j RETURN -m comment --comment " + formatComment("ignore-node-local-fd00::5"),
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("unexpected node rules:\ngot:\n%s\nexpected:\n%s", strings.Join(found, "\n"), strings.Join(expected, "\n"))
+	}
+}
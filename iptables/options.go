@@ -0,0 +1,139 @@
+package iptables
+
+// Option customizes the FirewallConfiguration built by NewFirewallConfiguration.
+type Option func(*FirewallConfiguration)
+
+// NewFirewallConfiguration builds a FirewallConfiguration out of the given options, applied in order, and validates
+// it. Unless overridden, all inbound and outbound IPv4 traffic is redirected with REDIRECT rules.
+func NewFirewallConfiguration(opts ...Option) (FirewallConfiguration, error) {
+	firewallConfiguration := FirewallConfiguration{
+		Mode:                        RedirectAllMode,
+		PortsToRedirectInbound:      make([]int, 0),
+		PortRangesToRedirectInbound: make([]string, 0),
+		InboundPortsToIgnore:        make([]string, 0),
+		OutboundPortsToIgnore:       make([]string, 0),
+		IPFamily:                    IPv4Family,
+		ProxyMode:                   RedirectProxyMode,
+		TproxyMark:                  DefaultTproxyMark,
+	}
+	for _, opt := range opts {
+		opt(&firewallConfiguration)
+	}
+
+	if err := firewallConfiguration.Validate(); err != nil {
+		return FirewallConfiguration{}, err
+	}
+	return firewallConfiguration, nil
+}
+
+// WithProxyPorts sets the ports the proxy receives the redirected inbound and outbound traffic on.
+func WithProxyPorts(inbound int, outgoing int) Option {
+	return func(c *FirewallConfiguration) {
+		c.ProxyInboundPort = inbound
+		c.ProxyOutgoingPort = outgoing
+	}
+}
+
+// WithRedirectAll redirects the inbound traffic to every port to the proxy.
+func WithRedirectAll() Option {
+	return func(c *FirewallConfiguration) {
+		c.Mode = RedirectAllMode
+		c.PortsToRedirectInbound = make([]int, 0)
+		c.PortRangesToRedirectInbound = make([]string, 0)
+	}
+}
+
+// WithRedirectListed only redirects the inbound traffic to the given ports to the proxy.
+func WithRedirectListed(ports ...int) Option {
+	return func(c *FirewallConfiguration) {
+		c.Mode = RedirectListedMode
+		c.PortsToRedirectInbound = append(c.PortsToRedirectInbound, ports...)
+	}
+}
+
+// WithInboundIgnore never redirects the inbound traffic to the given ports or port ranges.
+func WithInboundIgnore(ports ...string) Option {
+	return func(c *FirewallConfiguration) {
+		c.InboundPortsToIgnore = append(c.InboundPortsToIgnore, ports...)
+	}
+}
+
+// WithOutboundIgnore never redirects the outbound traffic to the given ports or port ranges.
+func WithOutboundIgnore(ports ...string) Option {
+	return func(c *FirewallConfiguration) {
+		c.OutboundPortsToIgnore = append(c.OutboundPortsToIgnore, ports...)
+	}
+}
+
+// WithProxyUID ignores the traffic of the given user, which the proxy runs as.
+func WithProxyUID(uid int) Option {
+	return func(c *FirewallConfiguration) {
+		c.ProxyUID = uid
+		c.HasProxyUID = true
+	}
+}
+
+// WithProxyUIDRange ignores the traffic of the users from lower to upper, inclusive, which the proxies run as.
+func WithProxyUIDRange(lower, upper int) Option {
+	return func(c *FirewallConfiguration) {
+		c.ProxyUIDRange = [2]int{lower, upper}
+	}
+}
+
+// WithProxyGID ignores the traffic of the given group, which the proxy runs as.
+func WithProxyGID(gid int) Option {
+	return func(c *FirewallConfiguration) {
+		c.ProxyGID = gid
+		c.HasProxyGID = true
+	}
+}
+
+// WithNetNs configures the rules of the given network namespace instead of the current one.
+func WithNetNs(netNs string) Option {
+	return func(c *FirewallConfiguration) {
+		c.NetNs = netNs
+	}
+}
+
+// WithNetNsPID configures the rules of the network namespace of the process with the given PID instead of the current
+// one.
+func WithNetNsPID(pid int) Option {
+	return func(c *FirewallConfiguration) {
+		c.NetNsPID = pid
+	}
+}
+
+// WithIPFamily configures the rules of the given IP family, IPv4Family, IPv6Family or DualStackFamily.
+func WithIPFamily(family string) Option {
+	return func(c *FirewallConfiguration) {
+		c.IPFamily = family
+	}
+}
+
+// WithSimulateOnly logs the commands instead of executing them.
+func WithSimulateOnly() Option {
+	return func(c *FirewallConfiguration) {
+		c.SimulateOnly = true
+	}
+}
+
+// WithRunner executes the commands with the given CommandRunner.
+func WithRunner(runner CommandRunner) Option {
+	return func(c *FirewallConfiguration) {
+		c.Runner = runner
+	}
+}
+
+// WithTraceID identifies the rules with the given trace ID instead of ExecutionTraceID.
+func WithTraceID(traceID string) Option {
+	return func(c *FirewallConfiguration) {
+		c.TraceID = traceID
+	}
+}
+
+// WithLogger reports the progress of the configuration to the given Logger.
+func WithLogger(logger Logger) Option {
+	return func(c *FirewallConfiguration) {
+		c.Logger = logger
+	}
+}
@@ -0,0 +1,61 @@
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewFirewallConfiguration(t *testing.T) {
+	t.Run("It applies the options over the defaults", func(t *testing.T) {
+		config, err := NewFirewallConfiguration(
+			WithProxyPorts(4143, 4140),
+			WithRedirectListed(8080, 9090),
+			WithInboundIgnore("4190", "4191"),
+			WithProxyUID(2102),
+			WithNetNs("/var/run/netns/test"),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := FirewallConfiguration{
+			Mode:                        RedirectListedMode,
+			PortsToRedirectInbound:      []int{8080, 9090},
+			PortRangesToRedirectInbound: []string{},
+			InboundPortsToIgnore:        []string{"4190", "4191"},
+			OutboundPortsToIgnore:       []string{},
+			ProxyInboundPort:            4143,
+			ProxyOutgoingPort:           4140,
+			ProxyUID:                    2102,
+			HasProxyUID:                 true,
+			NetNs:                       "/var/run/netns/test",
+			IPFamily:                    IPv4Family,
+			ProxyMode:                   RedirectProxyMode,
+			TproxyMark:                  DefaultTproxyMark,
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Fatalf("expected configuration\n%+v\nbut got\n%+v", expected, config)
+		}
+	})
+
+	t.Run("It validates the configuration", func(t *testing.T) {
+		_, err := NewFirewallConfiguration(WithProxyPorts(4143, 4140), WithRedirectListed())
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if !strings.Contains(err.Error(), "requires at least one port") {
+			t.Fatalf("expected a validation error but got: %s", err)
+		}
+	})
+
+	t.Run("It rejects both a network namespace path and PID", func(t *testing.T) {
+		_, err := NewFirewallConfiguration(WithProxyPorts(4143, 4140), WithNetNs("/var/run/netns/test"), WithNetNsPID(42))
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if !strings.Contains(err.Error(), "NetNs and NetNsPID can't be used together") {
+			t.Fatalf("expected a validation error but got: %s", err)
+		}
+	})
+}
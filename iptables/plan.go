@@ -0,0 +1,214 @@
+package iptables
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// PlannedStep describes a command ConfigureFirewall would run to apply the configuration, as listed by Plan.
+type PlannedStep struct {
+	// Family is the IP family the command configures.
+	Family string `json:"family"`
+	// Action is `create-chain`, `append` or `insert` for iptables commands, and `run` for the other commands, such
+	// as those routing TPROXY traffic.
+	Action string `json:"action"`
+	// Table is the table holding the chain.
+	Table string `json:"table,omitempty"`
+	// Chain is the chain created or holding the rule.
+	Chain string `json:"chain,omitempty"`
+	// Position is the position the rule is inserted at, 1 being the first rule.
+	Position int `json:"position,omitempty"`
+	// Protocol is the protocol the rule applies to, or empty for all protocols.
+	Protocol string `json:"protocol,omitempty"`
+	// Match is the rest of the arguments selecting the packets the rule applies to, excluding the comment.
+	Match []string `json:"match,omitempty"`
+	// Target is the chain or extension the packets are sent to.
+	Target string `json:"target,omitempty"`
+	// TargetOptions are the arguments of the target.
+	TargetOptions []string `json:"targetOptions,omitempty"`
+	// Comment is the comment identifying the rule or chain.
+	Comment string `json:"comment,omitempty"`
+	// Command is the command line, without the nsenter and wait flag wrapping.
+	Command []string `json:"command"`
+}
+
+// Plan returns the commands ConfigureFirewall would run to apply the configuration as a JSON array of PlannedStep,
+// in order, so that tools can audit them. Like DumpScript, it neither reads nor removes the installed rules.
+func (c FirewallConfiguration) Plan() ([]byte, error) {
+	steps := make([]PlannedStep, 0)
+	for _, family := range ipFamilies(c) {
+		familyConfiguration := c
+		familyConfiguration.IPFamily = family
+		commands, err := BuildRules(familyConfiguration)
+		if err != nil {
+			return nil, err
+		}
+
+		binary := iptablesBinary(familyConfiguration)
+		for _, cmd := range commands {
+			steps = append(steps, planStep(family, binary, cmd.Args))
+		}
+	}
+	return json.MarshalIndent(steps, "", "  ")
+}
+
+// RuleCount returns the number of rules ConfigureFirewall would add for the configuration, across IP families and
+// tables, e.g. to estimate the size of the nat tables of a node before a rollout. Chains and the routing of TPROXY
+// traffic aren't counted. The rules are counted from the configuration alone, without building the commands or
+// reading anything from the host, so the cluster DNS and node addresses to ignore must be configured rather than
+// discovered. An invalid configuration is reported as an error.
+func (c FirewallConfiguration) RuleCount() (int, error) {
+	if err := c.Validate(); err != nil {
+		return 0, err
+	}
+	// As done by resolveDirections, without logging.
+	c.SkipOutbound = c.SkipOutbound || c.ProxyOutgoingPort == 0
+	if c.IgnoreClusterDNS && !c.SkipOutbound && len(c.ClusterDNSAddresses) == 0 {
+		return 0, fmt.Errorf("ClusterDNSAddresses must be set to count the rules ignoring the cluster DNS")
+	}
+	if c.IgnoreNodeLocal && !c.SkipOutbound && len(c.NodeAddresses) == 0 {
+		return 0, fmt.Errorf("NodeAddresses must be set to count the rules ignoring the node")
+	}
+
+	count := 0
+	for _, family := range ipFamilies(c) {
+		familyConfiguration := c
+		familyConfiguration.IPFamily = family
+		count += incomingRuleCount(familyConfiguration) + outgoingRuleCount(familyConfiguration) + noTrackRuleCount(familyConfiguration)
+	}
+	return count, nil
+}
+
+// incomingRuleCount counts the rules addIncomingTrafficRules adds.
+func incomingRuleCount(c FirewallConfiguration) int {
+	if c.SkipInbound {
+		return 0
+	}
+	perProtocol := len(protocols(c))
+	count := countIf(c.IgnoreICMP) + countIf(c.IgnoreDNAT) + countIf(c.RedirectNewOnly) + 2*countIf(c.LogPackets)
+	count += perProtocol * len(makeMultiportDestinations(coalescePortRanges(uniquePortRanges(c.InboundPortsToIgnore))))
+	count += perProtocol * len(makeMultiportDestinations(intsToStrings(uniquePorts(c.ProbePorts))))
+	count += perProtocol * len(makeMultiportDestinations(intsToStrings(proxyPorts(c))))
+	count += len(cidrsForFamily(c.InboundCIDRsToIgnore, c.IPFamily))
+
+	redirects := 0
+	switch c.Mode {
+	case RedirectAllMode:
+		redirects = 1
+	case RedirectListedMode:
+		redirects = len(uniquePorts(c.PortsToRedirectInbound)) + len(uniquePortRanges(c.PortRangesToRedirectInbound))
+	}
+	if c.LogRedirects {
+		redirects *= 2
+	}
+	return count + perProtocol*redirects + jumpCount(c)
+}
+
+// outgoingRuleCount counts the rules addOutgoingTrafficRules adds.
+func outgoingRuleCount(c FirewallConfiguration) int {
+	if c.SkipOutbound {
+		return 0
+	}
+	perProtocol := len(protocols(c))
+	count := countIf(c.IgnoreICMP) + 2*countIf(c.LogPackets) + countIf(c.IgnoreEstablished) + countIf(c.RedirectNewOnly)
+	_, hasUID := proxyUIDOwner(c)
+	for _, set := range []bool{hasUID, c.ProxyGID > 0 || c.HasProxyGID} {
+		if set {
+			count += 1 + countIf(c.ProxyMode != TproxyProxyMode && !c.SkipInbound)
+		}
+	}
+	// the loopback traffic is always ignored
+	count++
+	count += perProtocol * len(makeMultiportDestinations(coalescePortRanges(uniquePortRanges(c.OutboundPortsToIgnore))))
+	if c.SkipSpecialRanges {
+		count += len(cidrsForFamily(specialRanges, c.IPFamily))
+	}
+	count += len(cidrsForFamily(c.OutboundCIDRsToIgnore, c.IPFamily))
+	if c.IgnoreClusterDNS {
+		count += 2 * len(addressesForFamily(c.ClusterDNSAddresses, c.IPFamily))
+	}
+	if c.IgnoreNodeLocal {
+		count += len(addressesForFamily(c.NodeAddresses, c.IPFamily))
+	}
+
+	redirects := 1
+	if c.OutboundMode == RedirectListedMode {
+		redirects = len(uniquePorts(c.PortsToRedirectOutbound))
+	}
+	if c.FwMark > 0 {
+		redirects *= 2
+	}
+	count += perProtocol*redirects + jumpCount(c)
+	if rewritesSource(c) {
+		count += 2
+	}
+	return count
+}
+
+// noTrackRuleCount counts the rules addNoTrackRules adds.
+func noTrackRuleCount(c FirewallConfiguration) int {
+	if len(c.NoTrackPorts) == 0 {
+		return 0
+	}
+	return 2*len(protocols(c))*len(uniquePorts(c.NoTrackPorts)) + 2
+}
+
+// jumpCount counts the rules addJumpsIntoChain adds.
+func jumpCount(c FirewallConfiguration) int {
+	if c.ScopeJumpsToProtocols {
+		return len(protocols(c))
+	}
+	return 1
+}
+
+// countIf returns 1 for the rules added when the condition holds, 0 otherwise.
+func countIf(condition bool) int {
+	if condition {
+		return 1
+	}
+	return 0
+}
+
+// planStep describes the command, parsing it when it's an iptables command run with the binary.
+func planStep(family string, binary string, args []string) PlannedStep {
+	step := PlannedStep{Family: family, Action: "run", Command: args}
+	if args[0] != binary || len(args) < 5 || args[1] != "-t" {
+		return step
+	}
+
+	table, operation, chain, spec := args[2], args[3], args[4], args[5:]
+	switch operation {
+	case "-N":
+		rule := parseRule(table, chain, spec)
+		step.Action, step.Table, step.Chain, step.Comment = "create-chain", table, chain, rule.Comment
+		return step
+	case "-A":
+		step.Action = "append"
+	case "-I":
+		step.Action = "insert"
+		if len(spec) > 0 {
+			if position, err := strconv.Atoi(spec[0]); err == nil {
+				step.Position = position
+				spec = spec[1:]
+			}
+		}
+	default:
+		return step
+	}
+
+	rule := parseRule(table, chain, spec)
+	step.Table, step.Chain, step.Target, step.Comment = table, chain, rule.Target, rule.Comment
+	for i := 0; i < len(rule.Matches); i++ {
+		if rule.Matches[i] == "-p" && i+1 < len(rule.Matches) {
+			step.Protocol = rule.Matches[i+1]
+			i++
+			continue
+		}
+		step.Match = append(step.Match, rule.Matches[i])
+	}
+	if len(rule.TargetOptions) > 0 {
+		step.TargetOptions = rule.TargetOptions
+	}
+	return step
+}
@@ -0,0 +1,192 @@
+package iptables
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	out, err := FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		IPFamily:               DualStackFamily,
+		JumpPosition:           1,
+	}.Plan()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var steps []PlannedStep
+	if err := json.Unmarshal(out, &steps); err != nil {
+		t.Fatalf("expected a JSON array of steps but got %s: %s", out, err)
+	}
+	if len(steps) == 0 || steps[0].Family != IPv4Family || steps[len(steps)-1].Family != IPv6Family {
+		t.Fatalf("expected the IPv4 steps, then the IPv6 ones, but got %s", out)
+	}
+
+	expected := []PlannedStep{
+		{
+			Family:  IPv4Family,
+			Action:  "create-chain",
+			Table:   "nat",
+			Chain:   ProxyInitRedirectChainName,
+			Comment: formatComment("redirect-common-chain"),
+			Command: []string{"iptables", "-t", "nat", "-N", ProxyInitRedirectChainName, "-m", "comment", "--comment", formatComment("redirect-common-chain")},
+		},
+		{
+			Family:        IPv4Family,
+			Action:        "append",
+			Table:         "nat",
+			Chain:         ProxyInitRedirectChainName,
+			Protocol:      "tcp",
+			Match:         []string{"--destination-port", "8080"},
+			Target:        "REDIRECT",
+			TargetOptions: []string{"--to-port", "4143"},
+			Comment:       formatComment("redirect-port-8080-to-proxy-port"),
+			Command:       []string{"iptables", "-t", "nat", "-A", ProxyInitRedirectChainName, "-p", "tcp", "--destination-port", "8080", "-j", "REDIRECT", "--to-port", "4143", "-m", "comment", "--comment", formatComment("redirect-port-8080-to-proxy-port")},
+		},
+		{
+			Family:   IPv4Family,
+			Action:   "insert",
+			Table:    "nat",
+			Chain:    IptablesPreroutingChainName,
+			Position: 1,
+			Target:   ProxyInitRedirectChainName,
+			Comment:  formatComment("install-proxy-init-prerouting"),
+			Command:  []string{"iptables", "-t", "nat", "-I", IptablesPreroutingChainName, "1", "-j", ProxyInitRedirectChainName, "-m", "comment", "--comment", formatComment("install-proxy-init-prerouting")},
+		},
+	}
+	actual := make([]PlannedStep, 0)
+	for _, step := range steps {
+		if step.Family == IPv4Family && (step.Action == "create-chain" || step.Target == "REDIRECT" || step.Action == "insert") {
+			actual = append(actual, step)
+		}
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected\n%+v\nbut got\n%+v", expected, actual)
+	}
+}
+
+func TestRuleCount(t *testing.T) {
+	t.Run("It counts the rules of every IP family", func(t *testing.T) {
+		fc := FirewallConfiguration{
+			Mode:                   RedirectListedMode,
+			PortsToRedirectInbound: []int{8080},
+			ProxyInboundPort:       4143,
+			IPFamily:               DualStackFamily,
+		}
+		count, err := fc.RuleCount()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if count != 6 {
+			t.Fatalf("expected 6 rules, ignoring the proxy port, redirecting and jumping per IP family, but got %d", count)
+		}
+	})
+
+	t.Run("It reports an invalid configuration", func(t *testing.T) {
+		if _, err := (FirewallConfiguration{Mode: RedirectAllMode}).RuleCount(); err == nil {
+			t.Fatal("expected error but got nil")
+		}
+	})
+
+	t.Run("It doesn't discover the addresses to ignore", func(t *testing.T) {
+		_, err := FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			IgnoreClusterDNS:  true,
+		}.RuleCount()
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+	})
+
+	t.Run("It counts the rules BuildRules adds", func(t *testing.T) {
+		base := FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+		}
+		for name, configure := range map[string]func(c *FirewallConfiguration){
+			"default": func(c *FirewallConfiguration) {},
+			"listed ports": func(c *FirewallConfiguration) {
+				c.Mode = RedirectListedMode
+				c.PortsToRedirectInbound = []int{8080, 9090, 8080}
+				c.PortRangesToRedirectInbound = []string{"7000-7010"}
+				c.InboundPortTargets = map[int]int{9090: 4144}
+				c.OutboundMode = RedirectListedMode
+				c.PortsToRedirectOutbound = []int{443, 80}
+			},
+			"ignored traffic": func(c *FirewallConfiguration) {
+				c.InboundPortsToIgnore = []string{"22", "25-27", "26"}
+				c.OutboundPortsToIgnore = []string{"443"}
+				c.ProbePorts = []int{8081}
+				c.InboundCIDRsToIgnore = []string{"10.0.0.0/8", "fd00::/8"}
+				c.OutboundCIDRsToIgnore = []string{"192.168.0.0/16"}
+				c.SkipSpecialRanges = true
+				c.IgnoreClusterDNS = true
+				c.ClusterDNSAddresses = []string{"10.96.0.10", "fd00::a"}
+				c.IgnoreNodeLocal = true
+				c.NodeAddresses = []string{"10.0.0.1"}
+				c.IgnoreICMP = true
+				c.IgnoreDNAT = true
+				c.IgnoreEstablished = true
+				c.RedirectNewOnly = true
+			},
+			"proxy owners": func(c *FirewallConfiguration) {
+				c.ProxyUID = 2102
+				c.ProxyGID = 2102
+				c.ProxyAdminPort = 4191
+			},
+			"logging and marking": func(c *FirewallConfiguration) {
+				c.LogPackets = true
+				c.LogRedirects = true
+				c.FwMark = 0x10
+				c.Masquerade = true
+			},
+			"every protocol and family": func(c *FirewallConfiguration) {
+				c.IPFamily = DualStackFamily
+				c.RedirectUDP = true
+				c.ScopeJumpsToProtocols = true
+				c.NoTrackPorts = []int{9000, 8000, 9000}
+				c.ProxyUID = 2102
+			},
+			"tproxy": func(c *FirewallConfiguration) {
+				c.ProxyMode = TproxyProxyMode
+				c.ProxyUID = 2102
+			},
+			"inbound only": func(c *FirewallConfiguration) {
+				c.ProxyOutgoingPort = 0
+			},
+		} {
+			fc := base
+			configure(&fc)
+			commands, err := BuildRules(fc)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", name, err)
+			}
+			expected := 0
+			for _, family := range ipFamilies(fc) {
+				familyConfiguration := fc
+				familyConfiguration.IPFamily = family
+				binary := iptablesBinary(familyConfiguration)
+				for _, cmd := range commands {
+					if _, ok := addedRule(binary, cmd); ok {
+						expected++
+					}
+				}
+			}
+
+			count, err := fc.RuleCount()
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", name, err)
+			}
+			if count != expected {
+				t.Fatalf("%s: expected %d rules but got %d", name, expected, count)
+			}
+		}
+	})
+}
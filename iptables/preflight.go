@@ -0,0 +1,159 @@
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// capNetAdmin is the number of the CAP_NET_ADMIN capability, required to change the iptables rules.
+const capNetAdmin = 12
+
+var (
+	// procStatusPath is the file listing the capabilities of the current process.
+	procStatusPath = "/proc/self/status"
+	// lookPath finds the binaries on the PATH.
+	lookPath = exec.LookPath
+)
+
+// checkCapabilities fails early, with an actionable error, when the process lacks the CAP_NET_ADMIN capability every
+// iptables command needs. The check is skipped when commands aren't run by this process, that is when simulating or
+// when a Runner is configured, and on systems without /proc.
+func checkCapabilities(firewallConfiguration FirewallConfiguration) error {
+	if firewallConfiguration.SimulateOnly || firewallConfiguration.Runner != nil {
+		return nil
+	}
+
+	status, err := ioutil.ReadFile(procStatusPath)
+	if os.IsNotExist(err) {
+		logger(firewallConfiguration).Info("Not checking the capabilities", "reason", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read the capabilities of the process: %w", err)
+	}
+
+	capabilities, err := effectiveCapabilities(status)
+	if err != nil {
+		return err
+	}
+	if capabilities&(1<<capNetAdmin) == 0 {
+		return fmt.Errorf("the NET_ADMIN capability is missing, add it to the securityContext.capabilities of the container: %w", ErrPermission)
+	}
+	return nil
+}
+
+// effectiveCapabilities returns the CapEff bitmask found in the content of /proc/<pid>/status.
+func effectiveCapabilities(status []byte) (uint64, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		capabilities, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse the capabilities of the process: %w", err)
+		}
+		return capabilities, nil
+	}
+	return 0, fmt.Errorf("could not find the capabilities of the process")
+}
+
+// checkBinaries fails early, naming the missing binary, when one of the binaries the configuration needs can't be
+// found. Like checkCapabilities, it is skipped when commands aren't run by this process.
+func checkBinaries(firewallConfiguration FirewallConfiguration) error {
+	if firewallConfiguration.SimulateOnly || firewallConfiguration.Runner != nil {
+		return nil
+	}
+
+	binaries := make([]string, 0)
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		binaries = append(binaries, iptablesBinary(familyConfiguration), iptablesSaveBinary(familyConfiguration))
+		if firewallConfiguration.UseIptablesRestore {
+			binaries = append(binaries, fmt.Sprintf("%s-restore", iptablesBinary(familyConfiguration)))
+		}
+	}
+	if firewallConfiguration.ProxyMode == TproxyProxyMode && !firewallConfiguration.SkipInbound {
+		binaries = append(binaries, "ip")
+	}
+	if len(nsenterArgs(firewallConfiguration)) > 0 {
+		binaries = append(binaries, nsenterPath(firewallConfiguration))
+	}
+
+	path, ok := envPath(firewallConfiguration.Env)
+	if !ok {
+		path = os.Getenv("PATH")
+	}
+	for _, binary := range binaries {
+		if _, err := lookPathInEnv(firewallConfiguration.Env, binary); err != nil {
+			return fmt.Errorf("could not find the %s binary in PATH %q, install it or configure its path: %w", binary, path, err)
+		}
+	}
+	return nil
+}
+
+// checkIgnoreTarget fails early when the IgnoreTarget is a chain missing from one of the tables the rules ignoring
+// traffic are added to, rather than failing halfway through adding the rules. It is skipped when simulating.
+func checkIgnoreTarget(firewallConfiguration FirewallConfiguration) error {
+	target := ignoreTarget(firewallConfiguration)
+	if target == "RETURN" || target == "ACCEPT" || firewallConfiguration.SimulateOnly {
+		return nil
+	}
+
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		tables := make([]string, 0)
+		if !familyConfiguration.SkipInbound {
+			tables = append(tables, inboundTable(familyConfiguration))
+		}
+		if !familyConfiguration.SkipOutbound && (len(tables) == 0 || tables[0] != natTable(familyConfiguration)) {
+			tables = append(tables, natTable(familyConfiguration))
+		}
+		binary := iptablesBinary(familyConfiguration)
+		for _, table := range tables {
+			if err := executeCommand(familyConfiguration, makeListChainRules(binary, table, target)); err != nil {
+				return fmt.Errorf("the ignore target %s must be a chain of the %s table of %s: %w", target, table, binary, err)
+			}
+		}
+	}
+	return nil
+}
+
+// envPath returns the PATH set by the environment, the last entry winning as with exec.Cmd.
+func envPath(env []string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], "PATH=") {
+			return strings.TrimPrefix(env[i], "PATH="), true
+		}
+	}
+	return "", false
+}
+
+// lookPathInEnv finds the binary in the PATH set by the environment, or with lookPath when it doesn't set one or the
+// binary is given as a path.
+func lookPathInEnv(env []string, binary string) (string, error) {
+	path, ok := envPath(env)
+	if !ok || strings.Contains(binary, "/") {
+		return lookPath(binary)
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		candidate := filepath.Join(dir, binary)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", binary, exec.ErrNotFound)
+}
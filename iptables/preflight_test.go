@@ -0,0 +1,161 @@
+package iptables
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEffectiveCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		status   string
+		expected uint64
+		err      string
+	}{
+		{"It parses the effective capabilities", "Name:\tproxy-init\nCapInh:\t0000000000000000\nCapEff:\t00000000a80435fb\n", 0xa80435fb, ""},
+		{"It fails without capabilities", "Name:\tproxy-init\n", 0, "could not find the capabilities"},
+		{"It fails on malformed capabilities", "CapEff:\tall\n", 0, "could not parse the capabilities"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			capabilities, err := effectiveCapabilities([]byte(tt.status))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q but got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if capabilities != tt.expected {
+				t.Fatalf("expected capabilities %#x but got %#x", tt.expected, capabilities)
+			}
+		})
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { procStatusPath = path }(procStatusPath)
+	procStatusPath = filepath.Join(dir, "status")
+
+	for _, tt := range []struct {
+		name   string
+		capEff string
+		err    bool
+	}{
+		{"It accepts NET_ADMIN", "0000000000001000", false},
+		{"It rejects missing NET_ADMIN", "00000000a80425fb", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(procStatusPath, []byte("CapEff:\t"+tt.capEff+"\n"), 0600); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			err := checkCapabilities(FirewallConfiguration{})
+			if tt.err && (err == nil || !strings.Contains(err.Error(), "NET_ADMIN capability is missing") || !errors.Is(err, ErrPermission)) {
+				t.Fatalf("expected a missing capability error but got %v", err)
+			}
+			if !tt.err && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestCheckBinaries(t *testing.T) {
+	defer func(f func(string) (string, error)) { lookPath = f }(lookPath)
+	lookPath = func(file string) (string, error) {
+		if file == "ip6tables-save" {
+			return "", exec.ErrNotFound
+		}
+		return "/sbin/" + file, nil
+	}
+
+	if err := checkBinaries(FirewallConfiguration{IPFamily: IPv4Family}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err := checkBinaries(FirewallConfiguration{IPFamily: DualStackFamily})
+	if err == nil {
+		t.Fatal("expected error but got nil")
+	}
+	if !strings.Contains(err.Error(), "could not find the ip6tables-save binary") || !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("expected an error naming the missing binary but got: %s", err)
+	}
+}
+
+func TestCheckIgnoreTarget(t *testing.T) {
+	for _, target := range []string{"", "RETURN", "ACCEPT"} {
+		runner := &scriptedRunner{}
+		if err := checkIgnoreTarget(FirewallConfiguration{IgnoreTarget: target, Runner: runner}); err != nil {
+			t.Fatalf("unexpected error for %q: %s", target, err)
+		}
+		if len(runner.commands) != 0 {
+			t.Fatalf("expected no commands for %q but got %v", target, runner.commands)
+		}
+	}
+
+	runner := &scriptedRunner{}
+	if err := checkIgnoreTarget(FirewallConfiguration{IgnoreTarget: "AUDIT_IGNORED", Runner: runner}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := []string{"iptables -t nat -S AUDIT_IGNORED"}; !reflect.DeepEqual(runner.commands, expected) {
+		t.Fatalf("expected %v but got %v", expected, runner.commands)
+	}
+
+	runner = &scriptedRunner{errors: map[string]error{"iptables -t nat -S AUDIT_IGNORED": errors.New("No chain/target/match by that name.")}}
+	err := checkIgnoreTarget(FirewallConfiguration{IgnoreTarget: "AUDIT_IGNORED", Runner: runner})
+	if err == nil || !strings.Contains(err.Error(), "the ignore target AUDIT_IGNORED must be a chain of the nat table") {
+		t.Fatalf("expected an error naming the missing chain but got: %v", err)
+	}
+}
+
+func TestLookPathInEnv(t *testing.T) {
+	defer func(f func(string) (string, error)) { lookPath = f }(lookPath)
+	lookPath = func(file string) (string, error) {
+		return "/sbin/" + file, nil
+	}
+
+	dir, err := ioutil.TempDir("", "proxy-init-path")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ip6tables"), []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		env      []string
+		binary   string
+		expected string
+		err      error
+	}{
+		{"It looks the binary up in the PATH of the environment", []string{"PATH=/nonexistent:" + dir}, "iptables", filepath.Join(dir, "iptables"), nil},
+		{"It skips files that aren't executable", []string{"PATH=" + dir}, "ip6tables", "", exec.ErrNotFound},
+		{"It uses the last PATH", []string{"PATH=" + dir, "PATH=/nonexistent"}, "iptables", "", exec.ErrNotFound},
+		{"It falls back to the PATH of the process", []string{"LC_ALL=C"}, "iptables", "/sbin/iptables", nil},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := lookPathInEnv(tt.env, tt.binary)
+			if !errors.Is(err, tt.err) || path != tt.expected {
+				t.Fatalf("expected [%s] and error [%v] but got [%s] and [%v]", tt.expected, tt.err, path, err)
+			}
+		})
+	}
+}
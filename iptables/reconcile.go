@@ -0,0 +1,179 @@
+package iptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ReconcileFirewall brings the installed rules in line with the configuration by applying only the differences
+// reported by Diff, without flushing the proxy-init chains. The missing chains are created, the missing rules are
+// added and only then are the stale rules deleted, so that the traffic is handled by either the previous or the new
+// rules at any point in time. The proxy-init chains the configuration no longer uses are deleted once the removals
+// leave them empty and unreferenced. Commands are killed once ctx is done.
+func ReconcileFirewall(ctx context.Context, firewallConfiguration FirewallConfiguration) error {
+	firewallConfiguration.ctx = ctx
+
+	logger(firewallConfiguration).Info("Tracing this script execution", "traceID", traceID(firewallConfiguration))
+
+	start := time.Now()
+	defer func() {
+		metrics(firewallConfiguration).ApplyDuration(time.Since(start))
+	}()
+
+	if err := firewallConfiguration.Validate(); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall reconciliation", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("validate")
+		return err
+	}
+
+	if err := checkCapabilities(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall reconciliation", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+
+	firewallConfiguration = resolveDirections(resolveBackend(firewallConfiguration))
+
+	if err := checkBinaries(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall reconciliation", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+
+	if err := checkIgnoreTarget(firewallConfiguration); err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall reconciliation", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("preflight")
+		return err
+	}
+
+	commands, err := BuildRules(firewallConfiguration)
+	if err != nil {
+		logger(firewallConfiguration).Error("Aborting firewall reconciliation", "error", err)
+		metrics(firewallConfiguration).ApplyFailed("build")
+		return err
+	}
+
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		if err := reconcileFirewallForFamily(familyConfiguration, commands, newRuleSnapshot(familyConfiguration)); err != nil {
+			metrics(familyConfiguration).ApplyFailed("reconcile")
+			return fmt.Errorf("failed to reconcile %s firewall: %w", family, err)
+		}
+	}
+	return nil
+}
+
+func reconcileFirewallForFamily(firewallConfiguration FirewallConfiguration, commands []*exec.Cmd, snapshot *ruleSnapshot) error {
+	binary := iptablesBinary(firewallConfiguration)
+
+	toAdd, toRemove, err := diffFamily(firewallConfiguration, commands, snapshot)
+	if err != nil {
+		return err
+	}
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		logger(firewallConfiguration).Info("The rules are already up to date", "family", firewallConfiguration.IPFamily)
+		return nil
+	}
+	logger(firewallConfiguration).Info("Reconciling rules", "family", firewallConfiguration.IPFamily, "binary", binary, "adding", len(toAdd), "removing", len(toRemove))
+
+	for _, cmd := range commands {
+		if _, ok := createdChain(binary, cmd); !ok {
+			continue
+		}
+		if err := executeCommand(firewallConfiguration, cmd); err != nil && !isExistingChain(err) {
+			return err
+		}
+	}
+
+	// The rules are added with the commands BuildRules generated for them, so that inserted rules keep their position.
+	pending := append([]Rule{}, toAdd...)
+	for _, cmd := range commands {
+		rule, ok := addedRule(binary, cmd)
+		if !ok {
+			continue
+		}
+		for i := range pending {
+			if reflect.DeepEqual(pending[i], rule) {
+				pending = append(pending[:i], pending[i+1:]...)
+				if err := executeCommand(firewallConfiguration, cmd); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	for _, rule := range toRemove {
+		if err := executeCommand(firewallConfiguration, makeDeleteRule(binary, rule.Table, append([]string{rule.Chain}, ruleSpec(rule)...))); err != nil && !isMissingObject(err) {
+			return fmt.Errorf("could not delete rule %q from chain %s: %w", rule.Comment, rule.Chain, err)
+		}
+	}
+
+	for _, chain := range staleChains(firewallConfiguration, binary, commands, toRemove) {
+		if err := removeUnusedChain(firewallConfiguration, binary, chain); err != nil {
+			return err
+		}
+	}
+
+	metrics(firewallConfiguration).RulesApplied(len(toAdd))
+	return nil
+}
+
+// staleChains returns the proxy-init chains the removed rules are held in or jump to that the commands don't create,
+// such as the TPROXY chain of the mangle table once the configuration switches to REDIRECT.
+func staleChains(firewallConfiguration FirewallConfiguration, binary string, commands []*exec.Cmd, removed []Rule) []proxyInitChain {
+	created := make(map[proxyInitChain]bool)
+	for _, cmd := range commands {
+		if chain, ok := createdChain(binary, cmd); ok {
+			created[proxyInitChain{cmd.Args[2], chain}] = true
+		}
+	}
+	owned := make(map[string]bool)
+	for _, name := range proxyInitChainNames(firewallConfiguration) {
+		if !firewallConfiguration.PreserveForeignChains || strings.HasPrefix(name, ProxyInitChainPrefix) {
+			owned[name] = true
+		}
+	}
+
+	chains := make([]proxyInitChain, 0)
+	seen := make(map[proxyInitChain]bool)
+	for _, rule := range removed {
+		for _, name := range []string{rule.Chain, rule.Target} {
+			chain := proxyInitChain{rule.Table, name}
+			if owned[name] && !created[chain] && !seen[chain] {
+				seen[chain] = true
+				chains = append(chains, chain)
+			}
+		}
+	}
+	return chains
+}
+
+// removeUnusedChain deletes the chain unless rules are still held in or jump to it, as listed by iptables-save.
+func removeUnusedChain(firewallConfiguration FirewallConfiguration, binary string, chain proxyInitChain) error {
+	rules, err := readRules(firewallConfiguration, chain.table)
+	if err != nil {
+		return fmt.Errorf("could not read the rules of table %s: %w", chain.table, err)
+	}
+	for _, rule := range rules {
+		if rule.Chain == chain.name || rule.Target == chain.name {
+			logger(firewallConfiguration).Info("Leaving a chain still in use", "table", chain.table, "chain", chain.name)
+			return nil
+		}
+	}
+	if err := executeCommand(firewallConfiguration, makeDeleteChain(binary, chain.table, chain.name)); err != nil && !isMissingObject(err) {
+		return fmt.Errorf("could not delete chain %s: %w", chain.name, err)
+	}
+	return nil
+}
+
+// isExistingChain checks whether the error reports that the chain to create already exists.
+func isExistingChain(err error) bool {
+	return errors.Is(err, ErrChainExists)
+}
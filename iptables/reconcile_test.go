@@ -0,0 +1,176 @@
+package iptables
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// liveTablesRunner is a CommandRunner answering iptables-save with the rules of its tables, or of the requested one,
+// less those it was asked to delete.
+type liveTablesRunner struct {
+	commands []string
+	tables   map[string][]Rule
+}
+
+func newLiveTablesRunner(t *testing.T, fc FirewallConfiguration, tables ...string) *liveTablesRunner {
+	runner := &liveTablesRunner{tables: make(map[string][]Rule)}
+	for _, table := range tables {
+		rules, err := ParseRules([]byte(savedTable(t, fc, table)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		runner.tables[table] = rules
+	}
+	return runner
+}
+
+func (r *liveTablesRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	command := strings.Join(cmd.Args, " ")
+	r.commands = append(r.commands, command)
+	args := cmd.Args[1:]
+	switch {
+	case cmd.Args[0] == "iptables-save":
+		tables := make([]string, 0)
+		for table := range r.tables {
+			if len(args) < 2 || args[1] == table {
+				tables = append(tables, table)
+			}
+		}
+		lines := make([]string, 0)
+		for _, table := range tables {
+			lines = append(lines, "*"+table)
+			for _, rule := range r.tables[table] {
+				lines = append(lines, strings.Join(append([]string{"-A", rule.Chain}, ruleSpec(rule)...), " "))
+			}
+			lines = append(lines, "COMMIT")
+		}
+		return []byte(strings.Join(lines, "\n")), nil
+	case cmd.Args[0] == "iptables" && len(args) > 3 && args[2] == "-D":
+		deleted := ruleFingerprint(parseRule(args[1], args[3], args[4:]))
+		rules := r.tables[args[1]]
+		for i, rule := range rules {
+			if ruleFingerprint(rule) == deleted {
+				r.tables[args[1]] = append(rules[:i:i], rules[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, nil
+}
+
+func TestReconcileFirewall(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProxyUID:               2102,
+	}
+
+	t.Run("It runs nothing but the listing when the rules are up to date", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, fc)},
+		}
+		current := fc
+		current.Runner = runner
+
+		if err := ReconcileFirewall(context.Background(), current); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, command := range runner.commands {
+			if !strings.HasPrefix(command, "iptables-save") {
+				t.Fatalf("expected only the rules to be read but got %v", runner.commands)
+			}
+		}
+	})
+
+	t.Run("It adds the missing rules before deleting the stale ones", func(t *testing.T) {
+		previous := fc
+		previous.PortsToRedirectInbound = []int{9090}
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, previous)},
+		}
+		current := fc
+		current.Runner = runner
+
+		if err := ReconcileFirewall(context.Background(), current); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		added, deleted := -1, -1
+		for i, command := range runner.commands {
+			if strings.Contains(command, " -F ") || strings.Contains(command, " -X ") {
+				t.Fatalf("expected no chain to be flushed or deleted but got %s", command)
+			}
+			if strings.Contains(command, " -A ") && strings.Contains(command, "redirect-port-8080-to-proxy-port") {
+				added = i
+			}
+			if strings.Contains(command, " -D ") && strings.Contains(command, "redirect-port-9090-to-proxy-port/1234") {
+				deleted = i
+			}
+		}
+		if added == -1 || deleted == -1 || added > deleted {
+			t.Fatalf("expected the new rule to be added before the stale one is deleted but got:\n%s", strings.Join(runner.commands, "\n"))
+		}
+		for _, command := range runner.commands {
+			if strings.Contains(command, "install-proxy-init-prerouting") {
+				t.Fatalf("expected the matching jump to be left untouched but got %s", command)
+			}
+		}
+	})
+
+	t.Run("It rewrites a rule whose only difference is a match", func(t *testing.T) {
+		previous := fc
+		previous.ProxyUID = 9999
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, previous)},
+		}
+		current := fc
+		current.Runner = runner
+
+		if err := ReconcileFirewall(context.Background(), current); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		added, deleted := false, false
+		for _, command := range runner.commands {
+			if strings.Contains(command, "ignore-proxy-user-id") {
+				added = added || strings.Contains(command, " -A ") && strings.Contains(command, "--uid-owner 2102")
+				deleted = deleted || strings.Contains(command, " -D ") && strings.Contains(command, "--uid-owner 9999")
+			}
+		}
+		if !added || !deleted {
+			t.Fatalf("expected the rule with the stale UID to be replaced but got:\n%s", strings.Join(runner.commands, "\n"))
+		}
+	})
+
+	t.Run("It deletes the chains of the previous mode once they are empty", func(t *testing.T) {
+		previous := fc
+		previous.ProxyMode = TproxyProxyMode
+		runner := newLiveTablesRunner(t, previous, "nat", "mangle")
+		current := fc
+		current.Runner = runner
+
+		if err := ReconcileFirewall(context.Background(), current); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(runner.tables["mangle"]) != 0 {
+			t.Fatalf("expected the TPROXY rules to be deleted but got %v", runner.tables["mangle"])
+		}
+		deleted := false
+		for _, command := range runner.commands {
+			if command == "iptables -t mangle -X PROXY_INIT_REDIRECT" {
+				deleted = true
+			}
+			if strings.HasPrefix(command, "iptables -t nat -X ") {
+				t.Fatalf("expected the chains still in use to be kept but got %s", command)
+			}
+		}
+		if !deleted {
+			t.Fatalf("expected the TPROXY chain to be deleted but got:\n%s", strings.Join(runner.commands, "\n"))
+		}
+	})
+}
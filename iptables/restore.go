@@ -0,0 +1,79 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// makeRestoreInput translates iptables commands into the input of `iptables-restore`, grouping the rules by table so
+// they can be committed in a single, atomic call. Commands that aren't iptables rule or chain additions, such as the
+// `ip` commands used for TPROXY, can't be expressed that way and are returned separately, in their original order.
+func makeRestoreInput(binary string, commands []*exec.Cmd) ([]byte, []*exec.Cmd, error) {
+	tables := make([]string, 0)
+	chainsByTable := make(map[string][]string)
+	rulesByTable := make(map[string][]string)
+	remaining := make([]*exec.Cmd, 0)
+
+	for _, cmd := range commands {
+		if cmd.Args[0] != binary {
+			remaining = append(remaining, cmd)
+			continue
+		}
+
+		args := cmd.Args[1:]
+		if len(args) < 4 || args[0] != "-t" {
+			return nil, nil, fmt.Errorf("command %q can't be applied with iptables-restore", cmd.Args)
+		}
+		table, operation, chain := args[1], args[2], args[3]
+		if _, ok := rulesByTable[table]; !ok {
+			tables = append(tables, table)
+			rulesByTable[table] = make([]string, 0)
+		}
+
+		switch operation {
+		case "-N":
+			chainsByTable[table] = append(chainsByTable[table], chain)
+		case "-A", "-I":
+			rulesByTable[table] = append(rulesByTable[table], formatRestoreRule(args[2:]))
+		default:
+			return nil, nil, fmt.Errorf("command %q can't be applied with iptables-restore", cmd.Args)
+		}
+	}
+
+	var input bytes.Buffer
+	for _, table := range tables {
+		fmt.Fprintf(&input, "*%s\n", table)
+		for _, chain := range chainsByTable[table] {
+			// Declaring a chain creates it, or flushes it when it already exists
+			fmt.Fprintf(&input, ":%s - [0:0]\n", chain)
+		}
+		for _, rule := range rulesByTable[table] {
+			fmt.Fprintln(&input, rule)
+		}
+		fmt.Fprintln(&input, "COMMIT")
+	}
+	return input.Bytes(), remaining, nil
+}
+
+// formatRestoreRule joins the arguments of a rule into a line of `iptables-restore` input, quoting arguments that
+// contain spaces.
+func formatRestoreRule(args []string) string {
+	formatted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"") {
+			arg = strconv.Quote(arg)
+		}
+		formatted = append(formatted, arg)
+	}
+	return strings.Join(formatted, " ")
+}
+
+// makeRestore applies the given input without flushing the tables, leaving the rules of other components intact.
+func makeRestore(binary string, input []byte) *exec.Cmd {
+	cmd := exec.Command(fmt.Sprintf("%s-restore", binary), "--noflush")
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd
+}
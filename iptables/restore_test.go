@@ -0,0 +1,97 @@
+package iptables
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// stdinRecordingRunner is a CommandRunner that records the commands it runs along with their standard input.
+type stdinRecordingRunner struct {
+	commands []string
+	inputs   []string
+}
+
+func (r *stdinRecordingRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	r.commands = append(r.commands, strings.Join(cmd.Args, " "))
+	input := ""
+	if cmd.Stdin != nil {
+		data, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		input = string(data)
+	}
+	r.inputs = append(r.inputs, input)
+	return nil, nil
+}
+
+func TestMakeRestoreInput(t *testing.T) {
+	commands := []*exec.Cmd{
+		exec.Command("iptables", "-t", "mangle", "-N", "PROXY_INIT_REDIRECT", "-m", "comment", "--comment", "proxy-init/redirect-common-chain/1"),
+		exec.Command("iptables", "-t", "mangle", "-A", "PROXY_INIT_REDIRECT", "-p", "tcp", "-j", "TPROXY", "--on-port", "4143"),
+		exec.Command("ip", "-4", "rule", "add", "fwmark", "1", "lookup", "100"),
+		exec.Command("iptables", "-t", "nat", "-N", "PROXY_INIT_OUTPUT"),
+		exec.Command("iptables", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-m", "comment", "--comment", "has spaces", "-j", "RETURN"),
+	}
+
+	input, remaining, err := makeRestoreInput("iptables", commands)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := `*mangle
+:PROXY_INIT_REDIRECT - [0:0]
+-A PROXY_INIT_REDIRECT -p tcp -j TPROXY --on-port 4143
+COMMIT
+*nat
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_OUTPUT -m comment --comment "has spaces" -j RETURN
+COMMIT
+`
+	if string(input) != expected {
+		t.Fatalf("expected input:\n%s\nbut got:\n%s", expected, input)
+	}
+	if len(remaining) != 1 || remaining[0].Args[0] != "ip" {
+		t.Fatalf("expected the ip command to remain but got %v", remaining)
+	}
+
+	if _, _, err := makeRestoreInput("iptables", []*exec.Cmd{exec.Command("iptables", "-t", "nat", "-F", "OUTPUT")}); err == nil {
+		t.Fatal("expected error for a command that isn't a rule or chain addition but got nil")
+	}
+}
+
+func TestConfigureFirewall_UseIptablesRestore(t *testing.T) {
+	runner := &stdinRecordingRunner{}
+	err := ConfigureFirewall(context.Background(), FirewallConfiguration{
+		Mode:               RedirectAllMode,
+		ProxyInboundPort:   4143,
+		ProxyOutgoingPort:  4140,
+		UseIptablesRestore: true,
+		Runner:             runner,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	restores := 0
+	for i, command := range runner.commands {
+		if command != "iptables-restore --noflush" {
+			continue
+		}
+		restores++
+		if !strings.HasPrefix(runner.inputs[i], "*nat\n:PROXY_INIT_REDIRECT - [0:0]\n:PROXY_INIT_OUTPUT - [0:0]\n") {
+			t.Fatalf("unexpected restore input:\n%s", runner.inputs[i])
+		}
+	}
+	if restores != 1 {
+		t.Fatalf("expected a single iptables-restore call but got: %v", runner.commands)
+	}
+	for _, command := range runner.commands {
+		if strings.Contains(command, " -A ") {
+			t.Fatalf("expected no rule to be added outside of iptables-restore but got: %s", command)
+		}
+	}
+}
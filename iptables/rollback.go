@@ -0,0 +1,55 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// tableSnapshot is the content of a table, as listed by iptables-save, before the rules were applied.
+type tableSnapshot struct {
+	configuration FirewallConfiguration
+	table         string
+	content       []byte
+}
+
+// snapshotTables saves the tables holding the proxy-init chains of the IP family of the configuration, so that
+// rollback can restore them if the configuration fails.
+func snapshotTables(firewallConfiguration FirewallConfiguration) ([]tableSnapshot, error) {
+	snapshots := make([]tableSnapshot, 0)
+	seen := make(map[string]bool)
+	for _, chain := range proxyInitChains(firewallConfiguration) {
+		if seen[chain.table] {
+			continue
+		}
+		seen[chain.table] = true
+		out, err := executeCommandWithOutput(firewallConfiguration, makeSaveTable(iptablesSaveBinary(firewallConfiguration), chain.table))
+		if err != nil {
+			return nil, fmt.Errorf("could not save the %s rules of table %s: %w", firewallConfiguration.IPFamily, chain.table, err)
+		}
+		snapshots = append(snapshots, tableSnapshot{firewallConfiguration, chain.table, out})
+	}
+	return snapshots, nil
+}
+
+// rollback restores the tables to their snapshots, the most recent first. The commands aren't bound to the context,
+// as rolling back is precisely what follows a cancellation.
+func rollback(snapshots []tableSnapshot) error {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		familyConfiguration := snapshot.configuration
+		familyConfiguration.ctx = nil
+		logger(familyConfiguration).Info("Rolling back the rules", "family", familyConfiguration.IPFamily, "table", snapshot.table)
+		if err := executeCommand(familyConfiguration, makeRestoreTable(iptablesBinary(familyConfiguration), snapshot.content)); err != nil {
+			return fmt.Errorf("could not restore the %s rules of table %s: %w", familyConfiguration.IPFamily, snapshot.table, err)
+		}
+	}
+	return nil
+}
+
+// makeRestoreTable replaces the tables listed in the input, as produced by iptables-save, with their content.
+func makeRestoreTable(binary string, input []byte) *exec.Cmd {
+	cmd := exec.Command(fmt.Sprintf("%s-restore", binary))
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd
+}
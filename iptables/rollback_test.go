@@ -0,0 +1,104 @@
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// cancelingRunner cancels the context once it runs the given command, recording the commands along with their input.
+type cancelingRunner struct {
+	commands []string
+	inputs   []string
+	outputs  map[string]string
+	cancelAt string
+	cancel   context.CancelFunc
+}
+
+func (r *cancelingRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	command := strings.Join(cmd.Args, " ")
+	input := ""
+	if cmd.Stdin != nil {
+		in, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		input = string(in)
+	}
+	r.commands = append(r.commands, command)
+	r.inputs = append(r.inputs, input)
+	if command == r.cancelAt {
+		r.cancel()
+		return nil, context.Canceled
+	}
+	return []byte(r.outputs[command]), nil
+}
+
+func TestConfigureFirewall_RollbackOnFailure(t *testing.T) {
+	saved := `*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A PREROUTING -m comment --comment "kube-proxy" -j KUBE-SERVICES
+COMMIT
+`
+
+	t.Run("It restores the tables when the context is done partway through", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		runner := &cancelingRunner{
+			outputs:  map[string]string{"iptables-save -t nat": saved},
+			cancelAt: "iptables -t nat -A PREROUTING -j PROXY_INIT_REDIRECT",
+			cancel:   cancel,
+		}
+		err := ConfigureFirewall(ctx, FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			SkipStateDump:     true,
+			DisableComments:   true,
+			RollbackOnFailure: true,
+			Runner:            runner,
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error to wrap [%s] but got [%v]", context.Canceled, err)
+		}
+
+		if first := runner.commands[0]; first != "iptables-save -t nat" {
+			t.Fatalf("expected the table to be saved first but got %s", first)
+		}
+		last := len(runner.commands) - 1
+		if runner.commands[last] != "iptables-restore" || runner.inputs[last] != saved {
+			t.Fatalf("expected the table to be restored last but got %s with input\n%s", runner.commands[last], runner.inputs[last])
+		}
+	})
+
+	t.Run("It leaves the rules in place when rolling back is disabled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		runner := &cancelingRunner{
+			outputs:  map[string]string{"iptables-save -t nat": saved},
+			cancelAt: "iptables -t nat -A PREROUTING -j PROXY_INIT_REDIRECT",
+			cancel:   cancel,
+		}
+		err := ConfigureFirewall(ctx, FirewallConfiguration{
+			Mode:              RedirectAllMode,
+			ProxyInboundPort:  4143,
+			ProxyOutgoingPort: 4140,
+			SkipStateDump:     true,
+			DisableComments:   true,
+			Runner:            runner,
+		})
+		if err == nil {
+			t.Fatal("expected an error but got nil")
+		}
+
+		for _, command := range runner.commands {
+			if strings.HasPrefix(command, "iptables-restore") {
+				t.Fatalf("expected the tables not to be restored but got %v", runner.commands)
+			}
+		}
+	})
+}
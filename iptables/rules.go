@@ -0,0 +1,130 @@
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule is an iptables rule, as listed by iptables-save.
+type Rule struct {
+	// Table is the table holding the rule, such as `nat`.
+	Table string
+	// Chain is the chain holding the rule.
+	Chain string
+	// Matches are the arguments selecting the packets the rule applies to, such as `-p tcp --dport 80`, excluding
+	// the comment.
+	Matches []string
+	// Target is the chain or extension the packets are sent to, such as `REDIRECT`. It is empty for rules without a
+	// target.
+	Target string
+	// TargetOptions are the arguments of the target, such as `--to-ports 4143`.
+	TargetOptions []string
+	// Comment is the comment attached to the rule, if any.
+	Comment string
+}
+
+// TraceID returns the ExecutionTraceID of the run that added the rule, as found at the end of comments generated by
+// proxy-init, or an empty string for comments of another shape.
+func (r Rule) TraceID() string {
+	if strings.Count(r.Comment, "/") < 2 {
+		return ""
+	}
+	return r.Comment[strings.LastIndex(r.Comment, "/")+1:]
+}
+
+// ParseRules parses the output of iptables-save into the rules it lists, in order. Chain policies, counters and
+// comments of the output itself are skipped.
+func ParseRules(saveOutput []byte) ([]Rule, error) {
+	rules := make([]Rule, 0)
+	table := ""
+	for i, line := range strings.Split(string(saveOutput), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ":"), line == "COMMIT":
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+		case strings.HasPrefix(line, "-A "):
+			if table == "" {
+				return nil, fmt.Errorf("line %d: rule outside of a table: %s", i+1, line)
+			}
+			args := splitRuleSpec(line)
+			if len(args) < 2 {
+				return nil, fmt.Errorf("line %d: rule without a chain: %s", i+1, line)
+			}
+			rules = append(rules, parseRule(table, args[1], args[2:]))
+		default:
+			return nil, fmt.Errorf("line %d: unexpected line: %s", i+1, line)
+		}
+	}
+	return rules, nil
+}
+
+// parseRule builds a Rule out of the specification following the chain name. The comment may appear before or after
+// the target, so that the commands built by this package can be parsed as well as iptables-save output.
+func parseRule(table string, chain string, spec []string) Rule {
+	rule := Rule{Table: table, Chain: chain, Matches: make([]string, 0), TargetOptions: make([]string, 0)}
+	inTarget := false
+	for i := 0; i < len(spec); i++ {
+		switch {
+		case spec[i] == "-m" && i+3 < len(spec) && spec[i+1] == "comment" && spec[i+2] == "--comment":
+			rule.Comment = spec[i+3]
+			i += 3
+		case (spec[i] == "-j" || spec[i] == "-g") && i+1 < len(spec):
+			rule.Target = spec[i+1]
+			inTarget = true
+			i++
+		case inTarget && spec[i] != "-m":
+			rule.TargetOptions = append(rule.TargetOptions, spec[i])
+		default:
+			inTarget = false
+			rule.Matches = append(rule.Matches, spec[i])
+		}
+	}
+	return rule
+}
+
+// ruleSpec returns the specification of the rule following the chain name, as accepted by iptables to append or
+// delete it.
+func ruleSpec(rule Rule) []string {
+	spec := append([]string{}, rule.Matches...)
+	if rule.Comment != "" {
+		spec = append(spec, "-m", "comment", "--comment", rule.Comment)
+	}
+	if rule.Target != "" {
+		spec = append(append(spec, "-j", rule.Target), rule.TargetOptions...)
+	}
+	return spec
+}
+
+// splitRuleSpec splits a rule as printed by `iptables -S` or `iptables-save` into its arguments, honoring the
+// double quotes iptables places around arguments containing spaces, such as comments.
+func splitRuleSpec(line string) []string {
+	args := make([]string, 0)
+	var current strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case r == ' ' && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
@@ -0,0 +1,126 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	t.Run("It parses the rules of every table", func(t *testing.T) {
+		rules, err := ParseRules([]byte(`# Generated by iptables-save v1.8.4 on Thu Jan  1 00:00:00 2020
+*mangle
+:PREROUTING ACCEPT [0:0]
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:PROXY_INIT_REDIRECT - [0:0]
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+-A PROXY_INIT_REDIRECT -p tcp -m multiport --dports 4190 -m comment --comment "proxy-init/ignore-port-4190/1234" -j RETURN
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port/1234" -j REDIRECT --to-ports 4143
+-A KUBE-SERVICES ! -s 10.244.0.0/16 -j KUBE-MARK-MASQ
+COMMIT
+# Completed on Thu Jan  1 00:00:00 2020
+`))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := []Rule{
+			{
+				Table:         "nat",
+				Chain:         "PREROUTING",
+				Matches:       []string{},
+				Target:        "PROXY_INIT_REDIRECT",
+				TargetOptions: []string{},
+				Comment:       "proxy-init/install-proxy-init-prerouting/1234",
+			},
+			{
+				Table:         "nat",
+				Chain:         "PROXY_INIT_REDIRECT",
+				Matches:       []string{"-p", "tcp", "-m", "multiport", "--dports", "4190"},
+				Target:        "RETURN",
+				TargetOptions: []string{},
+				Comment:       "proxy-init/ignore-port-4190/1234",
+			},
+			{
+				Table:         "nat",
+				Chain:         "PROXY_INIT_REDIRECT",
+				Matches:       []string{"-p", "tcp"},
+				Target:        "REDIRECT",
+				TargetOptions: []string{"--to-ports", "4143"},
+				Comment:       "proxy-init/redirect-all-incoming-to-proxy-port/1234",
+			},
+			{
+				Table:         "nat",
+				Chain:         "KUBE-SERVICES",
+				Matches:       []string{"!", "-s", "10.244.0.0/16"},
+				Target:        "KUBE-MARK-MASQ",
+				TargetOptions: []string{},
+			},
+		}
+		if !reflect.DeepEqual(rules, expected) {
+			t.Fatalf("expected rules\n%+v\nbut got\n%+v", expected, rules)
+		}
+	})
+
+	t.Run("It parses the commands built for the rules", func(t *testing.T) {
+		cmd := makeRedirectChainToPortBasedOnDestinationPort("iptables", "nat", "PROXY_INIT_REDIRECT", "tcp", "8080", "", 4143, "test")
+		rule := parseRule("nat", cmd.Args[4], cmd.Args[5:])
+
+		expected := Rule{
+			Table:         "nat",
+			Chain:         "PROXY_INIT_REDIRECT",
+			Matches:       []string{"-p", "tcp", "--destination-port", "8080"},
+			Target:        "REDIRECT",
+			TargetOptions: []string{"--to-port", "4143"},
+			Comment:       formatComment("test"),
+		}
+		if !reflect.DeepEqual(rule, expected) {
+			t.Fatalf("expected rule\n%+v\nbut got\n%+v", expected, rule)
+		}
+	})
+
+	t.Run("It rejects malformed output", func(t *testing.T) {
+		for _, output := range []string{
+			"-A PREROUTING -j PROXY_INIT_REDIRECT\n",
+			"*nat\n-A\nCOMMIT\n",
+			"*nat\n-D PREROUTING -j PROXY_INIT_REDIRECT\nCOMMIT\n",
+		} {
+			if _, err := ParseRules([]byte(output)); err == nil {
+				t.Fatalf("expected error for output\n%s", output)
+			}
+		}
+	})
+}
+
+func TestSplitRuleSpec(t *testing.T) {
+	for _, tt := range []struct {
+		line     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"-A OUTPUT -j PROXY_INIT_OUTPUT", []string{"-A", "OUTPUT", "-j", "PROXY_INIT_OUTPUT"}},
+		{`-A OUTPUT -m comment --comment "a \"quoted\" comment" -j RETURN`, []string{"-A", "OUTPUT", "-m", "comment", "--comment", `a "quoted" comment`, "-j", "RETURN"}},
+		{`-A OUTPUT ! -d 127.0.0.1/32 -j RETURN`, []string{"-A", "OUTPUT", "!", "-d", "127.0.0.1/32", "-j", "RETURN"}},
+	} {
+		if args := splitRuleSpec(tt.line); !reflect.DeepEqual(args, tt.expected) {
+			t.Fatalf("expected args %q for [%s] but got %q", tt.expected, tt.line, args)
+		}
+	}
+}
+
+func TestRuleTraceID(t *testing.T) {
+	for _, tt := range []struct {
+		comment  string
+		expected string
+	}{
+		{"proxy-init/redirect-all-incoming-to-proxy-port/1234", "1234"},
+		{"my/mesh/ignore-port-4190/5678", "5678"},
+		{"kube-proxy", ""},
+		{"", ""},
+	} {
+		if traceID := (Rule{Comment: tt.comment}).TraceID(); traceID != tt.expected {
+			t.Fatalf("expected trace ID %q for comment %q but got %q", tt.expected, tt.comment, traceID)
+		}
+	}
+}
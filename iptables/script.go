@@ -0,0 +1,53 @@
+package iptables
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// safeShellWord matches the arguments that don't need quoting in a shell script.
+var safeShellWord = regexp.MustCompile(`^[A-Za-z0-9_./:=,@%+-]+$`)
+
+// DumpScript writes the commands ConfigureFirewall would run as a shell script, one command per line, so that they
+// can be reviewed and run by hand. The commands are wrapped with nsenter and given the wait flags as configured. The
+// chains left behind by a previous run aren't removed by the script.
+func DumpScript(w io.Writer, firewallConfiguration FirewallConfiguration) error {
+	commands, err := BuildRules(firewallConfiguration)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{
+		"#!/bin/sh",
+		fmt.Sprintf("# Generated by proxy-init, trace ID %s", traceID(firewallConfiguration)),
+		"set -e",
+	}
+	for _, cmd := range commands {
+		args := cmd.Args
+		if firewallConfiguration.UseWaitFlag && supportsWaitFlag(cmd) {
+			args = append(append([]string{}, args...), waitFlagArgs(firewallConfiguration)...)
+		}
+		if netnsArgs := nsenterArgs(firewallConfiguration); len(netnsArgs) > 0 {
+			args = append(append([]string{nsenterPath(firewallConfiguration)}, netnsArgs...), args...)
+		}
+		lines = append(lines, shellQuote(args))
+	}
+
+	_, err = io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// shellQuote joins the arguments into a shell command line, single-quoting those containing special characters.
+func shellQuote(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if safeShellWord.MatchString(arg) {
+			quoted = append(quoted, arg)
+			continue
+		}
+		quoted = append(quoted, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
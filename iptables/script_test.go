@@ -0,0 +1,49 @@
+package iptables
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpScript(t *testing.T) {
+	var script bytes.Buffer
+	err := DumpScript(&script, FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		NetNs:             "/var/run/netns/test",
+		UseWaitFlag:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(script.String(), "\n"), "\n")
+	if lines[0] != "#!/bin/sh" || lines[2] != "set -e" {
+		t.Fatalf("expected a shell script header but got:\n%s", script.String())
+	}
+	expected := "nsenter --net=/var/run/netns/test iptables -t nat -A PREROUTING -j PROXY_INIT_REDIRECT -m comment --comment " + formatComment("install-proxy-init-prerouting") + " -w"
+	found := false
+	for _, line := range lines {
+		found = found || line == expected
+	}
+	if !found {
+		t.Fatalf("expected line %q in script:\n%s", expected, script.String())
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"iptables", "-t", "nat", "-A", "OUTPUT", "!", "-d", "127.0.0.1/32"}, "iptables -t nat -A OUTPUT '!' -d 127.0.0.1/32"},
+		{[]string{"--comment", "has spaces"}, "--comment 'has spaces'"},
+		{[]string{"--comment", "it's"}, `--comment 'it'\''s'`},
+	} {
+		if quoted := shellQuote(tt.args); quoted != tt.expected {
+			t.Fatalf("expected %s but got %s", tt.expected, quoted)
+		}
+	}
+}
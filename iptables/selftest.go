@@ -0,0 +1,83 @@
+package iptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ErrSelfTestSkipped is returned by SelfTest when it can't run, because the process isn't running as root.
+var ErrSelfTestSkipped = errors.New("the self-test requires root privileges")
+
+var (
+	// geteuid returns the effective user ID of the process.
+	geteuid = os.Geteuid
+	// netnsDir is where `ip netns` mounts the named network namespaces.
+	netnsDir = "/var/run/netns"
+)
+
+// SelfTest checks that the rules can be applied on this host: it creates a temporary network namespace, configures a
+// representative firewall in it, checks the installed rules against the desired ones with iptables-save, tears the
+// firewall down and deletes the namespace. It returns ErrSelfTestSkipped when not running as root.
+func SelfTest() error {
+	if geteuid() != 0 {
+		return ErrSelfTestSkipped
+	}
+	return selfTest(FirewallConfiguration{})
+}
+
+// selfTest runs the self-test with the runner, logger and binaries of the configuration.
+func selfTest(base FirewallConfiguration) (err error) {
+	name := fmt.Sprintf("proxy-init-self-test-%s", ExecutionTraceID)
+	if err := executeCommand(base, makeAddNetns(name)); err != nil {
+		return fmt.Errorf("could not create the network namespace of the self-test: %w", err)
+	}
+	defer func() {
+		if deleteErr := executeCommand(base, makeDeleteNetns(name)); deleteErr != nil && err == nil {
+			err = fmt.Errorf("could not delete the network namespace of the self-test: %w", deleteErr)
+		}
+	}()
+
+	fc := selfTestConfiguration(base, name)
+	if err := ConfigureFirewall(context.Background(), fc); err != nil {
+		return fmt.Errorf("self-test failed to configure the firewall: %w", err)
+	}
+
+	toAdd, toRemove, err := Diff(fc)
+	if err != nil {
+		return fmt.Errorf("self-test failed to read the rules: %w", err)
+	}
+	if len(toAdd) > 0 || len(toRemove) > 0 {
+		return fmt.Errorf("self-test found %d missing and %d unexpected rules after configuring the firewall", len(toAdd), len(toRemove))
+	}
+
+	if err := TeardownFirewall(context.Background(), fc); err != nil {
+		return fmt.Errorf("self-test failed to tear down the firewall: %w", err)
+	}
+	return nil
+}
+
+// selfTestConfiguration returns the representative configuration applied in the network namespace of the self-test.
+func selfTestConfiguration(base FirewallConfiguration, netns string) FirewallConfiguration {
+	fc := base
+	fc.Mode = RedirectAllMode
+	fc.ProxyInboundPort = 4143
+	fc.ProxyOutgoingPort = 4140
+	fc.ProxyUID = 2102
+	fc.InboundPortsToIgnore = []string{"4190", "4191"}
+	fc.OutboundPortsToIgnore = []string{"443"}
+	fc.NetNs = filepath.Join(netnsDir, netns)
+	fc.VerifyRules = true
+	return fc
+}
+
+func makeAddNetns(name string) *exec.Cmd {
+	return exec.Command("ip", "netns", "add", name)
+}
+
+func makeDeleteNetns(name string) *exec.Cmd {
+	return exec.Command("ip", "netns", "delete", name)
+}
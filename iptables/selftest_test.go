@@ -0,0 +1,54 @@
+package iptables
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest_Skipped(t *testing.T) {
+	defer func(f func() int) { geteuid = f }(geteuid)
+	geteuid = func() int { return 1000 }
+
+	if err := SelfTest(); !errors.Is(err, ErrSelfTestSkipped) {
+		t.Fatalf("expected the self-test to be skipped but got %v", err)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	name := "proxy-init-self-test-" + ExecutionTraceID
+	saveCommand := "nsenter --net=/var/run/netns/" + name + " iptables-save"
+
+	t.Run("It configures, checks and tears down the firewall in a temporary namespace", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{saveCommand: savedRules(t, selfTestConfiguration(FirewallConfiguration{}, name))},
+		}
+
+		if err := selfTest(FirewallConfiguration{Runner: runner}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if first := runner.commands[0]; first != "ip netns add "+name {
+			t.Fatalf("expected the namespace to be created first but got %s", first)
+		}
+		if last := runner.commands[len(runner.commands)-1]; last != "ip netns delete "+name {
+			t.Fatalf("expected the namespace to be deleted last but got %s", last)
+		}
+		for _, command := range runner.commands[1 : len(runner.commands)-1] {
+			if !strings.HasPrefix(command, "nsenter --net=/var/run/netns/"+name+" ") {
+				t.Fatalf("expected the commands to run in the namespace but got %s", command)
+			}
+		}
+	})
+
+	t.Run("It deletes the namespace when the rules can't be verified", func(t *testing.T) {
+		runner := &scriptedRunner{}
+
+		err := selfTest(FirewallConfiguration{Runner: runner})
+		if err == nil || !strings.Contains(err.Error(), "self-test failed to configure the firewall") {
+			t.Fatalf("expected the verification to fail but got %v", err)
+		}
+		if last := runner.commands[len(runner.commands)-1]; last != "ip netns delete "+name {
+			t.Fatalf("expected the namespace to be deleted last but got %s", last)
+		}
+	})
+}
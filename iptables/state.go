@@ -0,0 +1,584 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isAlreadyConfigured checks whether the rules the commands would add are already installed, as left behind by a
+// previous run with the same configuration, along with the TPROXY routing configuration. Any error while reading the
+// live rules is reported as not configured, so that the rules get applied.
+func isAlreadyConfigured(firewallConfiguration FirewallConfiguration, binary string, commands []*exec.Cmd, snapshot *ruleSnapshot) bool {
+	if firewallConfiguration.SimulateOnly {
+		return false
+	}
+	if err := checkRules(firewallConfiguration, binary, commands, snapshot); err != nil {
+		logger(firewallConfiguration).Info("The rules need to be applied", "reason", err)
+		return false
+	}
+	return true
+}
+
+// checkRules compares the rules the commands would add with the installed ones, returning an error describing the
+// differences. Rules are compared by their fingerprint, ignoring the trace ID of the run that added them. In TPROXY
+// mode, the routing of the marked packets is checked as well.
+func checkRules(firewallConfiguration FirewallConfiguration, binary string, commands []*exec.Cmd, snapshot *ruleSnapshot) error {
+	tables, desired, _ := desiredRules(binary, commands)
+	if len(tables) == 0 {
+		return fmt.Errorf("no rules to check")
+	}
+
+	for _, table := range tables {
+		installedRules, err := snapshot.proxyInitRules(table)
+		if err != nil {
+			return err
+		}
+
+		installed, wanted := ruleFingerprints(installedRules), ruleFingerprints(desired[table])
+		if reflect.DeepEqual(installed, wanted) {
+			continue
+		}
+		missing, unexpected := difference(wanted, installed), difference(installed, wanted)
+		if len(missing) == 0 && len(unexpected) == 0 {
+			return fmt.Errorf("the rules of table %s are installed in the wrong order", table)
+		}
+		return fmt.Errorf("the rules of table %s differ from the desired ones: missing %q, unexpected %q", table, missing, unexpected)
+	}
+
+	if firewallConfiguration.ProxyMode == TproxyProxyMode && !firewallConfiguration.SkipInbound {
+		return checkTproxyRouting(firewallConfiguration)
+	}
+	return nil
+}
+
+// checkTproxyRouting checks that the packets marked by TPROXY are delivered locally, as listed by `ip rule` and
+// `ip route`.
+func checkTproxyRouting(firewallConfiguration FirewallConfiguration) error {
+	rules, err := executeCommandWithOutput(firewallConfiguration, makeListRoutingRules(firewallConfiguration.IPFamily))
+	if err != nil {
+		return fmt.Errorf("could not list the routing rules: %w", err)
+	}
+	mark := tproxyMark(firewallConfiguration)
+	if !hasTproxyRoutingRule(rules, mark) {
+		return fmt.Errorf("the routing rule looking up table %d for the packets marked %#x is missing", TproxyRouteTable, mark)
+	}
+
+	routes, err := executeCommandWithOutput(firewallConfiguration, makeListTproxyRoutes(firewallConfiguration.IPFamily))
+	if err != nil {
+		return fmt.Errorf("could not list the routes of table %d: %w", TproxyRouteTable, err)
+	}
+	for _, line := range strings.Split(string(routes), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "local ") {
+			return nil
+		}
+	}
+	return fmt.Errorf("the local route of table %d is missing", TproxyRouteTable)
+}
+
+// hasTproxyRoutingRule checks whether the output of `ip rule show` holds the rule looking up TproxyRouteTable for the
+// packets with the mark, which ip lists in hexadecimal.
+func hasTproxyRoutingRule(listOutput []byte, mark int) bool {
+	for _, line := range strings.Split(string(listOutput), "\n") {
+		fields := strings.Fields(line)
+		markMatches, tableMatches := false, false
+		for i := 0; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "fwmark":
+				value, err := strconv.ParseUint(strings.SplitN(fields[i+1], "/", 2)[0], 0, 32)
+				markMatches = err == nil && value == uint64(mark)
+			case "lookup", "table":
+				tableMatches = fields[i+1] == strconv.Itoa(TproxyRouteTable)
+			}
+		}
+		if markMatches && tableMatches {
+			return true
+		}
+	}
+	return false
+}
+
+// desiredRules returns the rules the commands run with the binary would add, grouped by table, along with the tables
+// in the order they are first used and the chains the commands create.
+func desiredRules(binary string, commands []*exec.Cmd) ([]string, map[string][]Rule, map[string]bool) {
+	tables := make([]string, 0)
+	desired := make(map[string][]Rule)
+	created := make(map[string]bool)
+	for _, cmd := range commands {
+		if chain, ok := createdChain(binary, cmd); ok {
+			created[chain] = true
+		}
+		rule, ok := addedRule(binary, cmd)
+		if !ok {
+			continue
+		}
+		if _, ok := desired[rule.Table]; !ok {
+			tables = append(tables, rule.Table)
+		}
+		desired[rule.Table] = append(desired[rule.Table], rule)
+	}
+	return tables, desired, created
+}
+
+// addedRule returns the rule the command adds when it appends or inserts a rule with the binary.
+func addedRule(binary string, cmd *exec.Cmd) (Rule, bool) {
+	args := cmd.Args[1:]
+	if cmd.Args[0] != binary || len(args) < 4 || args[0] != "-t" || (args[2] != "-A" && args[2] != "-I") {
+		return Rule{}, false
+	}
+	table, chain, spec := args[1], args[3], args[4:]
+	if args[2] == "-I" && len(spec) > 0 {
+		// skip the position of inserted rules
+		if _, err := strconv.Atoi(spec[0]); err == nil {
+			spec = spec[1:]
+		}
+	}
+	return parseRule(table, chain, spec), true
+}
+
+// createdChain returns the chain the command creates when it creates one with the binary.
+func createdChain(binary string, cmd *exec.Cmd) (string, bool) {
+	args := cmd.Args[1:]
+	if cmd.Args[0] != binary || len(args) < 4 || args[0] != "-t" || args[2] != "-N" {
+		return "", false
+	}
+	return args[3], true
+}
+
+// Diff compares the rules BuildRules would add with the proxy-init rules installed in the configured network
+// namespace, returning the rules to add and the installed rules to remove for the latter to match the former. Rules
+// are compared by their chain, matches, comment without the trace ID, target and target options, as done when
+// checking whether a previous run already applied the configuration.
+//
+// The rules of the chains created by proxy-init are evaluated in order, so past the first rule differing from the
+// desired ones, every installed rule of such a chain is to be removed and every desired one to be added. In the other
+// chains, such as PREROUTING and OUTPUT, only the presence of the rules matters. For DualStackFamily, the IPv4 rules
+// are listed first.
+func Diff(firewallConfiguration FirewallConfiguration) (toAdd, toRemove []Rule, err error) {
+	firewallConfiguration = resolveBackend(firewallConfiguration)
+	commands, err := BuildRules(firewallConfiguration)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	toAdd, toRemove = make([]Rule, 0), make([]Rule, 0)
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		added, removed, err := diffFamily(familyConfiguration, commands, newRuleSnapshot(familyConfiguration))
+		if err != nil {
+			return nil, nil, err
+		}
+		toAdd, toRemove = append(toAdd, added...), append(toRemove, removed...)
+	}
+	return toAdd, toRemove, nil
+}
+
+// diffFamily compares the rules the commands would add for the IP family of the configuration with the installed ones.
+// Every table proxy-init uses is read, not only those of the desired rules, so that the rules left in a table the
+// configuration no longer uses are reported as to be removed.
+func diffFamily(firewallConfiguration FirewallConfiguration, commands []*exec.Cmd, snapshot *ruleSnapshot) ([]Rule, []Rule, error) {
+	toAdd, toRemove := make([]Rule, 0), make([]Rule, 0)
+	tables, desired, created := desiredRules(iptablesBinary(firewallConfiguration), commands)
+	for _, table := range proxyInitTables(firewallConfiguration) {
+		if _, ok := desired[table]; !ok {
+			tables = append(tables, table)
+		}
+	}
+	for _, table := range tables {
+		installed, err := snapshot.proxyInitRules(table)
+		if err != nil {
+			return nil, nil, err
+		}
+		added, removed := diffRules(desired[table], installed, created)
+		toAdd, toRemove = append(toAdd, added...), append(toRemove, removed...)
+	}
+	return toAdd, toRemove, nil
+}
+
+// diffRules returns the desired rules missing from the installed ones and the installed rules that aren't desired,
+// comparing the rules of the ordered chains position by position.
+func diffRules(desired []Rule, installed []Rule, ordered map[string]bool) ([]Rule, []Rule) {
+	desiredByChain, installedByChain := rulesByChain(desired), rulesByChain(installed)
+	chains := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, rule := range append(append([]Rule{}, desired...), installed...) {
+		if !seen[rule.Chain] {
+			seen[rule.Chain] = true
+			chains = append(chains, rule.Chain)
+		}
+	}
+
+	toAdd, toRemove := make([]Rule, 0), make([]Rule, 0)
+	for _, chain := range chains {
+		wanted, live := desiredByChain[chain], installedByChain[chain]
+		if ordered[chain] {
+			common := 0
+			for common < len(wanted) && common < len(live) && ruleFingerprint(wanted[common]) == ruleFingerprint(live[common]) {
+				common++
+			}
+			toAdd, toRemove = append(toAdd, wanted[common:]...), append(toRemove, live[common:]...)
+			continue
+		}
+		toAdd = append(toAdd, missingRules(wanted, live)...)
+		toRemove = append(toRemove, missingRules(live, wanted)...)
+	}
+	return toAdd, toRemove
+}
+
+// rulesByChain groups the rules by chain, keeping their order within each chain.
+func rulesByChain(rules []Rule) map[string][]Rule {
+	byChain := make(map[string][]Rule)
+	for _, rule := range rules {
+		byChain[rule.Chain] = append(byChain[rule.Chain], rule)
+	}
+	return byChain
+}
+
+// missingRules returns the rules of a whose fingerprint isn't found in b.
+func missingRules(a []Rule, b []Rule) []Rule {
+	found := make(map[string]bool, len(b))
+	for _, rule := range b {
+		found[ruleFingerprint(rule)] = true
+	}
+	missing := make([]Rule, 0)
+	for _, rule := range a {
+		if !found[ruleFingerprint(rule)] {
+			missing = append(missing, rule)
+		}
+	}
+	return missing
+}
+
+// ruleFingerprints returns the fingerprints of the rules grouped by chain, keeping the order of the rules within each
+// chain. iptables-save lists the rules chain by chain, regardless of the order they were added in.
+func ruleFingerprints(rules []Rule) []string {
+	sorted := append([]Rule{}, rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Chain < sorted[j].Chain
+	})
+	fingerprints := make([]string, 0, len(sorted))
+	for _, rule := range sorted {
+		fingerprints = append(fingerprints, ruleFingerprint(rule))
+	}
+	return fingerprints
+}
+
+// difference returns the elements of a not found in b.
+func difference(a []string, b []string) []string {
+	found := make(map[string]bool, len(b))
+	for _, element := range b {
+		found[element] = true
+	}
+	diff := make([]string, 0)
+	for _, element := range a {
+		if !found[element] {
+			diff = append(diff, element)
+		}
+	}
+	return diff
+}
+
+// ListInstalledRules returns the rules added by proxy-init, as identified by the configured comment prefix, from the
+// nat, mangle and raw tables of the configured IP families, running iptables-save in the configured network namespace. For
+// DualStackFamily, the IPv4 rules are listed first.
+func ListInstalledRules(firewallConfiguration FirewallConfiguration) ([]Rule, error) {
+	firewallConfiguration = resolveBackend(firewallConfiguration)
+
+	installed := make([]Rule, 0)
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		for _, table := range proxyInitTables(familyConfiguration) {
+			rules, err := readRules(familyConfiguration, table)
+			if err != nil {
+				return nil, fmt.Errorf("could not read the %s rules of table %s: %w", family, table, err)
+			}
+			for _, rule := range rules {
+				if isProxyInitComment(familyConfiguration, rule.Comment) {
+					installed = append(installed, rule)
+				}
+			}
+		}
+	}
+	return installed, nil
+}
+
+// proxyInitTables returns the tables proxy-init adds rules to, whether or not the configuration uses them.
+func proxyInitTables(firewallConfiguration FirewallConfiguration) []string {
+	return []string{natTable(firewallConfiguration), "mangle", "raw"}
+}
+
+// verifyRules checks that the jumps into the proxy-init chains are installed, as listed by iptables-save.
+func verifyRules(firewallConfiguration FirewallConfiguration, binary string) error {
+	if firewallConfiguration.SimulateOnly {
+		return nil
+	}
+
+	snapshot := newRuleSnapshot(firewallConfiguration)
+	for _, jump := range proxyInitJumps(firewallConfiguration) {
+		rules, err := snapshot.tableRules(jump.table)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, rule := range rules {
+			if rule.Chain == jump.chain && rule.Target == jump.target {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("the jump from chain %s to chain %s is missing from table %s", jump.chain, jump.target, jump.table)
+		}
+	}
+	return nil
+}
+
+// ruleSnapshot lists the rules of every table with a single iptables-save run, made the first time they are needed,
+// so that the checks made before applying a configuration share the same listing.
+type ruleSnapshot struct {
+	firewallConfiguration FirewallConfiguration
+	read                  bool
+	rules                 map[string][]Rule
+	err                   error
+}
+
+func newRuleSnapshot(firewallConfiguration FirewallConfiguration) *ruleSnapshot {
+	return &ruleSnapshot{firewallConfiguration: firewallConfiguration}
+}
+
+// tableRules returns the rules installed in the table.
+func (s *ruleSnapshot) tableRules(table string) ([]Rule, error) {
+	if !s.read {
+		s.read = true
+		out, err := executeCommandWithOutput(s.firewallConfiguration, makeSaveAll(iptablesSaveBinary(s.firewallConfiguration)))
+		var rules []Rule
+		if err == nil {
+			rules, err = ParseRules(out)
+		}
+		if err != nil {
+			s.err = fmt.Errorf("could not read the rules: %w", err)
+		}
+		s.rules = make(map[string][]Rule)
+		for _, rule := range rules {
+			s.rules[rule.Table] = append(s.rules[rule.Table], rule)
+		}
+	}
+	return s.rules[table], s.err
+}
+
+// proxyInitRules returns the rules installed in the table by proxy-init.
+func (s *ruleSnapshot) proxyInitRules(table string) ([]Rule, error) {
+	rules, err := s.tableRules(table)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make([]Rule, 0)
+	for _, rule := range rules {
+		if isProxyInitRule(s.firewallConfiguration, rule) {
+			installed = append(installed, rule)
+		}
+	}
+	return installed, nil
+}
+
+// readRules lists the rules installed in the table.
+func readRules(firewallConfiguration FirewallConfiguration, table string) ([]Rule, error) {
+	out, err := executeCommandWithOutput(firewallConfiguration, makeSaveTable(iptablesSaveBinary(firewallConfiguration), table))
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(out)
+}
+
+// ruleFingerprint summarizes a rule by its chain, its matches, its comment without the trace ID, and its target along
+// with the target options. The matches and target options are normalized with normalizeOptions, so that a rule built
+// by this package and the same rule listed by iptables-save have the same fingerprint.
+func ruleFingerprint(rule Rule) string {
+	return fmt.Sprintf("%s [%s] %s %s [%s]", rule.Chain, strings.Join(normalizeOptions(rule.Matches), " "), stripTraceID(rule.Comment), rule.Target, strings.Join(normalizeOptions(rule.TargetOptions), " "))
+}
+
+// optionAliases maps the long forms of the options this package passes to iptables to the forms iptables-save lists.
+var optionAliases = map[string]string{
+	"--match":             "-m",
+	"--protocol":          "-p",
+	"--source":            "-s",
+	"--destination":       "-d",
+	"--in-interface":      "-i",
+	"--out-interface":     "-o",
+	"--source-port":       "--sport",
+	"--destination-port":  "--dport",
+	"--source-ports":      "--sports",
+	"--destination-ports": "--dports",
+	"--to-port":           "--to-ports",
+}
+
+// normalizeOptions splits the arguments into options, each with its values and preceded by its negation, if any,
+// rewritten the way iptables-save lists them and sorted. Module loads such as `-m tcp` are left out, as iptables-save
+// adds the implicit ones, and the options of a module identify it anyway.
+func normalizeOptions(args []string) []string {
+	options := make([]string, 0)
+	var current []string
+	negated := false
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		if option := normalizeOption(current); option != "" {
+			if negated {
+				option = "! " + option
+			}
+			options = append(options, option)
+		}
+		current, negated = nil, false
+	}
+	for _, arg := range args {
+		switch {
+		case arg == "!":
+			flush()
+			negated = true
+		case strings.HasPrefix(arg, "-"):
+			flush()
+			current = []string{arg}
+		default:
+			current = append(current, arg)
+		}
+	}
+	flush()
+	sort.Strings(options)
+	return options
+}
+
+// normalizeOption rewrites the option, followed by its values, the way iptables-save lists it, or returns an empty
+// string for the options left out of the comparison.
+func normalizeOption(option []string) string {
+	name, values := option[0], append([]string{}, option[1:]...)
+	if alias, ok := optionAliases[name]; ok {
+		name = alias
+	}
+	switch name {
+	case "-m":
+		return ""
+	case "--on-ip":
+		// TPROXY lists the address it listens on even when it's the default one.
+		if len(values) == 1 && (values[0] == "0.0.0.0" || values[0] == "::") {
+			return ""
+		}
+	case "-s", "-d":
+		for i, value := range values {
+			values[i] = normalizeCIDR(value)
+		}
+	case "--tproxy-mark", "--set-xmark", "--mark":
+		for i, value := range values {
+			values[i] = normalizeMark(value)
+		}
+	case "--ctstate":
+		for i, value := range values {
+			states := strings.Split(value, ",")
+			sort.Strings(states)
+			values[i] = strings.Join(states, ",")
+		}
+	case "--limit":
+		for i, value := range values {
+			values[i] = normalizeRate(value)
+		}
+	}
+	return strings.TrimSpace(name + " " + strings.Join(values, " "))
+}
+
+// normalizeCIDR returns the network of the address or CIDR, with the prefix length iptables-save adds to addresses.
+func normalizeCIDR(value string) string {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return value
+		}
+		if ip.To4() != nil {
+			return value + "/32"
+		}
+		return value + "/128"
+	}
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network.String()
+	}
+	return value
+}
+
+// normalizeMark returns the mark, with its optional mask, in hexadecimal as iptables-save lists it, the mask defaulting
+// to 0xffffffff.
+func normalizeMark(value string) string {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "0xffffffff")
+	}
+	for i, part := range parts {
+		number, err := strconv.ParseUint(part, 0, 32)
+		if err != nil {
+			return value
+		}
+		parts[i] = fmt.Sprintf("%#x", number)
+	}
+	return strings.Join(parts, "/")
+}
+
+// normalizeRate returns the rate of the limit match with the unit iptables-save lists, such as `10/sec` for `10/s`.
+func normalizeRate(value string) string {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return value
+	}
+	// iptables only looks at the first letter of the unit.
+	for _, unit := range []string{"sec", "min", "hour", "day"} {
+		if parts[1][0] == unit[0] {
+			return parts[0] + "/" + unit
+		}
+	}
+	return value
+}
+
+// isProxyInitRule checks whether the rule was added by proxy-init, based on its comment or, when comments are
+// disabled, on it being held in or jumping to a proxy-init chain.
+func isProxyInitRule(firewallConfiguration FirewallConfiguration, rule Rule) bool {
+	if !firewallConfiguration.DisableComments {
+		return isProxyInitComment(firewallConfiguration, rule.Comment)
+	}
+	for _, chain := range proxyInitChainNames(firewallConfiguration) {
+		if rule.Chain == chain || rule.Target == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyInitChainNames returns the names of the chains proxy-init creates, whichever of them the configuration uses.
+func proxyInitChainNames(firewallConfiguration FirewallConfiguration) []string {
+	return []string{redirectChainName(firewallConfiguration), outputChainName(firewallConfiguration), ProxyInitPostroutingChainName, ProxyInitNotrackChainName}
+}
+
+// isProxyInitComment checks whether the comment was generated by formatComment, with the configured prefix.
+func isProxyInitComment(firewallConfiguration FirewallConfiguration, comment string) bool {
+	return strings.HasPrefix(comment, commentPrefix(firewallConfiguration)+"/")
+}
+
+// stripTraceID removes the trace ID formatComment appends to comments.
+func stripTraceID(comment string) string {
+	if i := strings.LastIndex(comment, "/"); i >= 0 {
+		return comment[:i]
+	}
+	return comment
+}
+
+func makeSaveTable(saveBinary string, table string) *exec.Cmd {
+	return exec.Command(saveBinary, "-t", table)
+}
+
+func makeSaveAll(saveBinary string) *exec.Cmd {
+	return exec.Command(saveBinary)
+}
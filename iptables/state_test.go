@@ -0,0 +1,507 @@
+package iptables
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// savedRules renders the nat rules the configuration would add the way iptables-save lists them, chain by chain, as
+// installed by an earlier run with a different trace ID.
+func savedRules(t *testing.T, fc FirewallConfiguration) string {
+	return savedTable(t, fc, "nat")
+}
+
+// savedTable renders the rules the configuration would add to the table, as savedRules does for the nat table.
+func savedTable(t *testing.T, fc FirewallConfiguration, table string) string {
+	commands, err := BuildRules(fc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	chains := make([]string, 0)
+	rulesByChain := make(map[string][]string)
+	for _, cmd := range commands {
+		if len(cmd.Args) < 4 || cmd.Args[1] != "-t" || cmd.Args[2] != table {
+			continue
+		}
+		args := cmd.Args[3:]
+		if args[0] == "-I" {
+			args = append([]string{"-A", args[1]}, args[3:]...)
+		}
+		if args[0] != "-A" {
+			continue
+		}
+		if _, ok := rulesByChain[args[1]]; !ok {
+			chains = append(chains, args[1])
+		}
+		line := strings.Join(args, " ")
+		line = strings.Replace(line, "/"+ExecutionTraceID, "/1234", 1)
+		rulesByChain[args[1]] = append(rulesByChain[args[1]], line)
+	}
+
+	sort.Strings(chains)
+	lines := []string{"*" + table}
+	for _, chain := range chains {
+		lines = append(lines, rulesByChain[chain]...)
+	}
+	return strings.Join(append(lines, "COMMIT"), "\n")
+}
+
+func TestConfigureFirewall_AlreadyConfigured(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProxyUID:               2102,
+	}
+
+	t.Run("It leaves matching rules untouched", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, fc)},
+		}
+		fc.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), fc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 1 {
+			t.Fatalf("expected only the rules to be read but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It leaves matching inserted jumps untouched", func(t *testing.T) {
+		inserted := fc
+		inserted.JumpPosition = 1
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, inserted)},
+		}
+		inserted.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), inserted); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 1 {
+			t.Fatalf("expected only the rules to be read but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It only considers the rules with the configured comment prefix", func(t *testing.T) {
+		forked := fc
+		forked.CommentPrefix = "my-mesh"
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, fc) + "\n" + savedRules(t, forked)},
+		}
+		forked.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), forked); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 1 {
+			t.Fatalf("expected only the rules to be read but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It leaves matching rules without comments untouched", func(t *testing.T) {
+		uncommented := fc
+		uncommented.DisableComments = true
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": `*nat
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -m comment --comment "kube-proxy" -j KUBE-SERVICES
+COMMIT
+` + savedRules(t, uncommented)},
+		}
+		uncommented.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), uncommented); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 1 {
+			t.Fatalf("expected only the rules to be read but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It checks the routing of TPROXY traffic", func(t *testing.T) {
+		tproxied := fc
+		tproxied.ProxyMode = TproxyProxyMode
+		saved := savedRules(t, tproxied) + "\n" + savedTable(t, tproxied, "mangle")
+		routingRules := "0:\tfrom all lookup local\n32765:\tfrom all fwmark 0x1 lookup 100\n32766:\tfrom all lookup main\n"
+
+		runner := &scriptedRunner{
+			outputs: map[string]string{
+				"iptables-save":              saved,
+				"ip -4 rule show":            routingRules,
+				"ip -4 route show table 100": "local default dev lo scope host\n",
+			},
+		}
+		tproxied.Runner = runner
+		if err := ConfigureFirewall(context.Background(), tproxied); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 3 {
+			t.Fatalf("expected only the rules and routing to be read but got %v", runner.commands)
+		}
+
+		runner = &scriptedRunner{
+			outputs: map[string]string{
+				"iptables-save":              saved,
+				"ip -4 rule show":            "0:\tfrom all lookup local\n32766:\tfrom all lookup main\n",
+				"ip -4 route show table 100": "local default dev lo scope host\n",
+			},
+		}
+		tproxied.Runner = runner
+		if err := ConfigureFirewall(context.Background(), tproxied); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		reapplied := false
+		for _, command := range runner.commands {
+			if command == "ip -4 rule add fwmark 1 lookup 100" {
+				reapplied = true
+			}
+		}
+		if !reapplied {
+			t.Fatalf("expected the rules to be reapplied without the routing rule but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It reapplies rules that differ", func(t *testing.T) {
+		previous := fc
+		previous.ProxyOutgoingPort = 4141
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, previous)},
+		}
+		fc.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), fc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) == 1 {
+			t.Fatalf("expected the rules to be reapplied but got %v", runner.commands)
+		}
+	})
+
+	for _, tt := range []struct {
+		name   string
+		change func(c *FirewallConfiguration)
+	}{
+		{"It reapplies rules whose proxy UID differs", func(c *FirewallConfiguration) { c.ProxyUID = 9999 }},
+		{"It reapplies rules whose interface differs", func(c *FirewallConfiguration) { c.InboundInterface = "eth1" }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &scriptedRunner{
+				outputs: map[string]string{"iptables-save": savedRules(t, fc)},
+			}
+			changed := fc
+			tt.change(&changed)
+			changed.Runner = runner
+
+			if err := ConfigureFirewall(context.Background(), changed); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(runner.commands) == 1 {
+				t.Fatalf("expected the rules to be reapplied but got %v", runner.commands)
+			}
+		})
+	}
+
+	t.Run("It reconciles rules that differ without removing the chains", func(t *testing.T) {
+		previous := fc
+		previous.ProxyOutgoingPort = 4141
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, previous)},
+		}
+		reconciled := fc
+		reconciled.ReconcileExisting = true
+		reconciled.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), reconciled); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		deleted := false
+		for _, command := range runner.commands {
+			if strings.Contains(command, " -F ") || strings.Contains(command, " -X ") {
+				t.Fatalf("expected no chain to be flushed or deleted but got %s", command)
+			}
+			deleted = deleted || (strings.Contains(command, " -D ") && strings.Contains(command, "--to-port 4141"))
+		}
+		if !deleted {
+			t.Fatalf("expected the stale rule to be deleted but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It applies the rules when none are installed", func(t *testing.T) {
+		runner := &scriptedRunner{}
+		fc.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), fc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) == 1 {
+			t.Fatalf("expected the rules to be applied but got %v", runner.commands)
+		}
+	})
+}
+
+func TestRuleFingerprint(t *testing.T) {
+	built := parseRule("nat", "PROXY_INIT_REDIRECT", []string{"-p", "tcp", "--destination-port", "8080", "-j", "REDIRECT", "--to-port", "4143", "-m", "comment", "--comment", "proxy-init/redirect-port-8080-to-proxy-port/5678"})
+	saved, err := ParseRules([]byte("*nat\n" +
+		`-A PROXY_INIT_REDIRECT -p tcp -m tcp --dport 8080 -m comment --comment "proxy-init/redirect-port-8080-to-proxy-port/1234" -j REDIRECT --to-ports 4143` +
+		"\n-A PROXY_INIT_OUTPUT -d 10.0.0.1/32 -m owner ! --uid-owner 2102 -j RETURN\nCOMMIT\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ruleFingerprint(built) != ruleFingerprint(saved[0]) {
+		t.Fatalf("expected the built and saved rules to match but got %q and %q", ruleFingerprint(built), ruleFingerprint(saved[0]))
+	}
+
+	for _, args := range [][]string{
+		{"-m", "owner", "!", "--uid-owner", "2102", "-d", "10.0.0.1", "-j", "RETURN"},
+		{"-d", "10.0.0.1", "-m", "owner", "!", "--uid-owner", "2102", "-j", "RETURN"},
+	} {
+		if rule := parseRule("nat", "PROXY_INIT_OUTPUT", args); ruleFingerprint(rule) != ruleFingerprint(saved[1]) {
+			t.Fatalf("expected %v to match the saved rule but got %q and %q", args, ruleFingerprint(rule), ruleFingerprint(saved[1]))
+		}
+	}
+	for _, args := range [][]string{
+		{"-d", "10.0.0.1", "-m", "owner", "--uid-owner", "2102", "-j", "RETURN"},
+		{"-d", "10.0.0.1", "-m", "owner", "!", "--uid-owner", "9999", "-j", "RETURN"},
+		{"-d", "10.0.0.2", "-m", "owner", "!", "--uid-owner", "2102", "-j", "RETURN"},
+	} {
+		if rule := parseRule("nat", "PROXY_INIT_OUTPUT", args); ruleFingerprint(rule) == ruleFingerprint(saved[1]) {
+			t.Fatalf("expected %v not to match the saved rule", args)
+		}
+	}
+}
+
+func TestConfigureFirewall_VerifyRules(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		VerifyRules:       true,
+	}
+
+	t.Run("It succeeds when the jumps are installed", func(t *testing.T) {
+		fc.Runner = &scriptedRunner{
+			outputs: map[string]string{"iptables-save": `*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output/1234" -j PROXY_INIT_OUTPUT
+COMMIT
+`},
+		}
+
+		if err := ConfigureFirewall(context.Background(), fc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	})
+
+	t.Run("It fails when a jump is missing", func(t *testing.T) {
+		fc.Runner = &scriptedRunner{
+			outputs: map[string]string{"iptables-save": `*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+COMMIT
+`},
+		}
+
+		err := ConfigureFirewall(context.Background(), fc)
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if !strings.Contains(err.Error(), "jump from chain OUTPUT to chain PROXY_INIT_OUTPUT is missing") {
+			t.Fatalf("expected error to name the missing jump but got: %s", err)
+		}
+	})
+}
+
+func TestConfigureFirewall_CheckMode(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProxyUID:               2102,
+	}
+
+	t.Run("It succeeds without changing anything when the rules are installed", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, fc)},
+		}
+		checked := fc
+		checked.CheckMode = true
+		checked.Runner = runner
+
+		if err := ConfigureFirewall(context.Background(), checked); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 1 {
+			t.Fatalf("expected only the rules to be read but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It reports drift without changing anything", func(t *testing.T) {
+		previous := fc
+		previous.PortsToRedirectInbound = []int{9090}
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, previous)},
+		}
+		checked := fc
+		checked.CheckMode = true
+		checked.Runner = runner
+
+		err := ConfigureFirewall(context.Background(), checked)
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if !strings.Contains(err.Error(), "redirect-port-8080-to-proxy-port") || !strings.Contains(err.Error(), "redirect-port-9090-to-proxy-port") {
+			t.Fatalf("expected error to describe the drift but got: %s", err)
+		}
+		if len(runner.commands) != 1 {
+			t.Fatalf("expected only the rules to be read but got %v", runner.commands)
+		}
+	})
+
+	t.Run("It reports a rule whose only difference is a match", func(t *testing.T) {
+		previous := fc
+		previous.ProxyUID = 9999
+		runner := &scriptedRunner{
+			outputs: map[string]string{"iptables-save": savedRules(t, previous)},
+		}
+		checked := fc
+		checked.CheckMode = true
+		checked.Runner = runner
+
+		err := ConfigureFirewall(context.Background(), checked)
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if !strings.Contains(err.Error(), "--uid-owner 9999") {
+			t.Fatalf("expected error to describe the drift but got: %s", err)
+		}
+	})
+}
+
+func TestListInstalledRules(t *testing.T) {
+	runner := &scriptedRunner{
+		outputs: map[string]string{
+			"nsenter --net=/var/run/netns/test iptables-save -t nat": `*nat
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -m comment --comment "kube-proxy" -j KUBE-SERVICES
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+COMMIT
+`,
+		},
+	}
+
+	rules, err := ListInstalledRules(FirewallConfiguration{Runner: runner, NetNs: "/var/run/netns/test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(rules) != 1 {
+		t.Fatalf("expected a single proxy-init rule but got %v", rules)
+	}
+	if rules[0].Chain != IptablesPreroutingChainName || rules[0].Target != ProxyInitRedirectChainName || rules[0].TraceID() != "1234" {
+		t.Fatalf("unexpected rule %+v", rules[0])
+	}
+}
+
+func TestDiff(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProxyUID:               2102,
+	}
+
+	comments := func(rules []Rule) []string {
+		stripped := make([]string, 0, len(rules))
+		for _, rule := range rules {
+			stripped = append(stripped, stripTraceID(rule.Comment))
+		}
+		return stripped
+	}
+
+	for _, tt := range []struct {
+		name      string
+		installed FirewallConfiguration
+		toAdd     []string
+		toRemove  []string
+	}{
+		{
+			name:      "It reports nothing for matching rules",
+			installed: fc,
+			toAdd:     []string{},
+			toRemove:  []string{},
+		},
+		{
+			name: "It reports the rules to add and remove",
+			installed: func() FirewallConfiguration {
+				previous := fc
+				previous.PortsToRedirectInbound = []int{8080, 9090}
+				previous.ProxyOutgoingPort = 4141
+				return previous
+			}(),
+			toAdd:    []string{"proxy-init/ignore-proxy-ports", "proxy-init/redirect-port-8080-to-proxy-port", "proxy-init/redirect-all-outgoing-to-proxy-port"},
+			toRemove: []string{"proxy-init/ignore-proxy-ports", "proxy-init/redirect-port-8080-to-proxy-port", "proxy-init/redirect-port-9090-to-proxy-port", "proxy-init/redirect-all-outgoing-to-proxy-port"},
+		},
+		{
+			name: "It reports the rules whose matches differ",
+			installed: func() FirewallConfiguration {
+				previous := fc
+				previous.ProxyUID = 9999
+				return previous
+			}(),
+			toAdd:    []string{"proxy-init/redirect-non-loopback-local-traffic", "proxy-init/ignore-proxy-user-id", "proxy-init/ignore-loopback", "proxy-init/redirect-all-outgoing-to-proxy-port"},
+			toRemove: []string{"proxy-init/redirect-non-loopback-local-traffic", "proxy-init/ignore-proxy-user-id", "proxy-init/ignore-loopback", "proxy-init/redirect-all-outgoing-to-proxy-port"},
+		},
+		{
+			name: "It reports the rules following a difference in a proxy-init chain",
+			installed: func() FirewallConfiguration {
+				previous := fc
+				previous.PortsToRedirectInbound = []int{80, 8080}
+				return previous
+			}(),
+			toAdd:    []string{"proxy-init/redirect-port-8080-to-proxy-port"},
+			toRemove: []string{"proxy-init/redirect-port-80-to-proxy-port", "proxy-init/redirect-port-8080-to-proxy-port"},
+		},
+		{
+			name: "It reports the rules of the tables no longer used",
+			installed: func() FirewallConfiguration {
+				previous := fc
+				previous.NoTrackPorts = []int{9000}
+				return previous
+			}(),
+			toAdd:    []string{},
+			toRemove: []string{"proxy-init/install-proxy-init-notrack-output", "proxy-init/install-proxy-init-notrack-prerouting", "proxy-init/notrack-port-9000", "proxy-init/notrack-port-9000-replies"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			desired := fc
+			desired.Runner = &scriptedRunner{
+				outputs: map[string]string{
+					"iptables-save": savedRules(t, tt.installed) + "\n" + savedTable(t, tt.installed, "raw"),
+				},
+			}
+
+			toAdd, toRemove, err := Diff(desired)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(comments(toAdd), tt.toAdd) {
+				t.Fatalf("expected to add %q but got %q", tt.toAdd, comments(toAdd))
+			}
+			if !reflect.DeepEqual(comments(toRemove), tt.toRemove) {
+				t.Fatalf("expected to remove %q but got %q", tt.toRemove, comments(toRemove))
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// multiError aggregates the errors of steps that are all attempted even when some of them fail.
+type multiError []error
+
+func (m multiError) Error() string {
+	messages := make([]string, 0, len(m))
+	for _, err := range m {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// errorOrNil returns nil when no error was collected, so that callers don't return a non-nil empty multiError.
+func (m multiError) errorOrNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// TeardownFirewall removes everything ConfigureFirewall installs: the jump rules from the `PREROUTING` and `OUTPUT`
+// chains, the proxy-init chains themselves and, in TPROXY mode, the routing configuration. Every step is attempted
+// even if a previous one failed, and the failures are returned together. Anything already gone is skipped, so tearing
+// down twice succeeds. Commands are killed once ctx is done.
+func TeardownFirewall(ctx context.Context, firewallConfiguration FirewallConfiguration) error {
+	firewallConfiguration.ctx = ctx
+	logger(firewallConfiguration).Info("Tracing this script execution", "traceID", traceID(firewallConfiguration))
+
+	firewallConfiguration = resolveBackend(firewallConfiguration)
+
+	var errs multiError
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		for _, err := range teardownFirewallForFamily(familyConfiguration) {
+			errs = append(errs, fmt.Errorf("failed to tear down %s firewall: %w", family, err))
+		}
+	}
+	return errs.errorOrNil()
+}
+
+func teardownFirewallForFamily(firewallConfiguration FirewallConfiguration) multiError {
+	binary := iptablesBinary(firewallConfiguration)
+	errs := removeJumps(firewallConfiguration)
+
+	for _, chain := range removableChains(firewallConfiguration) {
+		if err := executeCommand(firewallConfiguration, makeFlushChain(binary, chain.table, chain.name)); err != nil && !isMissingObject(err) {
+			errs = append(errs, fmt.Errorf("could not flush chain %s: %w", chain.name, err))
+		}
+		if err := executeCommand(firewallConfiguration, makeDeleteChain(binary, chain.table, chain.name)); err != nil && !isMissingObject(err) {
+			errs = append(errs, fmt.Errorf("could not delete chain %s: %w", chain.name, err))
+		}
+	}
+
+	if firewallConfiguration.ProxyMode == TproxyProxyMode && !firewallConfiguration.SkipInbound {
+		if err := executeCommand(firewallConfiguration, makeDeleteTproxyRoutingRule(firewallConfiguration.IPFamily, tproxyMark(firewallConfiguration))); err != nil && !isMissingObject(err) {
+			errs = append(errs, fmt.Errorf("could not delete the TPROXY routing rule: %w", err))
+		}
+		if err := executeCommand(firewallConfiguration, makeFlushTproxyRouteTable(firewallConfiguration.IPFamily)); err != nil {
+			errs = append(errs, fmt.Errorf("could not flush the TPROXY route table: %w", err))
+		}
+	}
+	return errs
+}
+
+// removeJumps deletes the jumps from the built-in chains into the proxy-init chains, as listed by `iptables -S`, so
+// that the chains can then be deleted. With PreserveForeignChains, the jumps proxy-init didn't add are left in place.
+func removeJumps(firewallConfiguration FirewallConfiguration) multiError {
+	binary := iptablesBinary(firewallConfiguration)
+	var errs multiError
+	for _, jump := range proxyInitJumps(firewallConfiguration) {
+		out, err := executeCommandWithOutput(firewallConfiguration, makeListChainRules(binary, jump.table, jump.chain))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not list the rules of chain %s: %w", jump.chain, err))
+			continue
+		}
+		for _, rule := range findJumpRules(out, jump.target) {
+			if firewallConfiguration.PreserveForeignChains && !isProxyInitComment(firewallConfiguration, parseRule(jump.table, rule[0], rule[1:]).Comment) {
+				logger(firewallConfiguration).Info("Leaving a jump proxy-init didn't add", "chain", jump.chain, "rule", rule)
+				continue
+			}
+			if err := executeCommand(firewallConfiguration, makeDeleteRule(binary, jump.table, rule)); err != nil {
+				errs = append(errs, fmt.Errorf("could not delete jump from %s to %s: %w", jump.chain, jump.target, err))
+			}
+		}
+	}
+	return errs
+}
+
+// CleanupByTraceID deletes the rules added by the run with the given ExecutionTraceID, as identified by their
+// comments, one by one. Unlike TeardownFirewall, it leaves the rules of other runs and the chains themselves in place.
+// Every rule is attempted even if deleting a previous one failed, and the failures are returned together.
+func CleanupByTraceID(firewallConfiguration FirewallConfiguration, traceID string) error {
+	if traceID == "" {
+		return fmt.Errorf("a trace ID is required")
+	}
+	logger(firewallConfiguration).Info("Removing the rules of a previous run", "traceID", traceID)
+
+	firewallConfiguration = resolveBackend(firewallConfiguration)
+
+	var errs multiError
+	for _, family := range ipFamilies(firewallConfiguration) {
+		familyConfiguration := firewallConfiguration
+		familyConfiguration.IPFamily = family
+		binary := iptablesBinary(familyConfiguration)
+
+		for _, table := range proxyInitTables(familyConfiguration) {
+			rules, err := readRules(familyConfiguration, table)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("could not read the %s rules of table %s: %w", family, table, err))
+				continue
+			}
+			for _, rule := range rules {
+				if !isProxyInitComment(familyConfiguration, rule.Comment) || !strings.HasSuffix(rule.Comment, "/"+traceID) {
+					continue
+				}
+				if err := executeCommand(familyConfiguration, makeDeleteRule(binary, table, append([]string{rule.Chain}, ruleSpec(rule)...))); err != nil {
+					errs = append(errs, fmt.Errorf("could not delete %s rule %q from chain %s: %w", family, rule.Comment, rule.Chain, err))
+				}
+			}
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// findJumpRules returns the specifications of the rules jumping to the target chain, as found in the output of
+// `iptables -S`, starting with the name of the chain holding the rule.
+func findJumpRules(listOutput []byte, target string) [][]string {
+	rules := make([][]string, 0)
+	for _, line := range strings.Split(string(listOutput), "\n") {
+		args := splitRuleSpec(line)
+		if len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+		for i := 2; i < len(args)-1; i++ {
+			if args[i] == "-j" && args[i+1] == target {
+				rules = append(rules, args[1:])
+				break
+			}
+		}
+	}
+	return rules
+}
+
+func makeListChainRules(binary string, table string, chainName string) *exec.Cmd {
+	return exec.Command(binary,
+		"-t", table,
+		"-S", chainName)
+}
+
+func makeDeleteRule(binary string, table string, rule []string) *exec.Cmd {
+	return exec.Command(binary, append([]string{"-t", table, "-D"}, rule...)...)
+}
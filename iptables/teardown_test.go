@@ -0,0 +1,188 @@
+package iptables
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scriptedRunner is a CommandRunner that records the commands it runs and answers them with canned outputs and
+// errors, keyed by the command line.
+type scriptedRunner struct {
+	commands []string
+	outputs  map[string]string
+	errors   map[string]error
+}
+
+func (r *scriptedRunner) Run(cmd *exec.Cmd) ([]byte, error) {
+	command := strings.Join(cmd.Args, " ")
+	r.commands = append(r.commands, command)
+	return []byte(r.outputs[command]), r.errors[command]
+}
+
+func TestCleanupByTraceID(t *testing.T) {
+	runner := &scriptedRunner{
+		outputs: map[string]string{
+			"iptables-save -t nat": `*nat
+:PREROUTING ACCEPT [0:0]
+:PROXY_INIT_REDIRECT - [0:0]
+-A PREROUTING -m comment --comment "kube-proxy" -j KUBE-SERVICES
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/5678" -j PROXY_INIT_REDIRECT
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port/1234" -j REDIRECT --to-ports 4143
+COMMIT
+`,
+		},
+	}
+
+	err := CleanupByTraceID(FirewallConfiguration{Runner: runner}, "1234")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"iptables-save -t nat",
+		"iptables -t nat -D PREROUTING -m comment --comment proxy-init/install-proxy-init-prerouting/1234 -j PROXY_INIT_REDIRECT",
+		"iptables -t nat -D PROXY_INIT_REDIRECT -p tcp -m comment --comment proxy-init/redirect-all-incoming-to-proxy-port/1234 -j REDIRECT --to-ports 4143",
+		"iptables-save -t mangle",
+		"iptables-save -t raw",
+	}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Fatalf("unexpected commands:\ngot:\n%s\nexpected:\n%s", strings.Join(runner.commands, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestTeardownFirewall(t *testing.T) {
+	t.Run("It removes the jump rules and the proxy-init chains", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{
+				"iptables -t nat -S PREROUTING": `-P PREROUTING ACCEPT
+-A PREROUTING -m comment --comment "kube-proxy" -j KUBE-SERVICES
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+`,
+				"iptables -t nat -S OUTPUT": `-P OUTPUT ACCEPT
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output/1234" -j PROXY_INIT_OUTPUT
+`,
+			},
+		}
+
+		err := TeardownFirewall(context.Background(), FirewallConfiguration{Runner: runner})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := []string{
+			"iptables -t nat -S PREROUTING",
+			"iptables -t nat -D PREROUTING -m comment --comment proxy-init/install-proxy-init-prerouting/1234 -j PROXY_INIT_REDIRECT",
+			"iptables -t nat -S OUTPUT",
+			"iptables -t nat -D OUTPUT -m comment --comment proxy-init/install-proxy-init-output/1234 -j PROXY_INIT_OUTPUT",
+			"iptables -t nat -F PROXY_INIT_REDIRECT",
+			"iptables -t nat -X PROXY_INIT_REDIRECT",
+			"iptables -t nat -F PROXY_INIT_OUTPUT",
+			"iptables -t nat -X PROXY_INIT_OUTPUT",
+		}
+		if !reflect.DeepEqual(runner.commands, expected) {
+			t.Fatalf("unexpected commands:\ngot:\n%s\nexpected:\n%s", strings.Join(runner.commands, "\n"), strings.Join(expected, "\n"))
+		}
+	})
+
+	t.Run("It leaves the jumps proxy-init didn't add when preserving foreign chains", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{
+				"iptables -t nat -S PREROUTING": `-P PREROUTING ACCEPT
+-A PREROUTING -j PROXY_INIT_REDIRECT
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting/1234" -j PROXY_INIT_REDIRECT
+`,
+			},
+		}
+
+		err := TeardownFirewall(context.Background(), FirewallConfiguration{Runner: runner, SkipOutbound: true, PreserveForeignChains: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := []string{
+			"iptables -t nat -S PREROUTING",
+			"iptables -t nat -D PREROUTING -m comment --comment proxy-init/install-proxy-init-prerouting/1234 -j PROXY_INIT_REDIRECT",
+			"iptables -t nat -F PROXY_INIT_REDIRECT",
+			"iptables -t nat -X PROXY_INIT_REDIRECT",
+		}
+		if !reflect.DeepEqual(runner.commands, expected) {
+			t.Fatalf("unexpected commands:\ngot:\n%s\nexpected:\n%s", strings.Join(runner.commands, "\n"), strings.Join(expected, "\n"))
+		}
+	})
+
+	t.Run("It leaves the chain of a skipped direction alone", func(t *testing.T) {
+		runner := &scriptedRunner{}
+
+		err := TeardownFirewall(context.Background(), FirewallConfiguration{Runner: runner, SkipOutbound: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := []string{
+			"iptables -t nat -S PREROUTING",
+			"iptables -t nat -F PROXY_INIT_REDIRECT",
+			"iptables -t nat -X PROXY_INIT_REDIRECT",
+		}
+		if !reflect.DeepEqual(runner.commands, expected) {
+			t.Fatalf("unexpected commands:\ngot:\n%s\nexpected:\n%s", strings.Join(runner.commands, "\n"), strings.Join(expected, "\n"))
+		}
+	})
+
+	t.Run("It removes the raw table chain once", func(t *testing.T) {
+		runner := &scriptedRunner{
+			outputs: map[string]string{
+				"iptables -t raw -S PREROUTING": `-P PREROUTING ACCEPT
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-notrack-prerouting/1234" -j PROXY_INIT_NOTRACK
+`,
+				"iptables -t raw -S OUTPUT": `-P OUTPUT ACCEPT
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-notrack-output/1234" -j PROXY_INIT_NOTRACK
+`,
+			},
+		}
+
+		err := TeardownFirewall(context.Background(), FirewallConfiguration{Runner: runner, SkipInbound: true, SkipOutbound: true, NoTrackPorts: []int{9000}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := []string{
+			"iptables -t raw -S PREROUTING",
+			"iptables -t raw -D PREROUTING -m comment --comment proxy-init/install-proxy-init-notrack-prerouting/1234 -j PROXY_INIT_NOTRACK",
+			"iptables -t raw -S OUTPUT",
+			"iptables -t raw -D OUTPUT -m comment --comment proxy-init/install-proxy-init-notrack-output/1234 -j PROXY_INIT_NOTRACK",
+			"iptables -t raw -F PROXY_INIT_NOTRACK",
+			"iptables -t raw -X PROXY_INIT_NOTRACK",
+		}
+		if !reflect.DeepEqual(runner.commands, expected) {
+			t.Fatalf("unexpected commands:\ngot:\n%s\nexpected:\n%s", strings.Join(runner.commands, "\n"), strings.Join(expected, "\n"))
+		}
+	})
+
+	t.Run("It attempts every step and aggregates the failures", func(t *testing.T) {
+		runner := &scriptedRunner{
+			errors: map[string]error{
+				"iptables -t nat -X PROXY_INIT_REDIRECT": errors.New("exit status 1"),
+				"iptables -t nat -X PROXY_INIT_OUTPUT":   errors.New("exit status 1"),
+			},
+		}
+
+		err := TeardownFirewall(context.Background(), FirewallConfiguration{Runner: runner})
+		if err == nil {
+			t.Fatal("expected error but got nil")
+		}
+		if len(err.(multiError)) != 2 {
+			t.Fatalf("expected 2 aggregated errors but got: %s", err)
+		}
+		if !strings.Contains(err.Error(), "could not delete chain PROXY_INIT_OUTPUT") {
+			t.Fatalf("expected error to name the failing chain but got: %s", err)
+		}
+		if len(runner.commands) != 6 {
+			t.Fatalf("expected all 6 commands to be attempted but got %v", runner.commands)
+		}
+	})
+}